@@ -0,0 +1,192 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultLogFormat is the access log format used unless -log-format is set.
+const defaultLogFormat = "[$remote_addr] $request_time $status $request_method $request_uri"
+
+// logEntry is what the access log variables are taken from.
+type logEntry struct {
+	s     *server
+	r     *http.Request
+	w     *wrapResponseWriter
+	start time.Time
+	end   time.Time
+}
+
+// logSegment is a literal or, if value is set, a variable of a log format.
+type logSegment struct {
+	literal string
+	value   func(e *logEntry) string
+}
+
+// logVariables are the variables of -log-format, named as in nginx's
+// log_format. $http_<name> and $sent_http_<name> give request and response
+// headers.
+var logVariables = map[string]func(e *logEntry) string{
+	"remote_addr":     func(e *logEntry) string { return e.s.clientIP(e.r) },
+	"time_local":      func(e *logEntry) string { return e.start.Format("02/Jan/2006:15:04:05 -0700") },
+	"time_iso8601":    func(e *logEntry) string { return e.start.Format(time.RFC3339) },
+	"msec":            func(e *logEntry) string { return fmt.Sprintf("%.3f", float64(e.start.UnixNano())/1e9) },
+	"request":         func(e *logEntry) string { return e.r.Method + " " + e.s.loggedRequestURI(e.r) + " " + e.r.Proto },
+	"request_method":  func(e *logEntry) string { return e.r.Method },
+	"request_uri":     func(e *logEntry) string { return e.s.loggedRequestURI(e.r) },
+	"uri":             func(e *logEntry) string { return e.r.URL.Path },
+	"args":            func(e *logEntry) string { return e.s.redactQuery(e.r.URL.RawQuery) },
+	"host":            func(e *logEntry) string { return requestHost(e.r) },
+	"server_protocol": func(e *logEntry) string { return e.r.Proto },
+	"status":          func(e *logEntry) string { return strconv.Itoa(e.w.status) },
+	"body_bytes_sent": func(e *logEntry) string { return strconv.FormatInt(e.w.bytes, 10) },
+	"request_time":    func(e *logEntry) string { return fmt.Sprintf("%.3f", e.end.Sub(e.start).Seconds()) },
+}
+
+// loggedRequestURI returns the request URI with the API key of
+// -api-key-param, if any, redacted.
+func (s *server) loggedRequestURI(r *http.Request) string {
+	path, query, ok := strings.Cut(r.RequestURI, "?")
+	if !ok {
+		return path
+	}
+	return path + "?" + s.redactQuery(query)
+}
+
+// redactQuery replaces the values of the -api-key-param parameter of a raw
+// query, leaving the rest of it as it was sent.
+func (s *server) redactQuery(query string) string {
+	if s.apiKeyParam == "" || query == "" {
+		return query
+	}
+	params := strings.Split(query, "&")
+	for i, p := range params {
+		name, _, _ := strings.Cut(p, "=")
+		if n, err := url.QueryUnescape(name); err == nil && n == s.apiKeyParam {
+			params[i] = name + "=REDACTED"
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// parseLogFormat parses a format of literal text and $name or ${name}
+// variables.
+func (s *server) parseLogFormat(format string) ([]logSegment, error) {
+	var segments []logSegment
+	for format != "" {
+		i := strings.IndexByte(format, '$')
+		if i < 0 {
+			segments = append(segments, logSegment{literal: format})
+			break
+		}
+		if i > 0 {
+			segments = append(segments, logSegment{literal: format[:i]})
+		}
+		format = format[i+1:]
+		var name string
+		if strings.HasPrefix(format, "{") {
+			end := strings.IndexByte(format, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("log format: unterminated ${")
+			}
+			name, format = format[1:end], format[end+1:]
+		} else {
+			end := 0
+			for end < len(format) && isLogNameByte(format[end]) {
+				end++
+			}
+			name, format = format[:end], format[end:]
+		}
+		value, err := s.logVariable(name)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, logSegment{value: value})
+	}
+	return segments, nil
+}
+
+func isLogNameByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_'
+}
+
+func (s *server) logVariable(name string) (func(e *logEntry) string, error) {
+	if v, ok := logVariables[name]; ok {
+		return v, nil
+	}
+	if h := strings.TrimPrefix(name, "http_"); h != name && h != "" {
+		key := headerKey(h)
+		return func(e *logEntry) string { return e.r.Header.Get(key) }, nil
+	}
+	if h := strings.TrimPrefix(name, "sent_http_"); h != name && h != "" {
+		key := headerKey(h)
+		return func(e *logEntry) string { return s.sentHeader(e.w.Header(), key) }, nil
+	}
+	return nil, fmt.Errorf("log format: unknown variable $%s", name)
+}
+
+// headerKey turns the header part of a variable name (user_agent) into a
+// header key (User-Agent).
+func headerKey(name string) string {
+	return textproto.CanonicalMIMEHeaderKey(strings.ReplaceAll(name, "_", "-"))
+}
+
+// sentHeader looks key up in the response header, which may have been
+// renamed by -header-names.
+func (s *server) sentHeader(h http.Header, key string) string {
+	if v := h.Get(key); v != "" {
+		return v
+	}
+	if name, ok := s.headerNames[key]; ok && len(h[name]) > 0 {
+		return h[name][0]
+	}
+	return ""
+}
+
+// setupAccessLog parses -log-format. Unless New was given a logger for them,
+// access logs go to the standard logger, and a custom format is written to
+// stderr as is, without the timestamp the default one gets.
+func (s *server) setupAccessLog(format string) error {
+	custom := format != ""
+	if !custom {
+		format = defaultLogFormat
+	}
+	segments, err := s.parseLogFormat(format)
+	if err != nil {
+		return err
+	}
+	s.accessLogFormat = segments
+	switch {
+	case s.accessLogger != nil:
+	case custom:
+		s.accessLogger = log.New(os.Stderr, "", 0)
+	default:
+		s.accessLogger = log.Default()
+	}
+	return nil
+}
+
+// logAccess writes the access log line for a request. Empty values are
+// written as "-".
+func (s *server) logAccess(e *logEntry) {
+	var b strings.Builder
+	for _, seg := range s.accessLogFormat {
+		if seg.value == nil {
+			b.WriteString(seg.literal)
+			continue
+		}
+		v := seg.value(e)
+		if v == "" {
+			v = "-"
+		}
+		b.WriteString(v)
+	}
+	s.accessLogger.Printf("%s", b.String())
+}
@@ -0,0 +1,160 @@
+package gcsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxAccessKeys bounds the number of prefixes counted at once. Beyond it,
+// requests are counted under the prefix "*" of their bucket.
+const maxAccessKeys = 10000
+
+type accessKey struct {
+	bucket, prefix, storageClass string
+}
+
+type accessCount struct {
+	requests, bytes int64
+	last            time.Time
+}
+
+type accessCounter struct {
+	mu      sync.Mutex
+	since   time.Time
+	entries map[accessKey]*accessCount
+}
+
+func newAccessCounter() *accessCounter {
+	return &accessCounter{since: time.Now(), entries: make(map[accessKey]*accessCount)}
+}
+
+// accessPrefix returns the first -access-stats-depth segments of the object
+// name, which group objects in the export. Objects with fewer segments are
+// grouped under their parent "folder".
+func accessPrefix(object string, depth int) string {
+	segments := strings.SplitAfter(object, "/")
+	if len(segments) > depth {
+		segments = segments[:depth]
+	} else {
+		segments = segments[:len(segments)-1]
+	}
+	return strings.Join(segments, "")
+}
+
+// record counts a request for an object of the given size and class, grouped
+// by the first depth segments of its name.
+func (c *accessCounter) record(depth int, bucket, object string, size int64, storageClass string) {
+	if depth <= 0 {
+		return
+	}
+	key := accessKey{bucket, accessPrefix(object, depth), storageClass}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		if len(c.entries) >= maxAccessKeys {
+			key.prefix = "*"
+			e, ok = c.entries[key]
+		}
+		if !ok {
+			e = &accessCount{}
+			c.entries[key] = e
+		}
+	}
+	e.requests++
+	e.bytes += size
+	e.last = time.Now()
+}
+
+// take returns the counts and resets them.
+func (c *accessCounter) take() (since time.Time, entries map[accessKey]*accessCount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	since, entries = c.since, c.entries
+	c.since, c.entries = time.Now(), make(map[accessKey]*accessCount)
+	return since, entries
+}
+
+// restore adds counts that couldn't be exported back, so the next export
+// includes them.
+func (c *accessCounter) restore(since time.Time, entries map[accessKey]*accessCount) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.since = since
+	for key, e := range entries {
+		cur, ok := c.entries[key]
+		if !ok {
+			c.entries[key] = e
+			continue
+		}
+		cur.requests += e.requests
+		cur.bytes += e.bytes
+		if e.last.After(cur.last) {
+			cur.last = e.last
+		}
+	}
+}
+
+// prefixAccess is a line of an export.
+type prefixAccess struct {
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	Bucket       string    `json:"bucket"`
+	Prefix       string    `json:"prefix"`
+	StorageClass string    `json:"storageClass,omitempty"`
+	Requests     int64     `json:"requests"`
+	Bytes        int64     `json:"bytes"`
+	LastAccess   time.Time `json:"lastAccess"`
+}
+
+// exportAccess writes the counts since the last export to
+// <bucket>/<prefix><time>.json as newline-delimited JSON, one line per
+// prefix, most requested prefixes first.
+func (s *server) exportAccess(ctx context.Context, bucket, prefix string) error {
+	since, entries := s.accessStats.take()
+	now := time.Now()
+	var lines []prefixAccess
+	for key, e := range entries {
+		lines = append(lines, prefixAccess{
+			From:         since.UTC(),
+			To:           now.UTC(),
+			Bucket:       key.bucket,
+			Prefix:       key.prefix,
+			StorageClass: key.storageClass,
+			Requests:     e.requests,
+			Bytes:        e.bytes,
+			LastAccess:   e.last.UTC(),
+		})
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		a, b := lines[i], lines[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Bucket+"/"+a.Prefix < b.Bucket+"/"+b.Prefix
+	})
+
+	name := prefix + now.UTC().Format("20060102T150405Z") + ".json"
+	ow := s.storageClient().Bucket(bucket).Object(name).NewWriter(ctx)
+	ow.ContentType = "application/x-ndjson"
+	enc := json.NewEncoder(ow)
+	var err error
+	for _, line := range lines {
+		if err = enc.Encode(line); err != nil {
+			break
+		}
+	}
+	if cerr := ow.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.accessStats.restore(since, entries)
+		return fmt.Errorf("%s/%s: %v", bucket, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// account is an entry of the accounts section of the config file: the
+// credentials used for the objects of buckets matching Bucket (which may
+// contain wildcards) whose names start with Prefix, instead of the proxy's
+// own. Keyfile is a service account key file; Impersonate is the email of a
+// service account to impersonate, with the key file's credentials if one is
+// given or else the proxy's:
+//
+//	{"accounts": [
+//	  {"bucket": "billing-*", "impersonate": "billing-reader@billing.iam.gserviceaccount.com"},
+//	  {"bucket": "media", "prefix": "licensed/", "keyfile": "/etc/gcsproxy/licensed.json"}
+//	]}
+//
+// The account with the longest prefix covering an object is used.
+type account struct {
+	Bucket      string `json:"bucket"`
+	Prefix      string `json:"prefix,omitempty"`
+	Keyfile     string `json:"keyfile,omitempty"`
+	Impersonate string `json:"impersonate,omitempty"`
+
+	client *storage.Client
+}
+
+// compileAccounts validates accounts and creates their clients.
+func (s *server) compileAccounts(accounts []account) error {
+	for i := range accounts {
+		a := &accounts[i]
+		if _, err := parseBucketPatterns(a.Bucket); err != nil || a.Bucket == "" {
+			return fmt.Errorf("account %d: invalid bucket %q", i, a.Bucket)
+		}
+		if a.Keyfile == "" && a.Impersonate == "" {
+			return fmt.Errorf("account %d: keyfile or impersonate is required", i)
+		}
+		opts := s.endpointOptions()
+		if !s.usingEmulator() {
+			creds, err := accountCredentials(a)
+			if err != nil {
+				return fmt.Errorf("account %d: %v", i, err)
+			}
+			opts = append(opts, creds...)
+		}
+		c, err := s.newStorageClient(ctx, opts...)
+		if err != nil {
+			return fmt.Errorf("account %d: %v", i, err)
+		}
+		a.client = c
+	}
+	return nil
+}
+
+// accountCredentials returns the client options for the account's
+// credentials.
+func accountCredentials(a *account) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if a.Keyfile != "" {
+		opts = append(opts, option.WithCredentialsFile(a.Keyfile))
+	}
+	if a.Impersonate != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: a.Impersonate,
+			Scopes:          []string{storage.ScopeFullControl},
+		}, opts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = []option.ClientOption{option.WithTokenSource(ts)}
+	}
+	return opts, nil
+}
+
+// accountFor returns the account of the object, or nil if none covers it.
+func (s *server) accountFor(bucket, object string) *account {
+	accounts := s.activeRules().accounts
+	var match *account
+	for i, a := range accounts {
+		if !matchBucket([]string{a.Bucket}, bucket) || !strings.HasPrefix(object, a.Prefix) {
+			continue
+		}
+		if match == nil || len(a.Prefix) > len(match.Prefix) {
+			match = &accounts[i]
+		}
+	}
+	return match
+}
+
+// clientFor returns the client for the object's account, or the proxy's
+// own client if no account covers it.
+func (s *server) clientFor(bucket, object string) *storage.Client {
+	if a := s.accountFor(bucket, object); a != nil {
+		return a.client
+	}
+	return s.storageClient()
+}
+
+// bucketHandle returns a handle for the bucket, using the account of the
+// object or prefix that will be accessed through it.
+func (s *server) bucketHandle(bucket, object string) *storage.BucketHandle {
+	return s.clientFor(bucket, object).Bucket(bucket)
+}
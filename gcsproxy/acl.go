@@ -0,0 +1,197 @@
+package gcsproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// aclRule is an entry of the acl section of the config file. It sets who
+// may read the objects whose <bucket>/<object> matches Path, a glob in which
+// * matches within a path segment and ** across segments:
+//
+//	{"acl": [
+//	  {"path": "assets/admin/**", "groups": ["ops@example.com"]},
+//	  {"path": "assets/**", "public": true}
+//	]}
+//
+// The first matching rule applies. A rule that isn't public requires an
+// authenticated request that satisfies all of its requirements; groups and
+// users are satisfied by any of their entries.
+type aclRule struct {
+	Path   string `json:"path"`
+	Public bool   `json:"public,omitempty"`
+	// Claims must be present in the request's token, as for routes.
+	Claims map[string]string `json:"claims,omitempty"`
+	// Groups are matched against the groups claim or, for Google
+	// identities, checked with Cloud Identity, see inGroup.
+	Groups []string `json:"groups,omitempty"`
+	// Users are matched against the sub and email claims.
+	Users []string `json:"users,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// compileACL validates the rules and compiles their paths.
+func compileACL(acl []aclRule) error {
+	for i := range acl {
+		rule := &acl[i]
+		if rule.Path == "" {
+			return fmt.Errorf("acl rule %d: path is required", i)
+		}
+		if rule.Public && (len(rule.Claims) > 0 || len(rule.Groups) > 0 || len(rule.Users) > 0) {
+			return fmt.Errorf("acl rule %d: a public rule can't have requirements", i)
+		}
+		re, err := regexp.Compile(globPattern(rule.Path))
+		if err != nil {
+			return fmt.Errorf("acl rule %d: %v", i, err)
+		}
+		rule.re = re
+	}
+	return nil
+}
+
+// globPattern translates a path glob to an anchored regular expression.
+func globPattern(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// matchACL returns the first rule matching the object, or nil.
+func (rules *rules) matchACL(bucket, object string) *aclRule {
+	name := bucket + "/" + object
+	for i := range rules.acl {
+		if rules.acl[i].re.MatchString(name) {
+			return &rules.acl[i]
+		}
+	}
+	return nil
+}
+
+// aclActive reports whether requests may come without credentials, to be
+// authorized per object by the acl section.
+func (s *server) aclActive() bool {
+	return len(s.activeRules().acl) > 0
+}
+
+// anonymousKey marks requests an authentication option passed on without
+// credentials because of the acl section. Its value is the challenge to
+// answer them with, if any.
+type anonymousKey struct{}
+
+// passAnonymous passes a request without credentials on to checkACL, which
+// only serves it objects of public rules.
+func passAnonymous(r *http.Request, challenge string) *http.Request {
+	if prev, _ := r.Context().Value(anonymousKey{}).(string); prev != "" {
+		challenge = prev
+	}
+	return r.WithContext(context.WithValue(r.Context(), anonymousKey{}, challenge))
+}
+
+// checkACL answers with a 401 or 403 and returns false if the acl rule
+// matching the object denies the request. Requests that lack the
+// credentials of any authentication option are only served objects of
+// public rules; objects no rule matches are otherwise served as without an
+// acl section.
+func (s *server) checkACL(w http.ResponseWriter, r *http.Request, rules *rules, bucket, object string) bool {
+	status, rule, err := s.aclVerdict(r, rules, bucket, object)
+	switch status {
+	case 0:
+		return true
+	case http.StatusUnauthorized:
+		if challenge, anonymous := r.Context().Value(anonymousKey{}).(string); anonymous {
+			if challenge != "" {
+				w.Header().Set("WWW-Authenticate", challenge)
+			}
+		} else if s.htpasswd != "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", s.basicAuthRealm))
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gcsproxy"`)
+		}
+	case http.StatusServiceUnavailable:
+		s.warnf("acl-groups", "Failed to check group membership: %v", err)
+	case http.StatusForbidden:
+		s.noticef("acl-denied:"+rule.Path, "ACL rule %s denied %s/%s to %s", rule.Path, bucket, object, claimString(requestClaims(r)["sub"]))
+	}
+	http.Error(w, http.StatusText(status), status)
+	return false
+}
+
+// aclVerdict returns the status checkACL answers a request for the object
+// with, or 0 if the acl allows it, along with the rule that matched.
+func (s *server) aclVerdict(r *http.Request, rules *rules, bucket, object string) (int, *aclRule, error) {
+	rule := rules.matchACL(bucket, object)
+	if rule != nil && rule.Public {
+		return 0, rule, nil
+	}
+	if _, anonymous := r.Context().Value(anonymousKey{}).(string); anonymous {
+		return http.StatusUnauthorized, rule, nil
+	}
+	if rule == nil {
+		return 0, nil, nil
+	}
+	c := requestClaims(r)
+	if c == nil {
+		return http.StatusUnauthorized, rule, nil
+	}
+	allowed, err := s.aclAllows(r, rule, c)
+	if err != nil {
+		return http.StatusServiceUnavailable, rule, err
+	}
+	if !allowed {
+		return http.StatusForbidden, rule, nil
+	}
+	return 0, rule, nil
+}
+
+// aclAllows reports whether the claims satisfy the rule.
+func (s *server) aclAllows(r *http.Request, rule *aclRule, c claims) (bool, error) {
+	for name, value := range rule.Claims {
+		if !c.has(name, value) {
+			return false, nil
+		}
+	}
+	if len(rule.Users) > 0 && !c.hasAny("sub", rule.Users) && !c.hasAny("email", rule.Users) {
+		return false, nil
+	}
+	if len(rule.Groups) == 0 {
+		return true, nil
+	}
+	for _, group := range rule.Groups {
+		ok, err := s.inGroup(r, c, group)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// inGroup reports whether the token lists the group in its groups claim or,
+// for Google identities, whether Cloud Identity has the user as a member.
+func (s *server) inGroup(r *http.Request, c claims, group string) (bool, error) {
+	if c.has("groups", group) {
+		return true, nil
+	}
+	email, _ := c["email"].(string)
+	if email == "" || !strings.Contains(group, "@") || (s.googleVerifier == nil && s.iapVerifier == nil) {
+		return false, nil
+	}
+	return s.isGroupMember(r.Context(), group, email)
+}
@@ -0,0 +1,119 @@
+package gcsproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobPattern(t *testing.T) {
+	tests := []struct {
+		glob, name string
+		want       bool
+	}{
+		{"site/*.html", "site/index.html", true},
+		{"site/*.html", "site/docs/index.html", false},
+		{"site/**", "site/docs/index.html", true},
+		{"site/**", "site/", true},
+		{"site/**", "sites/a", false},
+		{"**/secret.txt", "a/b/secret.txt", true},
+		{"site/?.txt", "site/a.txt", true},
+		{"site/?.txt", "site/ab.txt", false},
+		{"site/?.txt", "site//.txt", false},
+		{"site/a+b(1).txt", "site/a+b(1).txt", true},
+		{"site/a.txt", "site/abtxt", false},
+		{"site/a.txt", "site/a.txt.bak", false},
+	}
+	for _, tt := range tests {
+		re := regexp.MustCompile(globPattern(tt.glob))
+		if got := re.MatchString(tt.name); got != tt.want {
+			t.Errorf("%q matching %q = %v, want %v", tt.glob, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompileACL(t *testing.T) {
+	invalid := [][]aclRule{
+		{{Public: true}},
+		{{Path: "a/**", Public: true, Users: []string{"alice"}}},
+	}
+	for _, acl := range invalid {
+		if err := compileACL(acl); err == nil {
+			t.Errorf("%+v was accepted", acl)
+		}
+	}
+	acl := []aclRule{{Path: "a/**", Public: true}, {Path: "**", Users: []string{"alice"}}}
+	if err := compileACL(acl); err != nil {
+		t.Fatal(err)
+	}
+	rules := &rules{acl: acl}
+	if rule := rules.matchACL("a", "b/c"); rule != &acl[0] {
+		t.Errorf("a/b/c matched %+v", rule)
+	}
+	if rule := rules.matchACL("b", "c"); rule != &acl[1] {
+		t.Errorf("b/c matched %+v", rule)
+	}
+}
+
+// setRules makes the rules of cfg active on s.
+func setRules(t *testing.T, s *server, cfg *fileConfig) {
+	t.Helper()
+	r, err := s.newRules("", "", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.currentRules.Store(r)
+}
+
+func TestACL(t *testing.T) {
+	s := newServer()
+	s.bearerVerifier = newTestVerifier(t, "")
+	setRules(t, s, &fileConfig{ACL: []aclRule{
+		{Path: "site/admin/**", Groups: []string{"ops"}},
+		{Path: "site/drafts/*", Users: []string{"editor@example.com"}},
+		{Path: "site/**", Public: true},
+	}})
+	h := s.authenticate(func(w http.ResponseWriter, r *http.Request) {
+		bucket, object, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if s.checkACL(w, r, s.activeRules(), bucket, object) {
+			io.WriteString(w, "ok")
+		}
+	})
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	ops := "Bearer " + signTestToken(t, claims{"sub": "1", "groups": []string{"ops"}, "exp": exp})
+	editor := "Bearer " + signTestToken(t, claims{"sub": "2", "email": "editor@example.com", "exp": exp})
+
+	tests := []struct {
+		path, auth string
+		want       int
+	}{
+		{"/site/index.html", "", http.StatusOK},
+		{"/site/admin/report.txt", "", http.StatusUnauthorized},
+		{"/site/admin/report.txt", ops, http.StatusOK},
+		{"/site/admin/report.txt", editor, http.StatusForbidden},
+		{"/site/drafts/post.md", editor, http.StatusOK},
+		{"/site/drafts/post.md", ops, http.StatusForbidden},
+		{"/site/drafts/post.md", "", http.StatusUnauthorized},
+		// No rule matches: anonymous requests are refused, authenticated
+		// ones served as without an acl section.
+		{"/other/x.txt", "", http.StatusUnauthorized},
+		{"/other/x.txt", ops, http.StatusOK},
+		// Invalid credentials are rejected even for public objects.
+		{"/site/index.html", "Bearer invalid", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s with %q: status = %d, want %d", tt.path, tt.auth, w.Code, tt.want)
+		}
+	}
+}
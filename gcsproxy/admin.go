@@ -0,0 +1,59 @@
+package gcsproxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// adminPrefix is where the proxy's own endpoints live. Bucket names can't
+// start with a dash, so it never shadows a bucket.
+const adminPrefix = "/-/"
+
+// adminOnly requires the request to carry the admin token as a bearer token.
+func (s *server) adminOnly(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return requireToken(s.adminToken, fn)
+}
+
+// requireToken requires the request to carry want as a bearer token.
+func requireToken(want string, fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gcsproxy"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// registerAdminRoutes adds the admin endpoints to r. They are only enabled
+// when an admin token is configured, except for /-/sign, which can have a
+// token of its own.
+func (s *server) registerAdminRoutes(r *mux.Router) {
+	if s.signToken != "" {
+		r.HandleFunc(adminPrefix+"sign", s.wrapper(requireToken(s.signToken, s.signURL))).Methods("POST")
+	}
+	if s.adminToken == "" {
+		return
+	}
+	a := r.PathPrefix(adminPrefix).Subrouter()
+	if s.signToken == "" {
+		a.HandleFunc("/sign", s.wrapper(s.adminOnly(s.signURL))).Methods("POST")
+	}
+	a.HandleFunc("/version", s.wrapper(s.adminOnly(showVersion))).Methods("GET")
+	a.HandleFunc("/metrics", s.wrapper(s.adminOnly(s.serveMetrics))).Methods("GET")
+	a.HandleFunc("/buckets/{bucket:[0-9a-zA-Z-_.]+}", s.wrapper(s.adminOnly(s.inspectBucket))).Methods("GET")
+	a.HandleFunc("/freeze", s.wrapper(s.adminOnly(s.listFreezes))).Methods("GET")
+	a.HandleFunc("/freeze/{bucket:[0-9a-zA-Z-_.]+}", s.wrapper(s.adminOnly(s.freezeBucket))).Methods("PUT", "DELETE")
+	a.HandleFunc("/jobs", s.wrapper(s.adminOnly(s.listJobs))).Methods("GET")
+	a.HandleFunc("/jobs/{name}/run", s.wrapper(s.adminOnly(s.runJob))).Methods("POST")
+	a.HandleFunc("/search", s.wrapper(s.adminOnly(s.searchObjects))).Methods("GET")
+	a.HandleFunc("/checksum/{bucket:[0-9a-zA-Z-_.]+}/{object:.*}", s.wrapper(s.adminOnly(s.checksumRange))).Methods("GET")
+	a.HandleFunc("/diff/{bucket:[0-9a-zA-Z-_.]+}/{object:.*}", s.wrapper(s.adminOnly(s.diffObjects))).Methods("GET")
+	a.HandleFunc("/restore/{bucket:[0-9a-zA-Z-_.]+}/{object:.*}", s.wrapper(s.adminOnly(s.restoreObject))).Methods("POST")
+}
@@ -0,0 +1,166 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// apiKey is an entry of the -api-keys file.
+type apiKey struct {
+	// Name identifies the key in logs and route claims ("sub").
+	Name   string     `json:"name"`
+	Key    string     `json:"key"`
+	Scopes []keyScope `json:"scopes"`
+}
+
+// keyScope grants access to the objects under a prefix of a bucket. Methods
+// defaults to GET and HEAD; GET implies HEAD.
+type keyScope struct {
+	Bucket  string   `json:"bucket"`
+	Prefix  string   `json:"prefix,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+}
+
+type apiKeyKey struct{}
+
+// loadAPIKeys reads the keys from a file or Secret Manager, see readSecret.
+func loadAPIKeys(ctx context.Context, ref string) (map[[sha256.Size]byte]*apiKey, error) {
+	data, err := readSecret(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	var list []*apiKey
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", ref, err)
+	}
+	keys := make(map[[sha256.Size]byte]*apiKey)
+	for i, k := range list {
+		if k.Name == "" || len(k.Key) < 16 {
+			return nil, fmt.Errorf("%s: key %d needs a name and a key of at least 16 characters", ref, i)
+		}
+		for _, s := range k.Scopes {
+			if s.Bucket == "" {
+				return nil, fmt.Errorf("%s: key %s: scopes need a bucket", ref, k.Name)
+			}
+		}
+		sum := sha256.Sum256([]byte(k.Key))
+		if _, dup := keys[sum]; dup {
+			return nil, fmt.Errorf("%s: key %s is a duplicate", ref, k.Name)
+		}
+		keys[sum] = k
+	}
+	return keys, nil
+}
+
+// watchAPIKeys reloads the keys on SIGHUP and, if interval is positive,
+// periodically, so keys can be rotated without a restart. It returns when
+// the proxy is closed.
+func (s *server) watchAPIKeys(ref string, interval time.Duration, hup chan os.Signal) {
+	defer signal.Stop(hup)
+	tick, stopTick := ticks(interval)
+	defer stopTick()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+		}
+		keys, err := loadAPIKeys(context.Background(), ref)
+		if err != nil {
+			s.logger.Printf("[api-keys] reload failed, keeping previous keys: %v", err)
+			continue
+		}
+		s.apiKeys.Store(keys)
+	}
+}
+
+// requireAPIKey requires a key of -api-keys, if set, in the -api-key-header
+// header or the -api-key-param query parameter. Requests without a known
+// key get a 401; whether the key's scopes cover the object is checked by
+// checkAPIKeyScope.
+func (s *server) requireAPIKey(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, _ := s.apiKeys.Load().(map[[sha256.Size]byte]*apiKey)
+		if keys == nil {
+			fn(w, r)
+			return
+		}
+		key := r.Header.Get(s.apiKeyHeader)
+		if key == "" && s.apiKeyParam != "" {
+			key = r.URL.Query().Get(s.apiKeyParam)
+		}
+		if key == "" && s.aclActive() {
+			fn(w, passAnonymous(r, ""))
+			return
+		}
+		k, ok := keys[sha256.Sum256([]byte(key))]
+		if key == "" || !ok {
+			if key != "" {
+				s.warnf("api-key:"+s.clientIP(r), "Rejected unknown API key from %s", s.clientIP(r))
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyKey{}, k))
+		fn(w, withClaims(r, apiKeyClaims(requestClaims(r), k)))
+	}
+}
+
+// apiKeyClaims adds the claims of an API key to those the request was
+// already authenticated with: the key's name is the api_key claim, and the
+// sub claim unless a token or user set it.
+func apiKeyClaims(c claims, k *apiKey) claims {
+	merged := claims{"sub": k.Name}
+	for name, v := range c {
+		merged[name] = v
+	}
+	merged["api_key"] = k.Name
+	return merged
+}
+
+// checkAPIKeyScope answers with a 403 and returns false if the request's
+// API key isn't scoped to the object and method.
+func (s *server) checkAPIKeyScope(w http.ResponseWriter, r *http.Request, bucket, object string) bool {
+	if apiKeyScoped(r, bucket, object) {
+		return true
+	}
+	k := r.Context().Value(apiKeyKey{}).(*apiKey)
+	s.noticef("api-key-scope:"+k.Name, "API key %s isn't scoped to %s %s/%s", k.Name, r.Method, bucket, object)
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return false
+}
+
+// apiKeyScoped reports whether the request's API key, if any, is scoped to
+// the object and method.
+func apiKeyScoped(r *http.Request, bucket, object string) bool {
+	k, _ := r.Context().Value(apiKeyKey{}).(*apiKey)
+	if k == nil {
+		return true
+	}
+	for _, s := range k.Scopes {
+		if s.Bucket == bucket && strings.HasPrefix(object, s.Prefix) && s.allows(r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s keyScope) allows(method string) bool {
+	if len(s.Methods) == 0 {
+		return method == http.MethodGet || method == http.MethodHead
+	}
+	for _, m := range s.Methods {
+		if strings.EqualFold(m, method) || method == http.MethodHead && strings.EqualFold(m, http.MethodGet) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package gcsproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// maxCachedVersionLists is the cache size at which expired version listings
+// are swept on insert.
+const maxCachedVersionLists = 10000
+
+type objectVersion struct {
+	generation int64
+	size       int64
+	created    time.Time
+	deleted    time.Time
+}
+
+type versionList struct {
+	versions []objectVersion
+	expires  time.Time
+}
+
+type versionListCache struct {
+	mu      sync.Mutex
+	entries map[string]*versionList
+}
+
+func (c *versionListCache) get(key string) []objectVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(l.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return l.versions
+}
+
+func (c *versionListCache) put(key string, versions []objectVersion, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedVersionLists {
+		c.sweepLocked()
+		trimMap(c.entries, maxCachedVersionLists)
+	}
+	c.entries[key] = &versionList{versions: versions, expires: time.Now().Add(ttl)}
+}
+
+func (c *versionListCache) drop(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// sweep drops expired listings and returns how many were removed.
+func (c *versionListCache) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sweepLocked()
+}
+
+func (c *versionListCache) sweepLocked() int {
+	now := time.Now()
+	n := 0
+	for k, l := range c.entries {
+		if now.After(l.expires) {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// generationAsOf returns the generation of the object that was live at t,
+// i.e. the newest one created at or before t that hadn't been deleted or
+// replaced by then.
+func (s *server) generationAsOf(ctx context.Context, bucket, object string, t time.Time) (int64, error) {
+	versions, err := s.listVersions(ctx, bucket, object)
+	if err != nil {
+		return 0, err
+	}
+	var live *objectVersion
+	for i, v := range versions {
+		if v.created.After(t) {
+			continue
+		}
+		if live == nil || v.created.After(live.created) {
+			live = &versions[i]
+		}
+	}
+	if live == nil || (!live.deleted.IsZero() && !live.deleted.After(t)) {
+		return 0, storage.ErrObjectNotExist
+	}
+	return live.generation, nil
+}
+
+func (s *server) listVersions(ctx context.Context, bucket, object string) ([]objectVersion, error) {
+	key := bucket + "/" + object
+	if s.asofCacheTTL > 0 {
+		if versions := s.versionCache.get(key); versions != nil {
+			return versions, nil
+		}
+	}
+
+	var versions []objectVersion
+	it := s.bucketHandle(bucket, object).Objects(ctx, &storage.Query{Prefix: object, Versions: true})
+	for {
+		attr, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attr.Name != object {
+			continue
+		}
+		versions = append(versions, objectVersion{
+			generation: attr.Generation,
+			size:       attr.Size,
+			created:    attr.Created,
+			deleted:    attr.Deleted,
+		})
+	}
+	if s.asofCacheTTL > 0 {
+		s.versionCache.put(key, versions, s.asofCacheTTL)
+	}
+	return versions, nil
+}
+
+// historicalRead reports whether the request asks for a past generation of
+// the object, with ?asof= or ?generation=.
+func historicalRead(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Get("asof") != "" || q.Get("generation") != ""
+}
+
+// pinGeneration makes reads through obj fail with a 412 unless they find
+// the generation attr describes, so that the headers and the body of a
+// response can't come from different generations when the object is
+// overwritten in between. Handles of other objects, such as restored
+// copies, are returned as they are.
+func pinGeneration(obj *storage.ObjectHandle, attr *storage.ObjectAttrs) *storage.ObjectHandle {
+	if attr.Generation == 0 || obj.BucketName() != attr.Bucket || obj.ObjectName() != attr.Name {
+		return obj
+	}
+	return obj.If(storage.Conditions{GenerationMatch: attr.Generation})
+}
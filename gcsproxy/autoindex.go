@@ -0,0 +1,101 @@
+package gcsproxy
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// maxAutoindexEntries bounds the size of a directory listing.
+const maxAutoindexEntries = 5000
+
+type autoindexEntry struct {
+	Name    string
+	Href    string
+	Size    int64
+	Updated time.Time
+	Dir     bool
+}
+
+var autoindexTemplate = template.Must(template.New("autoindex").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of /{{.Path}}</title></head>
+<body>
+<h1>Index of /{{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if .Path}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{if not .Dir}}{{.Size}}{{end}}</td><td>{{if not .Dir}}{{.Updated.UTC.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+{{end}}</table>
+{{if .Truncated}}<p>Only the first {{len .Entries}} entries are shown.</p>
+{{end}}</body>
+</html>
+`))
+
+// autoindexEnabled reports whether directory listings are served for the
+// objects covered by rt. A route's autoindex setting takes precedence over
+// -autoindex.
+func (s *server) autoindexEnabled(rt *route) bool {
+	if rt != nil && rt.Autoindex != nil {
+		return *rt.Autoindex
+	}
+	return s.autoindex
+}
+
+// serveAutoindex lists the objects and subdirectories under dir as an HTML
+// page, in the manner of nginx's autoindex. Objects the proxy wouldn't serve
+// are left out.
+func (s *server) serveAutoindex(w http.ResponseWriter, r *http.Request, rules *rules, bucket, dir string) {
+	var entries []autoindexEntry
+	truncated := false
+	it := s.bucketHandle(bucket, dir).Objects(r.Context(), &storage.Query{Prefix: dir, Delimiter: "/"})
+	for {
+		attr, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		if len(entries) == maxAutoindexEntries {
+			truncated = true
+			break
+		}
+		if attr.Prefix != "" {
+			if !s.objectAllowed(bucket, attr.Prefix) {
+				continue
+			}
+			name := strings.TrimPrefix(attr.Prefix, dir)
+			entries = append(entries, autoindexEntry{Name: name, Href: autoindexHref(strings.TrimSuffix(name, "/")) + "/", Dir: true})
+			continue
+		}
+		if attr.Name == dir || !s.listable(r, rules, bucket, attr) {
+			continue
+		}
+		name := strings.TrimPrefix(attr.Name, dir)
+		entries = append(entries, autoindexEntry{Name: name, Href: autoindexHref(name), Size: attr.Size, Updated: attr.Updated})
+	}
+	if len(entries) == 0 && dir != "" {
+		// GCS has no directories; an empty listing means there is none.
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	autoindexTemplate.Execute(w, struct {
+		Path      string
+		Entries   []autoindexEntry
+		Truncated bool
+	}{dir, entries, truncated})
+}
+
+// autoindexHref returns a relative link to name. The "./" keeps a colon in
+// the name from being taken for a URL scheme.
+func autoindexHref(name string) string {
+	return "./" + url.PathEscape(name)
+}
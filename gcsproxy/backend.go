@@ -0,0 +1,187 @@
+package gcsproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// objectStore reads objects from a store other than GCS. Attrs reports
+// storage.ErrObjectNotExist for missing objects, and the attributes the store
+// has in the fields of storage.ObjectAttrs, so that the rest of the proxy can
+// treat them like GCS objects.
+type objectStore interface {
+	Attrs(ctx context.Context, object string) (*storage.ObjectAttrs, error)
+	Open(ctx context.Context, object string) (io.ReadCloser, error)
+}
+
+// backend is an entry of the backends section of the config file: a store
+// that routes can serve objects from instead of GCS, by naming it in their
+// backend setting:
+//
+//	{"backends": [
+//	  {"name": "minio", "type": "s3", "endpoint": "https://minio.internal:9000", "bucket": "assets", "accessKey": "proxy", "secretKey": "/etc/gcsproxy/minio"},
+//	  {"name": "blob", "type": "azure", "account": "contoso", "container": "assets", "key": "sm://projects/p/secrets/blob-key"},
+//	  {"name": "disk", "type": "file", "root": "/srv/assets"}
+//	],
+//	 "routes": [{"bucket": "assets", "prefix": "eu/", "backend": "minio"}]}
+//
+// Secrets (secretKey, key, sas) are files or Secret Manager references, see
+// readSecret.
+type backend struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// Endpoint is the S3 endpoint, by default AWS's for Region, or the
+	// Azure Blob endpoint, by default https://<account>.blob.core.windows.net.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Region is the S3 region, by default us-east-1.
+	Region string `json:"region,omitempty"`
+	// Bucket is the S3 bucket, by default the route's bucket.
+	Bucket    string `json:"bucket,omitempty"`
+	AccessKey string `json:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+
+	// Account and Container locate Azure blobs; Container defaults to the
+	// route's bucket. Key is the account's shared key, SAS a shared access
+	// signature. Without either, requests are anonymous.
+	Account   string `json:"account,omitempty"`
+	Container string `json:"container,omitempty"`
+	Key       string `json:"key,omitempty"`
+	SAS       string `json:"sas,omitempty"`
+
+	// Root is the directory holding the objects of a file backend.
+	Root string `json:"root,omitempty"`
+
+	open func(bucket string) objectStore
+}
+
+// backendClient makes the requests of the S3 and Azure backends.
+var backendClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// compileBackends validates backends, reads their secrets and links the
+// routes naming them.
+func compileBackends(backends []backend, routes []route) error {
+	names := make(map[string]*backend)
+	for i := range backends {
+		b := &backends[i]
+		if b.Name == "" {
+			return fmt.Errorf("backend %d: name is required", i)
+		}
+		if names[b.Name] != nil {
+			return fmt.Errorf("backend %d: duplicate name %q", i, b.Name)
+		}
+		var err error
+		switch b.Type {
+		case "s3":
+			err = compileS3(b)
+		case "azure":
+			err = compileAzure(b)
+		case "file":
+			err = compileLocalFS(b)
+		default:
+			err = fmt.Errorf("unknown type %q (s3, azure or file)", b.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("backend %s: %v", b.Name, err)
+		}
+		names[b.Name] = b
+	}
+	for i := range routes {
+		rt := &routes[i]
+		if rt.Backend == "" {
+			continue
+		}
+		b := names[rt.Backend]
+		if b == nil {
+			return fmt.Errorf("route %d: unknown backend %q", i, rt.Backend)
+		}
+		rt.store = b.open(rt.Bucket)
+	}
+	return nil
+}
+
+// readBackendSecret reads the secret ref names, if any.
+func readBackendSecret(ref string) (string, error) {
+	if ref == "" {
+		return "", nil
+	}
+	data, err := readSecret(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// storeFor returns the store serving the route's objects, or nil for GCS.
+func storeFor(rt *route) objectStore {
+	if rt == nil {
+		return nil
+	}
+	return rt.store
+}
+
+// serveFromStore answers a request for an object of a route served by a
+// backend. GCS features such as historical reads, replicas, signed URL
+// redirects and cold storage don't apply.
+func (s *server) serveFromStore(w http.ResponseWriter, r *http.Request, rules *rules, rt *route, store objectStore, bucket, object string) {
+	actx, cancel := s.attrsContext(r.Context())
+	defer cancel()
+	attr, err := store.Attrs(actx, object)
+	if fb := s.fallbackObject(rt); err == storage.ErrObjectNotExist && fb != "" && fb != object {
+		attr, err = store.Attrs(actx, fb)
+		if err == nil {
+			if _, ok := s.authorizeObject(w, r, rules, bucket, fb); !ok {
+				return
+			}
+		}
+	}
+	if err == storage.ErrObjectNotExist {
+		s.warnf("not-found:"+bucket+"/"+object, "Object %s/%s not found", bucket, object)
+		s.notFound(w, r, rt, bucket)
+		return
+	}
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if attr.Bucket == "" {
+		attr.Bucket = bucket
+	}
+	if isBlocked(rules, attr) {
+		s.warnf("blocked:"+attr.Bucket+"/"+attr.Name, "Object %v is blocked", attr.Name)
+		s.notFound(w, r, rt, bucket)
+		return
+	}
+	if !s.checkTransport(w, r, s.objectMinTLS(attr)) {
+		return
+	}
+	s.accessStats.record(s.accessStatsDepth, attr.Bucket, attr.Name, attr.Size, attr.StorageClass)
+	if !s.writeObjectHeaders(w, r, rules, attr) {
+		return
+	}
+	rc, err := store.Open(r.Context(), attr.Name)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	defer rc.Close()
+	writeContentHeaders(w, attr, attr.CacheControl, attr.ContentEncoding, attr.Size)
+	if !s.runPostHeadersHooks(w, r, attr) {
+		return
+	}
+	body := s.countEgress(bucket, s.throttle(r.Context(), rules, rt, bucket, attr.Name, rc))
+	s.sendBody(w, r, rules, bucket, attr, attr.ContentEncoding, body)
+}
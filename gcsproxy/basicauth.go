@@ -0,0 +1,167 @@
+package gcsproxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// loadHtpasswd reads an htpasswd file. Only the MD5 ($apr1$, htpasswd -m)
+// and SHA-1 ({SHA}, htpasswd -s) schemes are supported.
+func loadHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, n)
+		}
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for %s, create it with htpasswd -m", path, n, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// watchHtpasswd reloads the htpasswd file on SIGHUP until the proxy is
+// closed.
+func (s *server) watchHtpasswd(path string, hup chan os.Signal) {
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-hup:
+		}
+		users, err := loadHtpasswd(path)
+		if err != nil {
+			s.logger.Printf("[htpasswd] reload failed, keeping previous users: %v", err)
+			continue
+		}
+		s.htpasswdUsers.Store(users)
+		s.logger.Printf("[htpasswd] reloaded %d users", len(users))
+	}
+}
+
+// basicAuth requires HTTP Basic credentials of a user of -htpasswd, if set.
+// The user name is available to the route claims checks as "sub".
+func (s *server) basicAuth(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, _ := s.htpasswdUsers.Load().(map[string]string)
+		if users == nil {
+			fn(w, r)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok && s.aclActive() {
+			fn(w, passAnonymous(r, fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", s.basicAuthRealm)))
+			return
+		}
+		if !ok || !checkPassword(users[user], password) {
+			if ok {
+				s.warnf("basic-auth:"+user, "Rejected password for %q from %s", user, s.clientIP(r))
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", s.basicAuthRealm))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		fn(w, withClaims(r, claims{"sub": user}))
+	}
+}
+
+// checkPassword reports whether the password matches an htpasswd hash. An
+// empty hash, as for unknown users, matches nothing.
+func checkPassword(hash, password string) bool {
+	var got string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		got = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		got = apr1(password, salt)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(hash)) == 1
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 returns Apache's MD5-based crypt of the password, as created by
+// htpasswd -m.
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + "$apr1$" + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$apr1$" + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[i[0]])<<16|uint32(sum[i[1]])<<8|uint32(sum[i[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+	return out.String()
+}
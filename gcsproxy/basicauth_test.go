@@ -0,0 +1,92 @@
+package gcsproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPR1(t *testing.T) {
+	// Hashes created with openssl passwd -apr1.
+	tests := []struct {
+		password, salt, want string
+	}{
+		{"myPassword", "r31.....", "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+		{"secret", "saltsalt", "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0"},
+	}
+	for _, tt := range tests {
+		if got := apr1(tt.password, tt.salt); got != tt.want {
+			t.Errorf("apr1(%q, %q) = %q, want %q", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		hash, password string
+		want           bool
+	}{
+		{"$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "myPassword", true},
+		{"$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "mypassword", false},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", true},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "Password", false},
+		// Plain text and crypt(3) hashes aren't supported.
+		{"password", "password", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := checkPassword(tt.hash, tt.password); got != tt.want {
+			t.Errorf("checkPassword(%q, %q) = %v, want %v", tt.hash, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "alice:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n# a comment\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer()
+	setRules(t, s, &fileConfig{})
+	s.htpasswdUsers.Store(users)
+
+	h := s.basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(requestClaims(r)["sub"].(string)))
+	})
+	tests := []struct {
+		user, password string
+		want           int
+	}{
+		{"alice", "myPassword", http.StatusOK},
+		{"bob", "password", http.StatusOK},
+		{"alice", "password", http.StatusUnauthorized},
+		{"carol", "password", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/files/a.txt", nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%q: status = %d, want %d", tt.user, w.Code, tt.want)
+			continue
+		}
+		if w.Code == http.StatusOK && w.Body.String() != tt.user {
+			t.Errorf("%q: authenticated as %q", tt.user, w.Body.String())
+		}
+		if w.Code == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic realm=") {
+			t.Errorf("%q: WWW-Authenticate = %q", tt.user, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
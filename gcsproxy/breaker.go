@@ -0,0 +1,73 @@
+package gcsproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errGCSUnavailable is returned instead of calling GCS while the breaker is
+// open.
+var errGCSUnavailable = errors.New("GCS is unavailable")
+
+// circuitBreaker stops calling GCS after -gcs-breaker-failures consecutive
+// failures. Once -gcs-breaker-cooldown has passed, a single call is let
+// through as a probe: if it succeeds the breaker closes, otherwise it stays
+// open for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// breakerAllows reports whether a GCS call may be made.
+func (s *server) breakerAllows() bool {
+	b := s.gcsBreaker
+	if s.gcsBreakerFailures <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < s.gcsBreakerFailures {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// recordGCSCall updates the breaker with the outcome of a call that
+// breakerAllows let through. Only errors that suggest GCS is unhealthy count
+// as failures; calls abandoned by the client don't count either way.
+func (s *server) recordGCSCall(err error) {
+	b := s.gcsBreaker
+	if s.gcsBreakerFailures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	switch {
+	case errors.Is(err, context.Canceled):
+	case err != nil && (s.retryable(err) || errors.Is(err, context.DeadlineExceeded)):
+		b.failures++
+		if b.failures >= s.gcsBreakerFailures {
+			b.openUntil = time.Now().Add(s.gcsBreakerCooldown)
+		}
+		if b.failures == s.gcsBreakerFailures {
+			s.breakerStats.Add("trips", 1)
+			s.breakerStats.Add("open", 1)
+			s.logger.Printf("[breaker] %d consecutive GCS failures, failing fast for %v: %v", b.failures, s.gcsBreakerCooldown, err)
+		}
+	default:
+		if b.failures >= s.gcsBreakerFailures {
+			s.breakerStats.Add("open", -1)
+			s.logger.Printf("[breaker] GCS is available again")
+		}
+		b.failures = 0
+	}
+}
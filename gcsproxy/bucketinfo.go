@@ -0,0 +1,98 @@
+package gcsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+type bucketInfo struct {
+	Name                     string            `json:"name"`
+	Location                 string            `json:"location"`
+	LocationType             string            `json:"locationType,omitempty"`
+	StorageClass             string            `json:"storageClass"`
+	Versioning               bool              `json:"versioning"`
+	UniformBucketLevelAccess bool              `json:"uniformBucketLevelAccess"`
+	PublicAccessPrevention   string            `json:"publicAccessPrevention,omitempty"`
+	RequesterPays            bool              `json:"requesterPays"`
+	RetentionPeriod          string            `json:"retentionPeriod,omitempty"`
+	DefaultKMSKey            string            `json:"defaultKmsKey,omitempty"`
+	Website                  *websiteInfo      `json:"website,omitempty"`
+	Labels                   map[string]string `json:"labels,omitempty"`
+	Created                  time.Time         `json:"created"`
+	// IAM maps roles to their members. It is only filled in on request.
+	IAM map[string][]string `json:"iam,omitempty"`
+}
+
+type websiteInfo struct {
+	MainPageSuffix string `json:"mainPageSuffix,omitempty"`
+	NotFoundPage   string `json:"notFoundPage,omitempty"`
+}
+
+// inspectBucket shows the attributes of a served bucket that affect how its
+// objects behave, and with ?iam=true its IAM bindings.
+func (s *server) inspectBucket(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["bucket"]
+	if !s.bucketAllowed(name) {
+		http.NotFound(w, r)
+		return
+	}
+	bucket := s.bucketHandle(name, "")
+	attrs, err := bucket.Attrs(r.Context())
+	if err != nil {
+		s.handleBucketError(w, err)
+		return
+	}
+	info := bucketInfo{
+		Name:                     attrs.Name,
+		Location:                 attrs.Location,
+		LocationType:             attrs.LocationType,
+		StorageClass:             attrs.StorageClass,
+		Versioning:               attrs.VersioningEnabled,
+		UniformBucketLevelAccess: attrs.UniformBucketLevelAccess.Enabled,
+		PublicAccessPrevention:   attrs.PublicAccessPrevention.String(),
+		RequesterPays:            attrs.RequesterPays,
+		Labels:                   attrs.Labels,
+		Created:                  attrs.Created,
+	}
+	if rp := attrs.RetentionPolicy; rp != nil {
+		info.RetentionPeriod = rp.RetentionPeriod.String()
+	}
+	if enc := attrs.Encryption; enc != nil {
+		info.DefaultKMSKey = enc.DefaultKMSKeyName
+	}
+	if ws := attrs.Website; ws != nil {
+		info.Website = &websiteInfo{MainPageSuffix: ws.MainPageSuffix, NotFoundPage: ws.NotFoundPage}
+	}
+	if r.URL.Query().Get("iam") == "true" {
+		policy, err := bucket.IAM().Policy(r.Context())
+		if err != nil {
+			s.handleBucketError(w, err)
+			return
+		}
+		info.IAM = policyBindings(policy)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func policyBindings(policy *iam.Policy) map[string][]string {
+	bindings := make(map[string][]string)
+	for _, role := range policy.Roles() {
+		bindings[string(role)] = policy.Members(role)
+	}
+	return bindings
+}
+
+// handleBucketError is handleError for bucket operations.
+func (s *server) handleBucketError(w http.ResponseWriter, err error) {
+	if err == storage.ErrBucketNotExist {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.handleError(w, err)
+}
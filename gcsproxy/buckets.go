@@ -0,0 +1,118 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// parseBucketPatterns splits a comma-separated list of bucket names, which
+// may contain the wildcards of path.Match (e.g. assets-*).
+func parseBucketPatterns(s string) ([]string, error) {
+	patterns := splitList(s)
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid bucket pattern %q: %v", p, err)
+		}
+	}
+	return patterns, nil
+}
+
+func matchBucket(patterns []string, bucket string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, bucket); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketAllowed reports whether the proxy may serve from bucket: it must
+// match -allow-buckets, if set, and must not match -deny-buckets.
+func (s *server) bucketAllowed(bucket string) bool {
+	if len(s.allowedBuckets) > 0 && !matchBucket(s.allowedBuckets, bucket) {
+		return false
+	}
+	return !matchBucket(s.deniedBuckets, bucket)
+}
+
+// parseAccessFlags parses -allow-buckets, -deny-buckets, -allow-prefixes
+// and -deny-prefixes.
+func (s *server) parseAccessFlags() (err error) {
+	if s.allowedBuckets, err = parseBucketPatterns(s.allowBuckets); err != nil {
+		return err
+	}
+	if s.deniedBuckets, err = parseBucketPatterns(s.denyBuckets); err != nil {
+		return err
+	}
+	if s.allowedPrefixes, err = parsePrefixRules(s.allowPrefixes); err != nil {
+		return err
+	}
+	s.deniedPrefixes, err = parsePrefixRules(s.denyPrefixes)
+	return err
+}
+
+// prefixRule is an entry of -allow-prefixes or -deny-prefixes.
+type prefixRule struct {
+	bucket, prefix string
+}
+
+// parsePrefixRules parses comma-separated <bucket>/<prefix> entries. The
+// bucket may contain wildcards, so */.git/ applies to every bucket.
+func parsePrefixRules(s string) ([]prefixRule, error) {
+	var rules []prefixRule
+	for _, item := range splitList(s) {
+		parts := strings.SplitN(item, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid prefix rule %q: want <bucket>/<prefix>", item)
+		}
+		if _, err := path.Match(parts[0], ""); err != nil {
+			return nil, fmt.Errorf("invalid bucket pattern %q: %v", parts[0], err)
+		}
+		rules = append(rules, prefixRule{bucket: parts[0], prefix: parts[1]})
+	}
+	return rules, nil
+}
+
+// objectAllowed reports whether the proxy may serve the object: it must not
+// be a dotfile if -hide-dotfiles is set, must not be under a prefix of
+// -deny-prefixes and, if -allow-prefixes has entries for the bucket, must be
+// under one of them.
+func (s *server) objectAllowed(bucket, object string) bool {
+	if s.hideDotfiles && isDotfile(object) {
+		return false
+	}
+	for _, rule := range s.deniedPrefixes {
+		if rule.matches(bucket) && strings.HasPrefix(object, rule.prefix) {
+			return false
+		}
+	}
+	restricted := false
+	for _, rule := range s.allowedPrefixes {
+		if !rule.matches(bucket) {
+			continue
+		}
+		if strings.HasPrefix(object, rule.prefix) {
+			return true
+		}
+		restricted = true
+	}
+	return !restricted
+}
+
+func (rule prefixRule) matches(bucket string) bool {
+	ok, _ := path.Match(rule.bucket, bucket)
+	return ok
+}
+
+// isDotfile reports whether a segment of the object name starts with a dot,
+// as in .env or .git/config. .well-known is exempt, since it holds files
+// meant to be public, such as security.txt.
+func isDotfile(object string) bool {
+	for _, segment := range strings.Split(object, "/") {
+		if strings.HasPrefix(segment, ".") && segment != ".well-known" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package gcsproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// canaryMonitor periodically reads the -canary object and keeps the
+// results for /-/metrics, so that a lost permission or a network problem
+// shows up before users notice.
+type canaryMonitor struct {
+	mu          sync.Mutex
+	lastCheck   time.Time
+	lastSuccess time.Time
+	latency     time.Duration
+	updated     time.Time
+	failures    int64 // consecutive
+	lastError   string
+}
+
+// check reads the whole canary object once.
+func (m *canaryMonitor) check(ctx context.Context, client *storage.Client, bucket, object string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	start := time.Now()
+	r, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	if err == nil {
+		_, err = io.Copy(io.Discard, r)
+		r.Close()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastCheck = start
+	if err != nil {
+		m.failures++
+		m.lastError = err.Error()
+		return err
+	}
+	m.lastSuccess = start
+	m.latency = time.Since(start)
+	m.updated = r.Attrs.LastModified
+	m.failures = 0
+	m.lastError = ""
+	return nil
+}
+
+// snapshot returns the state of the monitor. healthy is false if the last
+// read failed, was slower than maxLatency or found the object older than
+// maxAge, either of which may be 0 for no limit.
+func (m *canaryMonitor) snapshot(maxLatency, maxAge time.Duration) map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lastCheck.IsZero() {
+		return nil
+	}
+	age := time.Since(m.updated)
+	healthy := m.failures == 0 &&
+		(maxLatency <= 0 || m.latency <= maxLatency) &&
+		(maxAge <= 0 || age <= maxAge)
+	s := map[string]interface{}{
+		"healthy":              healthy,
+		"consecutive_failures": m.failures,
+		"last_check":           m.lastCheck.Unix(),
+	}
+	if !m.lastSuccess.IsZero() {
+		s["last_success"] = m.lastSuccess.Unix()
+		s["latency_seconds"] = m.latency.Seconds()
+		s["age_seconds"] = age.Seconds()
+	}
+	if m.lastError != "" {
+		s["last_error"] = m.lastError
+	}
+	return s
+}
+
+// monitorCanary checks the canary object every interval until ctx is done.
+func (s *server) monitorCanary(ctx context.Context, canary string, interval time.Duration) error {
+	parts := strings.SplitN(canary, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("-canary must be <bucket>/<object>")
+	}
+	go func() {
+		for {
+			if err := s.canaryStatus.check(ctx, s.storageClient(), parts[0], parts[1]); err != nil {
+				s.logger.Printf("[canary] %s: %v", canary, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,97 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+)
+
+// runCheck implements "gcsproxy check [flags] [<bucket>[/<object>] ...]". It
+// validates the configuration and credentials and verifies that each bucket
+// or object given as an argument can be read, reporting every problem found.
+// It exits non-zero if there were any, so it can gate deployments.
+func (s *server) runCheck(args []string) {
+	s.flags.Parse(args)
+
+	problems := 0
+	report := func(what string, err error) {
+		if err != nil {
+			problems++
+			fmt.Printf("FAIL %s: %v\n", what, err)
+		} else {
+			fmt.Printf("ok   %s\n", what)
+		}
+	}
+
+	report("environment", applyEnv(s.flags))
+	cfg, err := s.loadConfig(s.flags)
+	report("config", err)
+	if cfg == nil {
+		cfg = &fileConfig{}
+	}
+	_, err = parseTrustedProxies(s.trustedProxiesList)
+	report("trusted proxies", err)
+	if s.receiptKeyFile != "" {
+		_, err = loadReceiptKey(s.receiptKeyFile)
+		report("receipt key", err)
+	}
+	_, err = s.newJobs(cfg.Jobs)
+	report("jobs", err)
+
+	report("credentials", s.checkCredentials())
+
+	if s.flags.NArg() > 0 {
+		if c, err := s.newClient(); err != nil {
+			report("storage client", err)
+		} else {
+			s.setStorageClient(c)
+			for _, target := range s.flags.Args() {
+				report("access to "+target, s.checkAccess(target))
+			}
+		}
+	}
+
+	if problems > 0 {
+		fmt.Printf("%d problem(s) found\n", problems)
+		os.Exit(1)
+	}
+}
+
+// checkCredentials makes sure the configured credentials can obtain a token.
+func (s *server) checkCredentials() error {
+	if s.usingEmulator() {
+		return nil
+	}
+	var creds *google.Credentials
+	var err error
+	if s.credentials != "" {
+		data, err := readSecret(ctx, s.credentials)
+		if err != nil {
+			return err
+		}
+		creds, err = google.CredentialsFromJSON(ctx, data, storage.ScopeReadOnly)
+		if err != nil {
+			return err
+		}
+	} else if creds, err = google.FindDefaultCredentials(ctx, storage.ScopeReadOnly); err != nil {
+		return err
+	}
+	_, err = creds.TokenSource.Token()
+	return err
+}
+
+// checkAccess reads the attributes of a bucket (<bucket>) or an object
+// (<bucket>/<object>).
+func (s *server) checkAccess(target string) error {
+	parts := strings.SplitN(target, "/", 2)
+	client := s.storageClient()
+	if len(parts) == 2 && parts[1] != "" {
+		_, err := client.Bucket(parts[0]).Object(parts[1]).Attrs(ctx)
+		return err
+	}
+	_, err := client.Bucket(parts[0]).Attrs(ctx)
+	return err
+}
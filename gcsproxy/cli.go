@@ -0,0 +1,83 @@
+package gcsproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+// Main runs the gcsproxy command: it parses os.Args, serves until the
+// listener fails and exits the process on errors. The gcsproxy binary is a
+// thin wrapper around it.
+func Main() {
+	s := newServer()
+	s.reloadOnHUP = true
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		s.runCheck(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "test-policy" {
+		s.runTestPolicy(os.Args[2:])
+		return
+	}
+	s.flags.Parse(os.Args[1:])
+	if s.showVersionFlag {
+		fmt.Println(currentBuild())
+		return
+	}
+
+	if err := applyEnv(s.flags); err != nil {
+		log.Fatalf("Failed to apply environment: %v", err)
+	}
+	cfg, err := s.loadConfig(s.flags)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if s.reapChildren {
+		go reapZombies()
+	}
+	if s.umask != "" {
+		mask, err := parseUmask(s.umask)
+		if err != nil {
+			log.Fatal(err)
+		}
+		syscall.Umask(mask)
+	}
+	r, err := s.setup(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	l, err := listen(s.bind)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.proxyProtocol {
+		l = &proxyProtoListener{Listener: l}
+	}
+	if s.tlsCertDir != "" {
+		l = tls.NewListener(l, &tls.Config{
+			GetCertificate: s.newCertStore(s.tlsCertDir).getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		})
+	}
+	if s.runAsUser != "" {
+		if err := s.dropPrivileges(s.runAsUser); err != nil {
+			log.Fatalf("Failed to drop privileges: %v", err)
+		}
+	}
+	if s.selfTest {
+		if s.runSelfTest(l, r) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	s.logger.Printf("[service] %s", currentBuild())
+	s.logger.Printf("[service] listening on %s", l.Addr())
+	if err := http.Serve(l, r); err != nil {
+		log.Fatal(err)
+	}
+}
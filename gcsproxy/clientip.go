@@ -0,0 +1,75 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range splitList(s) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", item, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (s *server) isTrustedProxy(ip net.IP) bool {
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request. The
+// X-Forwarded-For chain is walked from right to left, skipping trusted
+// proxies, so clients can't spoof their address by sending the header
+// themselves.
+func (s *server) clientIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || !s.isTrustedProxy(ip) {
+		return addr
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hopIP := net.ParseIP(hops[i])
+		if hopIP == nil {
+			// Whatever is left of a malformed entry can't be trusted.
+			return addr
+		}
+		addr = hops[i]
+		if !s.isTrustedProxy(hopIP) {
+			break
+		}
+	}
+	return addr
+}
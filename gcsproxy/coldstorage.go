@@ -0,0 +1,132 @@
+package gcsproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// restoreGenerationKey is the metadata key recording which generation of the
+// cold object a restored copy was made from.
+const restoreGenerationKey = "gcsproxy-source-generation"
+
+// coldClasses are the storage classes with retrieval fees and minimum
+// storage durations.
+var coldClasses = map[string]bool{"NEARLINE": true, "COLDLINE": true, "ARCHIVE": true}
+
+type restoreSet struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// parseColdStorageMode validates a -cold-storage mode or the coldStorage
+// setting of a route.
+func (s *server) parseColdStorageMode(mode string) error {
+	switch mode {
+	case "", "serve", "reject":
+		return nil
+	case "restore":
+		if s.restoreBucket == "" {
+			return fmt.Errorf("cold storage mode restore needs -restore-bucket")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown cold storage mode %q, expected serve, reject or restore", mode)
+}
+
+// coldStorageMode returns how objects in cold storage classes are handled.
+// A route's coldStorage setting takes precedence over -cold-storage.
+func (s *server) coldStorageMode(rt *route) string {
+	if rt != nil && rt.ColdStorage != "" {
+		return rt.ColdStorage
+	}
+	return s.coldStorage
+}
+
+// restoredName is the name of the copy of an object in -restore-bucket.
+func restoredName(attr *storage.ObjectAttrs) string {
+	return attr.Bucket + "/" + attr.Name
+}
+
+// serveCold decides how to serve an object in a cold storage class. It
+// returns the handle to read the object through, which is its restored copy
+// if there is an up-to-date one. Otherwise, in reject mode it answers with a
+// 409, and in restore mode it starts a copy to -restore-bucket and answers
+// with a 202; it returns false in both cases.
+func (s *server) serveCold(ctx context.Context, w http.ResponseWriter, r *http.Request, rt *route, obj *storage.ObjectHandle, attr *storage.ObjectAttrs, gzipAcceptable bool) (*storage.ObjectHandle, bool) {
+	if !coldClasses[attr.StorageClass] {
+		return obj, true
+	}
+	switch s.coldStorageMode(rt) {
+	case "reject":
+		http.Error(w, fmt.Sprintf("object is in %s storage and isn't served", attr.StorageClass), http.StatusConflict)
+		return nil, false
+	case "restore":
+		o, a, err := s.objectAttrs(ctx, s.restoreBucket, restoredName(attr), gzipAcceptable)
+		if err == nil && a.Metadata[restoreGenerationKey] == strconv.FormatInt(attr.Generation, 10) {
+			return o, true
+		}
+		if err != nil && err != storage.ErrObjectNotExist {
+			s.warnf("restore:"+restoredName(attr), "Restored copy of %s can't be read: %v", restoredName(attr), err)
+		}
+		s.startRestore(attr)
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.restoreRetryAfter/time.Second)))
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, fmt.Sprintf("object is in %s storage, restore requested", attr.StorageClass), http.StatusAccepted)
+		return nil, false
+	}
+	return obj, true
+}
+
+// startRestore copies the object to -restore-bucket in the background,
+// unless a copy is already in progress.
+func (s *server) startRestore(attr *storage.ObjectAttrs) {
+	name := restoredName(attr)
+	rs := s.restores
+	rs.mu.Lock()
+	if rs.pending[name] {
+		rs.mu.Unlock()
+		return
+	}
+	rs.pending[name] = true
+	rs.mu.Unlock()
+
+	go func() {
+		defer func() {
+			rs.mu.Lock()
+			delete(rs.pending, name)
+			rs.mu.Unlock()
+		}()
+		start := time.Now()
+		if err := s.restore(s.ctx, attr); err != nil {
+			s.logger.Printf("[restore] %s failed: %v", name, err)
+			return
+		}
+		s.logger.Printf("[restore] %s restored to %s in %v", name, s.restoreBucket, time.Since(start))
+	}()
+}
+
+// restore copies the generation of the object described by attr to
+// -restore-bucket in the Standard storage class.
+func (s *server) restore(ctx context.Context, attr *storage.ObjectAttrs) error {
+	// The object's account needs write access to -restore-bucket.
+	client := s.clientFor(attr.Bucket, attr.Name)
+	src := client.Bucket(attr.Bucket).Object(attr.Name).Generation(attr.Generation)
+	dst := client.Bucket(s.restoreBucket).Object(restoredName(attr))
+	copier := dst.CopierFrom(src)
+	copier.StorageClass = "STANDARD"
+	copier.ContentType = attr.ContentType
+	copier.ContentEncoding = attr.ContentEncoding
+	copier.Metadata = make(map[string]string, len(attr.Metadata)+1)
+	for k, v := range attr.Metadata {
+		copier.Metadata[k] = v
+	}
+	copier.Metadata[restoreGenerationKey] = strconv.FormatInt(attr.Generation, 10)
+	_, err := copier.Run(ctx)
+	return err
+}
@@ -0,0 +1,60 @@
+package gcsproxy
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// limitConcurrency serves at most -max-concurrent requests at once. Up to
+// -max-queue more wait for a slot for at most -queue-timeout; requests
+// beyond those, or that time out, get a 503, so a traffic spike degrades
+// gracefully instead of exhausting memory and file descriptors.
+func (s *server) limitConcurrency(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.readSlots == nil {
+			fn(w, r)
+			return
+		}
+		select {
+		case s.readSlots <- struct{}{}:
+		default:
+			if !s.waitForSlot(r) {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		s.concurrencyStats.Add("active", 1)
+		defer func() {
+			s.concurrencyStats.Add("active", -1)
+			<-s.readSlots
+		}()
+		fn(w, r)
+	}
+}
+
+// waitForSlot queues the request for a slot, and reports whether it got
+// one.
+func (s *server) waitForSlot(r *http.Request) bool {
+	if atomic.AddInt64(&s.queued, 1) > int64(s.maxQueue) {
+		atomic.AddInt64(&s.queued, -1)
+		s.concurrencyStats.Add("rejected", 1)
+		return false
+	}
+	s.concurrencyStats.Add("queued", 1)
+	defer func() {
+		atomic.AddInt64(&s.queued, -1)
+		s.concurrencyStats.Add("queued", -1)
+	}()
+	t := time.NewTimer(s.queueTimeout)
+	defer t.Stop()
+	select {
+	case s.readSlots <- struct{}{}:
+		return true
+	case <-t.C:
+		s.concurrencyStats.Add("timedOut", 1)
+	case <-r.Context().Done():
+	}
+	return false
+}
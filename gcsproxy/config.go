@@ -0,0 +1,337 @@
+package gcsproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// fileConfig is the structured part of a -config file. Every other top-level
+// key sets the command-line flag of the same name, so anything that can be
+// passed as a flag can also go into the file:
+//
+//	{
+//	  "bind": "0.0.0.0:8080",
+//	  "block-if": "Blocked:true",
+//	  "ext-authz-cache-ttl": "30s",
+//	  "headers": {"X-Frame-Options": "DENY"}
+//	}
+//
+// Flags given on the command line or through the environment take precedence
+// over the file.
+type fileConfig struct {
+	// Headers are added to every proxied response.
+	Headers map[string]string `json:"headers"`
+	// Jobs are run on a schedule, see jobConfig.
+	Jobs []jobConfig `json:"jobs"`
+	// Routes list the bucket prefixes served in strict mode, see route.
+	Routes []route `json:"routes"`
+	// Hosts maps host names to buckets in virtual-host mode, see
+	// hostMapping.
+	Hosts map[string]hostMapping `json:"hosts"`
+	// Rewrites map request paths to object names, see rewrite.
+	Rewrites []rewrite `json:"rewrites"`
+	// DLP rules redact or block sensitive content, see dlpRule.
+	DLP []dlpRule `json:"dlp"`
+	// ErrorPages replace the body of error responses, see errorPage.
+	ErrorPages map[string]errorPage `json:"errorPages"`
+	// Bandwidth caps responses by time of day, see bandwidthWindow.
+	Bandwidth []bandwidthWindow `json:"bandwidth"`
+	// ACL sets who may read which objects, see aclRule.
+	ACL []aclRule `json:"acl"`
+	// Quotas cap the bytes served per bucket, see egressQuota.
+	Quotas []egressQuota `json:"quotas"`
+	// Replicas list buckets holding the same objects, see replicaSet.
+	Replicas []replicaSet `json:"replicas"`
+	// Accounts give buckets credentials of their own, see account.
+	Accounts []account `json:"accounts"`
+	// Backends are stores other than GCS that routes can serve, see
+	// backend.
+	Backends []backend `json:"backends"`
+}
+
+// fileConfigSections are the keys of fileConfig, which aren't flags.
+var fileConfigSections = map[string]bool{"headers": true, "jobs": true, "routes": true, "hosts": true, "rewrites": true, "dlp": true, "errorPages": true, "bandwidth": true, "acl": true, "quotas": true, "replicas": true, "accounts": true, "backends": true}
+
+// flagAliases gives readable names to the single-letter flags.
+var flagAliases = map[string]string{
+	"bind":        "b",
+	"credentials": "c",
+	"verbose":     "v",
+}
+
+// envPrefix is prepended to the upper-cased flag name, with dashes replaced
+// by underscores, to form the environment variable setting the flag.
+const envPrefix = "GCSPROXY_"
+
+// reloadableFlags are the flags picked up again when the config file is
+// reloaded. All other settings only take effect on restart.
+var reloadableFlags = []string{"block-if", "pass-through"}
+
+// rules are the settings that can change while the proxy is running. They
+// are replaced as a whole on reload, and each request uses the rules that
+// were current when it started.
+type rules struct {
+	blockIfKey, blockIfValue string
+	passthrough              map[string]struct{}
+	headers                  map[string]string
+	routes                   []route
+	hosts                    *hostTable
+	rewrites                 []rewrite
+	dlp                      []dlpRule
+	errorPages               map[int]*errorPage
+	bandwidth                []bandwidthWindow
+	acl                      []aclRule
+	quotas                   []egressQuota
+	replicas                 []replicaSet
+	accounts                 []account
+}
+
+func (s *server) activeRules() *rules {
+	return s.currentRules.Load().(*rules)
+}
+
+func (s *server) newRules(blockIf, passthrough string, cfg *fileConfig) (*rules, error) {
+	key, value, err := parseBlockIfMeta(blockIf)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.compileRoutes(cfg.Routes); err != nil {
+		return nil, err
+	}
+	if err := compileRewrites(cfg.Rewrites); err != nil {
+		return nil, err
+	}
+	if err := compileDLPRules(cfg.DLP); err != nil {
+		return nil, err
+	}
+	if err := compileBandwidthWindows(cfg.Bandwidth); err != nil {
+		return nil, err
+	}
+	if err := compileACL(cfg.ACL); err != nil {
+		return nil, err
+	}
+	if err := compileQuotas(cfg.Quotas); err != nil {
+		return nil, err
+	}
+	if err := compileReplicas(cfg.Replicas); err != nil {
+		return nil, err
+	}
+	if err := s.compileAccounts(cfg.Accounts); err != nil {
+		return nil, err
+	}
+	if err := compileBackends(cfg.Backends, cfg.Routes); err != nil {
+		return nil, err
+	}
+	errorPages, err := compileErrorPages(cfg.ErrorPages)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := newHostTable(cfg.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &rules{
+		blockIfKey:   key,
+		blockIfValue: value,
+		passthrough:  parsePassthroughMeta(passthrough),
+		headers:      cfg.Headers,
+		routes:       cfg.Routes,
+		hosts:        hosts,
+		rewrites:     cfg.Rewrites,
+		dlp:          cfg.DLP,
+		errorPages:   errorPages,
+		bandwidth:    cfg.Bandwidth,
+		acl:          cfg.ACL,
+		quotas:       cfg.Quotas,
+		replicas:     cfg.Replicas,
+		accounts:     cfg.Accounts,
+	}, nil
+}
+
+// loadConfig applies the config file, if any, to the flags in fs that
+// haven't been set yet, activates the resulting rules and returns the
+// structured part of the file.
+func (s *server) loadConfig(fs *flag.FlagSet) (*fileConfig, error) {
+	s.pinnedFlags = make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { s.pinnedFlags[f.Name] = true })
+
+	cfg := &fileConfig{}
+	if s.configFile != "" {
+		settings, c, err := readConfigFile(fs, s.configFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range settings {
+			if s.pinnedFlags[name] {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", s.configFile, name, err)
+			}
+		}
+		cfg = c
+	}
+	r, err := s.newRules(s.blockIfMeta, s.passthroughMeta, cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.currentRules.Store(r)
+	return cfg, nil
+}
+
+// reloadConfig re-reads the config file and activates the new rules.
+func (s *server) reloadConfig(fs *flag.FlagSet) error {
+	settings, cfg, err := readConfigFile(fs, s.configFile)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]string)
+	for _, name := range reloadableFlags {
+		f := fs.Lookup(name)
+		values[name] = f.DefValue
+		if s.pinnedFlags[name] {
+			values[name] = f.Value.String()
+		} else if v, ok := settings[name]; ok {
+			values[name] = v
+		}
+	}
+	r, err := s.newRules(values["block-if"], values["pass-through"], cfg)
+	if err != nil {
+		return err
+	}
+	s.currentRules.Store(r)
+	return nil
+}
+
+// watchConfig reloads the config file on SIGHUP and, if interval is
+// positive, whenever its modification time or size changes. It returns when
+// the proxy is closed.
+func (s *server) watchConfig(fs *flag.FlagSet, interval time.Duration, hup chan os.Signal) {
+	defer signal.Stop(hup)
+	tick, stopTick := ticks(interval)
+	defer stopTick()
+	last, _ := os.Stat(s.configFile)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			fi, err := os.Stat(s.configFile)
+			if err != nil || (last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size()) {
+				continue
+			}
+			last = fi
+		}
+		if err := s.reloadConfig(fs); err != nil {
+			s.logger.Printf("[config] reload failed, keeping previous rules: %v", err)
+			continue
+		}
+		s.logger.Printf("[config] reloaded %s", s.configFile)
+	}
+}
+
+// readConfigFile reads the config file at path. It returns the flag
+// settings, keyed by flag name, and the structured part.
+func readConfigFile(fs *flag.FlagSet, path string) (map[string]string, *fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	settings := make(map[string]string)
+	sections := make(map[string]json.RawMessage)
+	for key, value := range raw {
+		if fileConfigSections[key] {
+			sections[key] = value
+			continue
+		}
+		name := key
+		if alias, ok := flagAliases[key]; ok {
+			name = alias
+		}
+		if fs.Lookup(name) == nil || name == "config" {
+			return nil, nil, fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		s, err := flagValue(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s: %v", path, key, err)
+		}
+		settings[name] = s
+	}
+
+	cfg := &fileConfig{}
+	if len(sections) > 0 {
+		data, err := json.Marshal(sections)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return settings, cfg, nil
+}
+
+// envName returns the environment variable that sets the flag name.
+func envName(name string) string {
+	for alias, flagName := range flagAliases {
+		if flagName == name {
+			name = alias
+			break
+		}
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets flags not given on the command line from their environment
+// variables (GCSPROXY_BIND, GCSPROXY_BLOCK_IF, ...).
+func applyEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), e)
+			}
+		}
+	})
+	return err
+}
+
+// flagValue converts a JSON scalar to the string form flag.Value.Set expects.
+// Lists may be given as arrays of strings and are joined with commas.
+func flagValue(value json.RawMessage) (string, error) {
+	value = bytes.TrimSpace(value)
+	switch {
+	case len(value) > 0 && value[0] == '"':
+		var s string
+		err := json.Unmarshal(value, &s)
+		return s, err
+	case len(value) > 0 && value[0] == '[':
+		var items []string
+		if err := json.Unmarshal(value, &items); err != nil {
+			return "", err
+		}
+		return strings.Join(items, ","), nil
+	case len(value) > 0 && value[0] == '{':
+		return "", fmt.Errorf("unexpected object")
+	default:
+		return string(value), nil
+	}
+}
@@ -0,0 +1,49 @@
+package gcsproxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// copyBody copies body to w through a buffer of -copy-buffer bytes, flushing
+// every -flush-interval, and returns the number of bytes written. Small
+// buffers and frequent flushes get bytes to clients sooner, e.g. for media
+// streaming; large ones make fewer, bigger writes for bulk transfers.
+func (s *server) copyBody(w http.ResponseWriter, body io.Reader) (written int64, err error) {
+	buf, _ := s.copyBuffers.Get().(*[]byte)
+	if buf == nil {
+		b := make([]byte, s.copyBufferSize)
+		buf = &b
+	}
+	defer s.copyBuffers.Put(buf)
+
+	lastFlush := time.Now()
+	for {
+		n, rerr := body.Read(*buf)
+		if n > 0 {
+			m, werr := w.Write((*buf)[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			if s.flushInterval < 0 || s.flushInterval > 0 && time.Since(lastFlush) >= s.flushInterval {
+				flush(w)
+				lastFlush = time.Now()
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// flush sends what has been written to w to the client, if w supports it.
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
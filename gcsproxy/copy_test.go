@@ -0,0 +1,28 @@
+package gcsproxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCopyBufferPerServer(t *testing.T) {
+	small, large := newServer(), newServer()
+	small.flags.Set("copy-buffer", "3")
+	large.flags.Set("copy-buffer", "64K")
+	for _, s := range []*server{small, large} {
+		if err := s.parseReadFlags(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if small.copyBufferSize != 3 || large.copyBufferSize != 64<<10 {
+		t.Fatalf("buffer sizes = %d and %d", small.copyBufferSize, large.copyBufferSize)
+	}
+	for _, s := range []*server{small, large} {
+		w := httptest.NewRecorder()
+		n, err := s.copyBody(w, strings.NewReader("hello, world"))
+		if err != nil || n != 12 || w.Body.String() != "hello, world" {
+			t.Errorf("copyBody with a %d byte buffer = %d, %v, %q", s.copyBufferSize, n, err, w.Body.String())
+		}
+	}
+}
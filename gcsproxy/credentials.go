@@ -0,0 +1,84 @@
+package gcsproxy
+
+import (
+	"bytes"
+	"os"
+	"os/signal"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// storageClient returns the client for the current credentials. Requests
+// should fetch it once and use it throughout, so that a rotation doesn't
+// affect them halfway.
+func (s *server) storageClient() *storage.Client {
+	return s.currentClient.Load().(*storage.Client)
+}
+
+func (s *server) setStorageClient(c *storage.Client) {
+	s.currentClient.Store(c)
+}
+
+// rotateCredentials creates a client from the credentials as they are now
+// and replaces the current one with it, if they can obtain a token. The
+// previous client isn't closed, as in-flight requests may still be using
+// it; it is garbage collected once they are done.
+func (s *server) rotateCredentials() error {
+	if err := s.checkCredentials(); err != nil {
+		return err
+	}
+	c, err := s.newClient()
+	if err != nil {
+		return err
+	}
+	s.setStorageClient(c)
+	return nil
+}
+
+// watchCredentials rotates the credentials on SIGHUP and, if interval is
+// positive and a key file is configured, whenever the key file's
+// modification time or size changes, or for a Secret Manager key, whenever
+// the secret's latest version has changed. It returns when the proxy is
+// closed.
+func (s *server) watchCredentials(interval time.Duration, hup chan os.Signal) {
+	defer signal.Stop(hup)
+	if s.credentials == "" {
+		interval = 0
+	}
+	tick, stopTick := ticks(interval)
+	defer stopTick()
+	var last os.FileInfo
+	var lastSecret []byte
+	if isSecretRef(s.credentials) {
+		lastSecret, _ = readSecret(ctx, s.credentials)
+	} else if s.credentials != "" {
+		last, _ = os.Stat(s.credentials)
+	}
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			if isSecretRef(s.credentials) {
+				data, err := readSecret(ctx, s.credentials)
+				if err != nil || bytes.Equal(data, lastSecret) {
+					continue
+				}
+				lastSecret = data
+				break
+			}
+			fi, err := os.Stat(s.credentials)
+			if err != nil || (last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size()) {
+				continue
+			}
+			last = fi
+		}
+		if err := s.rotateCredentials(); err != nil {
+			s.logger.Printf("[credentials] rotation failed, keeping previous credentials: %v", err)
+			continue
+		}
+		s.logger.Printf("[credentials] rotated")
+	}
+}
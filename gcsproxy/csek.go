@@ -0,0 +1,101 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// The headers clients send customer-supplied encryption keys in, as for
+// GCS itself.
+const (
+	csekAlgorithmHeader = "X-Goog-Encryption-Algorithm"
+	csekKeyHeader       = "X-Goog-Encryption-Key"
+	csekHashHeader      = "X-Goog-Encryption-Key-Sha256"
+)
+
+// loadBucketKeys reads the keys of -csek-keys, given as bucket=secret pairs
+// where each secret (see readSecret) holds a base64-encoded AES-256 key, as
+// in a gsutil boto file.
+func loadBucketKeys(ctx context.Context, list string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, entry := range splitList(list) {
+		bucket, ref, ok := strings.Cut(entry, "=")
+		if !ok || bucket == "" || ref == "" {
+			return nil, fmt.Errorf("invalid CSEK key %q, expected bucket=file", entry)
+		}
+		data, err := readSecret(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("CSEK key for %s: %v", bucket, err)
+		}
+		key, err := decodeCSEK(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("CSEK key for %s: %v", bucket, err)
+		}
+		keys[bucket] = key
+	}
+	return keys, nil
+}
+
+func decodeCSEK(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("not a base64-encoded 256-bit key")
+	}
+	return key, nil
+}
+
+// requestKey returns the customer-supplied encryption key sent with the
+// request, if -csek-headers accepts them.
+func (s *server) requestKey(r *http.Request) ([]byte, error) {
+	encoded := r.Header.Get(csekKeyHeader)
+	if encoded == "" {
+		return nil, nil
+	}
+	if !s.csekHeaders {
+		return nil, errors.New("customer-supplied encryption keys aren't accepted")
+	}
+	if alg := r.Header.Get(csekAlgorithmHeader); alg != "" && alg != "AES256" {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", alg)
+	}
+	key, err := decodeCSEK(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", csekKeyHeader, err)
+	}
+	if hash := r.Header.Get(csekHashHeader); hash != "" && hash != keyHash(key) {
+		return nil, fmt.Errorf("%s doesn't match the key", csekHashHeader)
+	}
+	return key, nil
+}
+
+func keyHash(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// withCSEK applies the key the object was encrypted with, if it was
+// encrypted with a customer-supplied one: the request's key, or else the
+// bucket's from -csek-keys. private is true if the request's key was used,
+// as the response must then not be served to clients without it. It
+// answers with a 400 and returns false if the request's key is invalid.
+func (s *server) withCSEK(w http.ResponseWriter, r *http.Request, obj *storage.ObjectHandle, attr *storage.ObjectAttrs) (_ *storage.ObjectHandle, private, ok bool) {
+	key, err := s.requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false, false
+	}
+	switch {
+	case attr.CustomerKeySHA256 == "":
+	case key != nil:
+		return obj.Key(key), true, true
+	case s.bucketKeys[attr.Bucket] != nil:
+		return obj.Key(s.bucketKeys[attr.Bucket]), false, true
+	}
+	return obj, false, true
+}
@@ -0,0 +1,74 @@
+package gcsproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// attrsContext returns a context for looking up object metadata, which
+// times out after -gcs-attrs-timeout.
+func (s *server) attrsContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if s.gcsAttrsTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, s.gcsAttrsTimeout)
+}
+
+// openObject opens the object, whose attributes are attr, for reading.
+// Opening it, and each read of the returned body, fail once GCS has sent
+// nothing for -gcs-read-timeout, so a hung read doesn't tie up the handler.
+// cancel must be called once the body has been read.
+func (s *server) openObject(parent context.Context, obj *storage.ObjectHandle, attr *storage.ObjectAttrs) (objr *storage.Reader, body io.Reader, cancel context.CancelFunc, err error) {
+	ctx, cancel := context.WithCancel(parent)
+	if s.gcsReadTimeout <= 0 {
+		objr, body, err = s.openBody(ctx, obj, attr)
+		if err != nil {
+			cancel()
+			return nil, nil, nil, err
+		}
+		return objr, body, cancel, nil
+	}
+	t := time.AfterFunc(s.gcsReadTimeout, cancel)
+	objr, body, err = s.openBody(ctx, obj, attr)
+	if !t.Stop() {
+		cancel()
+		s.recordGCSCall(context.DeadlineExceeded)
+		if err == nil {
+			objr.Close()
+		}
+		return nil, nil, nil, fmt.Errorf("opening object: %w", context.DeadlineExceeded)
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+	return objr, &idleReader{r: body, timer: t, timeout: s.gcsReadTimeout}, cancel, nil
+}
+
+// newReader opens the object, retrying transient errors.
+func (s *server) newReader(ctx context.Context, obj *storage.ObjectHandle) (objr *storage.Reader, err error) {
+	err = s.withRetries(ctx, func() error {
+		objr, err = obj.NewReader(ctx)
+		return err
+	})
+	return objr, err
+}
+
+// idleReader cancels the read when a Read takes longer than
+// -gcs-read-timeout.
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (i *idleReader) Read(p []byte) (int, error) {
+	i.timer.Reset(i.timeout)
+	n, err := i.r.Read(p)
+	i.timer.Stop()
+	return n, err
+}
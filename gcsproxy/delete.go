@@ -0,0 +1,46 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// deleteObject answers DELETE requests for objects covered by a route that
+// allows them. The path is mapped to an object as for reads, so a DELETE
+// removes the object a GET of the same URL serves. ?generation= deletes
+// that generation of an object in a versioned bucket instead of the live
+// one.
+func (s *server) deleteObject(w http.ResponseWriter, r *http.Request) {
+	rules := s.activeRules()
+	bucket, object := s.target(rules, r)
+	if bucket == "" || !s.bucketAllowed(bucket) {
+		http.NotFound(w, r)
+		return
+	}
+	object, _, ok := s.checkWrite(w, r, rules, bucket, object, func(rt *route) bool { return rt.Delete })
+	if !ok {
+		return
+	}
+	if object == "" || isDirectory(object) {
+		http.Error(w, "directories can't be deleted", http.StatusBadRequest)
+		return
+	}
+
+	obj := s.bucketHandle(bucket, object).Object(object)
+	if g := r.URL.Query().Get("generation"); g != "" {
+		gen, err := strconv.ParseInt(g, 10, 64)
+		if err != nil || gen <= 0 {
+			http.Error(w, fmt.Sprintf("invalid generation %q", g), http.StatusBadRequest)
+			return
+		}
+		obj = obj.Generation(gen)
+	}
+	if err := obj.Delete(r.Context()); err != nil {
+		s.handleError(w, err)
+		return
+	}
+	s.versionCache.drop(bucket + "/" + object)
+	s.logger.Printf("[delete] %s/%s", bucket, object)
+	w.WriteHeader(http.StatusNoContent)
+}
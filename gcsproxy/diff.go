@@ -0,0 +1,311 @@
+package gcsproxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around changes.
+	diffContext = 3
+	// maxDiffEdits bounds the work spent on a text diff; beyond it only the
+	// metadata comparison is returned.
+	maxDiffEdits = 4000
+)
+
+type objectSummary struct {
+	Bucket      string            `json:"bucket"`
+	Name        string            `json:"name"`
+	Generation  int64             `json:"generation"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	CRC32C      uint32            `json:"crc32c"`
+	MD5         string            `json:"md5,omitempty"`
+	Updated     time.Time         `json:"updated"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type objectComparison struct {
+	From      objectSummary `json:"from"`
+	To        objectSummary `json:"to"`
+	Identical bool          `json:"identical"`
+}
+
+// diffObjects compares two generations of an object (?from=<gen>&to=<gen>,
+// where a missing generation means the live one) or the object with another
+// one (?with=<bucket>/<object>). Text content is returned as a unified diff,
+// anything else as a JSON comparison of metadata, size and checksums.
+func (s *server) diffObjects(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	q := r.URL.Query()
+
+	from, err := s.diffHandle(params["bucket"], params["object"], q.Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	toBucket, toObject := params["bucket"], params["object"]
+	if with := q.Get("with"); with != "" {
+		parts := strings.SplitN(with, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			http.Error(w, "with must be <bucket>/<object>", http.StatusBadRequest)
+			return
+		}
+		toBucket, toObject = parts[0], parts[1]
+	}
+	to, err := s.diffHandle(toBucket, toObject, q.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fromAttr, err := from.Attrs(ctx)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	toAttr, err := to.Attrs(ctx)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	if fromAttr.Size <= s.diffMaxSize && toAttr.Size <= s.diffMaxSize {
+		fromText, err := s.readText(from.Generation(fromAttr.Generation))
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		toText, err := s.readText(to.Generation(toAttr.Generation))
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		if fromText != nil && toText != nil {
+			diff, ok := unifiedDiff(diffLabel(fromAttr), diffLabel(toAttr), fromText, toText)
+			if ok {
+				w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+				io.WriteString(w, diff)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(objectComparison{
+		From:      summarize(fromAttr),
+		To:        summarize(toAttr),
+		Identical: fromAttr.CRC32C == toAttr.CRC32C && fromAttr.Size == toAttr.Size,
+	})
+}
+
+func (s *server) diffHandle(bucket, object, generation string) (*storage.ObjectHandle, error) {
+	obj := s.storageClient().Bucket(bucket).Object(object)
+	if generation == "" {
+		return obj, nil
+	}
+	gen, err := strconv.ParseInt(generation, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generation %q", generation)
+	}
+	return obj.Generation(gen), nil
+}
+
+func diffLabel(attr *storage.ObjectAttrs) string {
+	return fmt.Sprintf("%s/%s#%d", attr.Bucket, attr.Name, attr.Generation)
+}
+
+func summarize(attr *storage.ObjectAttrs) objectSummary {
+	return objectSummary{
+		Bucket:      attr.Bucket,
+		Name:        attr.Name,
+		Generation:  attr.Generation,
+		Size:        attr.Size,
+		ContentType: attr.ContentType,
+		CRC32C:      attr.CRC32C,
+		MD5:         hex.EncodeToString(attr.MD5),
+		Updated:     attr.Updated,
+		Metadata:    attr.Metadata,
+	}
+}
+
+// readText returns the object's lines, or nil if it doesn't look like text.
+func (s *server) readText(obj *storage.ObjectHandle) ([]string, error) {
+	objr, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer objr.Close()
+	data, err := io.ReadAll(io.LimitReader(objr, s.diffMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(data) || strings.ContainsRune(string(data), 0) {
+		return nil, nil
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines, nil
+}
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// diffLines computes a shortest edit script from a to b using Myers'
+// algorithm. It gives up, returning false, after maxDiffEdits edits.
+func diffLines(a, b []string) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxDiffEdits {
+		max = maxDiffEdits
+	}
+	off := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] holds v[-d..d] after step d.
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+				return backtrack(a, b, trace), true
+			}
+		}
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+	}
+	return nil, false
+}
+
+func backtrack(a, b []string, trace [][]int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int { return prev[k+d-1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, diffOp{' ', a[x-1]})
+		x--
+		y--
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// unifiedDiff renders the differences between a and b in unified format.
+// It returns false if the inputs differ too much to diff.
+func unifiedDiff(fromName, toName string, a, b []string) (string, bool) {
+	ops, ok := diffLines(a, b)
+	if !ok {
+		return "", false
+	}
+	// Line numbers in a and b before each op.
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if op.kind != '+' {
+			aPos[i+1]++
+		}
+		if op.kind != '-' {
+			bPos[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		last := i
+		for j := i; j < len(ops) && j-last <= 2*diffContext; j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			}
+		}
+		end := last + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(aPos[start], aPos[end]-aPos[start]),
+			hunkRange(bPos[start], bPos[end]-bPos[start]))
+		for _, op := range ops[start:end] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.String(), true
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
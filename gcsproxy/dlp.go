@@ -0,0 +1,138 @@
+package gcsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dlpLineLimit is the longest line inspected as a whole when streaming;
+// longer lines are inspected in pieces of this size.
+const dlpLineLimit = 64 << 10
+
+// dlpRule is an entry of the dlp section of the config file. Responses
+// matching Pattern are redacted, or refused if Action is "block":
+//
+//	{"dlp": [
+//	  {"name": "aws-key", "pattern": "AKIA[0-9A-Z]{16}", "action": "block"},
+//	  {"name": "email", "pattern": "[\\w.+-]+@[\\w-]+\\.[\\w.]+", "replacement": "[email]"}
+//	]}
+type dlpRule struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Action      string `json:"action,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func compileDLPRules(rules []dlpRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i)
+		}
+		switch rule.Action {
+		case "":
+			rule.Action = "redact"
+		case "redact", "block":
+		default:
+			return fmt.Errorf("dlp rule %s: unknown action %q", rule.Name, rule.Action)
+		}
+		if rule.Replacement == "" {
+			rule.Replacement = "[REDACTED]"
+		}
+		re, err := compileRoutePattern(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("dlp rule %s: %v", rule.Name, err)
+		}
+		rule.re = re
+	}
+	return nil
+}
+
+// inspectable reports whether content of the type and encoding is text the
+// DLP rules can be applied to.
+func inspectable(contentType, contentEncoding string) bool {
+	if contentEncoding != "" && contentEncoding != "identity" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		strings.HasSuffix(mt, "+json"), strings.HasSuffix(mt, "+xml"),
+		mt == "application/json", mt == "application/xml",
+		mt == "application/javascript", mt == "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// applyDLP applies the rules to data. It returns nil and true if a block
+// rule matched.
+func (s *server) applyDLP(rules []dlpRule, name string, data []byte) ([]byte, bool) {
+	for _, rule := range rules {
+		n := len(rule.re.FindAllIndex(data, -1))
+		if n == 0 {
+			continue
+		}
+		s.dlpStats.Add("findings", int64(n))
+		s.noticef("dlp:"+name+":"+rule.Name, "[dlp] %s: %d match(es) of rule %s (%s)", name, n, rule.Name, rule.Action)
+		if rule.Action == "block" {
+			s.dlpStats.Add("blocked", 1)
+			return nil, true
+		}
+		data = rule.re.ReplaceAllLiteral(data, []byte(rule.Replacement))
+	}
+	return data, false
+}
+
+// serveInspected writes the content read from r with the rules applied.
+// Content up to -dlp-max-size is inspected as a whole before anything is
+// sent, so a block rule results in a 403. Larger content is streamed and
+// inspected line by line; a block rule matching then aborts the response.
+func (s *server) serveInspected(w http.ResponseWriter, rules []dlpRule, name string, r io.Reader) {
+	head, err := io.ReadAll(io.LimitReader(r, s.dlpMaxSize+1))
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	w.Header().Del("Content-Length")
+	if int64(len(head)) <= s.dlpMaxSize {
+		out, blocked := s.applyDLP(rules, name, head)
+		if blocked {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		setIntHeader(w, "Content-Length", int64(len(out)))
+		w.Write(out)
+		return
+	}
+
+	br := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(head), r), dlpLineLimit)
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			out, blocked := s.applyDLP(rules, name, line)
+			if blocked {
+				// The status line is gone; cut the response short instead.
+				panic(http.ErrAbortHandler)
+			}
+			if _, werr := w.Write(out); werr != nil {
+				return
+			}
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package gcsproxy
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// egressQuota is an entry of the quotas section of the config file. Once
+// the responses for objects of a bucket matching Bucket (which may contain
+// wildcards) have sent Daily bytes in a UTC day, or Monthly bytes in a UTC
+// month, further requests get Status (429 by default, or 503) until the
+// period ends:
+//
+//	{"quotas": [{"bucket": "downloads", "daily": "200G", "monthly": "3T"}]}
+//
+// The first quota matching a bucket applies. Bytes are counted per instance.
+type egressQuota struct {
+	Bucket  string `json:"bucket"`
+	Daily   string `json:"daily,omitempty"`
+	Monthly string `json:"monthly,omitempty"`
+	Status  int    `json:"status,omitempty"`
+
+	daily, monthly float64
+}
+
+// compileQuotas validates quotas and parses their sizes.
+func compileQuotas(quotas []egressQuota) error {
+	for i := range quotas {
+		q := &quotas[i]
+		if _, err := parseBucketPatterns(q.Bucket); err != nil || q.Bucket == "" {
+			return fmt.Errorf("quota %d: invalid bucket %q", i, q.Bucket)
+		}
+		var err error
+		if q.daily, err = parseSize(q.Daily); err != nil {
+			return fmt.Errorf("quota %s: %v", q.Bucket, err)
+		}
+		if q.monthly, err = parseSize(q.Monthly); err != nil {
+			return fmt.Errorf("quota %s: %v", q.Bucket, err)
+		}
+		switch q.Status {
+		case 0:
+			q.Status = http.StatusTooManyRequests
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		default:
+			return fmt.Errorf("quota %s: status must be 429 or 503", q.Bucket)
+		}
+	}
+	return nil
+}
+
+func (rules *rules) matchQuota(bucket string) *egressQuota {
+	for i := range rules.quotas {
+		if matchBucket([]string{rules.quotas[i].Bucket}, bucket) {
+			return &rules.quotas[i]
+		}
+	}
+	return nil
+}
+
+type bucketEgress struct {
+	day, month           string
+	dayBytes, monthBytes float64
+}
+
+type egressCounter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucketEgress
+}
+
+// current returns the bucket's counts, reset if a new day or month has
+// started. c.mu must be held.
+func (c *egressCounter) current(bucket string, now time.Time) *bucketEgress {
+	e, ok := c.buckets[bucket]
+	if !ok {
+		e = &bucketEgress{}
+		c.buckets[bucket] = e
+	}
+	now = now.UTC()
+	if day := now.Format("2006-01-02"); e.day != day {
+		e.day, e.dayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); e.month != month {
+		e.month, e.monthBytes = month, 0
+	}
+	return e
+}
+
+func (c *egressCounter) add(bucket string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.current(bucket, time.Now())
+	e.dayBytes += float64(n)
+	e.monthBytes += float64(n)
+}
+
+// exceeded returns when the quota's period ends, if the bucket has used up
+// the quota.
+func (c *egressCounter) exceeded(q *egressQuota, bucket string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UTC()
+	e := c.current(bucket, now)
+	if q.monthly > 0 && e.monthBytes >= q.monthly {
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC), true
+	}
+	if q.daily > 0 && e.dayBytes >= q.daily {
+		return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC), true
+	}
+	return time.Time{}, false
+}
+
+// checkEgressQuota answers with the quota's status and returns false if the
+// bucket has used up its egress quota.
+func (s *server) checkEgressQuota(w http.ResponseWriter, rules *rules, bucket string) bool {
+	q := rules.matchQuota(bucket)
+	if q == nil {
+		return true
+	}
+	reset, exceeded := s.egress.exceeded(q, bucket)
+	if !exceeded {
+		return true
+	}
+	s.egressStats.Add("quotaExceeded", 1)
+	s.noticef("egress-quota:"+bucket, "Egress quota of %s exceeded until %s", bucket, reset.Format(time.RFC3339))
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+	http.Error(w, "egress quota exceeded", q.Status)
+	return false
+}
+
+// countEgress counts the bytes read from body as served from the bucket.
+func (s *server) countEgress(bucket string, body io.Reader) io.Reader {
+	return &egressReader{r: body, bucket: bucket, counter: s.egress, stats: s.egressStats}
+}
+
+type egressReader struct {
+	r       io.Reader
+	bucket  string
+	counter *egressCounter
+	stats   *expvar.Map
+}
+
+func (e *egressReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if n > 0 {
+		e.counter.add(e.bucket, n)
+		e.stats.Add(e.bucket, int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,108 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Object names are taken from the request path percent-decoded exactly once
+// and are otherwise used verbatim: the path isn't cleaned, so "//", "." and
+// ".." segments are part of the name, and "+" is a plus sign, not a space.
+// Characters that can't appear literally in a path, such as "?", "#", "%"
+// and spaces, must be percent-encoded (%3F, %23, %25, %20).
+//
+// With -strict-encoding, requests whose path contains anything RFC 3986
+// doesn't allow unencoded are rejected instead of being interpreted
+// leniently, so that every object has exactly one spelling.
+
+// checkEncoding rejects requests with paths that aren't strictly RFC 3986
+// encoded, if -strict-encoding is set.
+func (s *server) checkEncoding(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.strictEncoding && !validPathEncoding(rawPath(r)) {
+			http.Error(w, "path is not RFC 3986 encoded", http.StatusBadRequest)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// rawPath returns the path as sent by the client.
+func rawPath(r *http.Request) string {
+	raw := r.RequestURI
+	if i := strings.IndexByte(raw, '?'); i >= 0 {
+		raw = raw[:i]
+	}
+	if !strings.HasPrefix(raw, "/") {
+		// Absolute-form request target.
+		return r.URL.EscapedPath()
+	}
+	return raw
+}
+
+// validPathEncoding reports whether p consists only of RFC 3986 path
+// characters and well-formed percent-encodings.
+func validPathEncoding(p string) bool {
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("-._~!$&'()*+,;=:@/", c) >= 0:
+		case c == '%':
+			if i+2 >= len(p) || !isHex(p[i+1]) || !isHex(p[i+2]) {
+				return false
+			}
+			i += 2
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// checkObjectName rejects requests for object names GCS can't store, or
+// that exceed the configured limits, before they reach the router's
+// fallbacks or the GCS client: a name longer than -max-object-name bytes
+// gets a 414, one with more than -max-path-depth segments, invalid UTF-8 or
+// line breaks a 400. It returns false if the request was rejected.
+func (s *server) checkObjectName(w http.ResponseWriter, object string) bool {
+	status, stat, msg := s.objectNameProblem(object)
+	if status == 0 {
+		return true
+	}
+	s.nameStats.Add(stat, 1)
+	http.Error(w, msg, status)
+	return false
+}
+
+// objectNameProblem returns the status, metrics key and message rejecting an
+// object name, or a zero status if the name is fine.
+func (s *server) objectNameProblem(object string) (status int, stat, msg string) {
+	switch {
+	case s.maxObjectName > 0 && len(object) > s.maxObjectName:
+		return http.StatusRequestURITooLong, "tooLong", fmt.Sprintf("object name longer than %d bytes", s.maxObjectName)
+	case s.maxPathDepth > 0 && pathDepth(object) > s.maxPathDepth:
+		return http.StatusBadRequest, "tooDeep", fmt.Sprintf("object path deeper than %d segments", s.maxPathDepth)
+	case !utf8.ValidString(object) || strings.ContainsAny(object, "\r\n"):
+		return http.StatusBadRequest, "invalid", "object name must be UTF-8 without line breaks"
+	}
+	return 0, "", ""
+}
+
+// pathDepth returns the number of non-empty segments of an object name, so
+// that "a/b/" and "a//b" are two deep like "a/b".
+func pathDepth(object string) int {
+	n := 0
+	for _, seg := range strings.Split(object, "/") {
+		if seg != "" {
+			n++
+		}
+	}
+	return n
+}
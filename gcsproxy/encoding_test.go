@@ -0,0 +1,20 @@
+package gcsproxy
+
+import "testing"
+
+func TestPathDepth(t *testing.T) {
+	tests := map[string]int{
+		"":         0,
+		"a":        1,
+		"a/b":      2,
+		"a/b/":     2,
+		"a//b":     2,
+		"/a/b/c":   3,
+		"a/b/c/d/": 4,
+	}
+	for object, want := range tests {
+		if got := pathDepth(object); got != want {
+			t.Errorf("pathDepth(%q) = %d, want %d", object, got, want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package gcsproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const (
+	// encryptionChunk is the amount of plaintext sealed at a time.
+	encryptionChunk = 64 << 10
+	// recipientHeader names the recipient whose key a response is
+	// encrypted with.
+	recipientHeader = "X-Gcsproxy-Recipient"
+)
+
+// loadRecipientKeys reads a JSON object mapping recipient names to
+// base64-encoded 32-byte keys.
+func loadRecipientKeys(path string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encoded map[string]string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	keys := make(map[string][]byte)
+	for name, s := range encoded {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s: key of %s must be 32 bytes, base64 encoded", path, name)
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
+
+// encryptResponse returns a writer encrypting the body for the recipient
+// the request names, or nil if it names none and encryption isn't required.
+// It answers the request with a 403 and returns false if the recipient is
+// unknown, or missing while -encryption-required is set.
+func (s *server) encryptResponse(w http.ResponseWriter, r *http.Request) (*encryptingWriter, bool) {
+	name := r.Header.Get(recipientHeader)
+	if name == "" && !s.encryptionRequired {
+		return nil, true
+	}
+	key, ok := s.recipientKeys[name]
+	if !ok {
+		http.Error(w, "unknown or missing "+recipientHeader, http.StatusForbidden)
+		return nil, false
+	}
+	w.Header().Add("Vary", recipientHeader)
+	return &encryptingWriter{ResponseWriter: w, recipient: name, key: key}, true
+}
+
+// encryptingWriter encrypts successful responses with AES-256-GCM in chunks
+// of encryptionChunk bytes, so that they can be streamed. The key is derived
+// from the recipient's key and a random salt sent along:
+//
+//	X-Gcsproxy-Encryption: aes-256-gcm-stream; recipient=<name>; salt=<base64url>
+//
+// key = HMAC-SHA256(recipient key, salt). Chunk i is sealed with the 12-byte
+// nonce made of i as a big-endian uint64, three zero bytes and a byte that
+// is 1 for the last chunk and 0 otherwise. Only the last chunk may be
+// shorter than encryptionChunk, and it is empty only for an empty body. Other
+// responses, such as errors, are passed through as they are.
+type encryptingWriter struct {
+	http.ResponseWriter
+	recipient string
+	key       []byte
+
+	wroteHeader bool
+	discard     bool        // set once nothing more may be written
+	aead        cipher.AEAD // nil unless the response is encrypted
+	buf         []byte
+	counter     uint64
+}
+
+func (w *encryptingWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	if status == http.StatusOK {
+		if err := w.start(); err != nil {
+			http.Error(w.ResponseWriter, err.Error(), http.StatusInternalServerError)
+			w.discard = true
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// start derives the key for the response and rewrites its headers.
+func (w *encryptingWriter) start() error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, w.key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return err
+	}
+	if w.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+
+	h := w.Header()
+	h.Set("X-Gcsproxy-Encryption", fmt.Sprintf("aes-256-gcm-stream; recipient=%s; salt=%s",
+		w.recipient, base64.RawURLEncoding.EncodeToString(salt)))
+	// The body is opaque now; the original representation travels along for
+	// the recipient.
+	for _, key := range []string{"Content-Type", "Content-Encoding"} {
+		if v := h.Get(key); v != "" {
+			h.Set("X-Gcsproxy-"+key, v)
+			h.Del(key)
+		}
+	}
+	h.Set("Content-Type", "application/octet-stream")
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+		h.Set("Content-Length", strconv.FormatInt(encryptedLength(n), 10))
+	}
+	return nil
+}
+
+// encryptedLength returns the size of n bytes of plaintext once encrypted.
+func encryptedLength(n int64) int64 {
+	chunks := (n + encryptionChunk - 1) / encryptionChunk
+	if chunks == 0 {
+		chunks = 1
+	}
+	return n + chunks*16
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(p), nil
+	}
+	if w.aead == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, since the
+		// last chunk has to be marked as such.
+		if len(w.buf) == encryptionChunk {
+			if err := w.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		take := encryptionChunk - len(w.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+	}
+	return n, nil
+}
+
+func (w *encryptingWriter) seal(last bool) error {
+	nonce := make([]byte, w.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, w.counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	w.counter++
+	_, err := w.ResponseWriter.Write(w.aead.Seal(nil, nonce, w.buf, nil))
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Close writes the last chunk of an encrypted response.
+func (w *encryptingWriter) Close() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.aead == nil || w.discard {
+		return nil
+	}
+	w.discard = true
+	return w.seal(true)
+}
@@ -0,0 +1,48 @@
+package gcsproxy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// usingEmulator reports whether GCS is an emulator such as fake-gcs-server,
+// set with STORAGE_EMULATOR_HOST (which the storage library honors) or an
+// http:// -endpoint. Emulators are used without credentials.
+func (s *server) usingEmulator() bool {
+	return os.Getenv("STORAGE_EMULATOR_HOST") != "" || strings.HasPrefix(s.endpoint, "http://")
+}
+
+// endpointOptions returns the client options for -endpoint.
+func (s *server) endpointOptions() []option.ClientOption {
+	if s.endpoint == "" {
+		return nil
+	}
+	opts := []option.ClientOption{option.WithEndpoint(s.endpoint)}
+	if s.usingEmulator() {
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	return opts
+}
+
+// newStorageClient creates a storage client, using gRPC with -grpc or the
+// tuned HTTP transport with the -gcs-* transport flags. The storage library
+// only offers its gRPC client through the STORAGE_USE_GRPC environment
+// variable, which affects the whole process, so New refuses -grpc.
+func (s *server) newStorageClient(ctx context.Context, opts ...option.ClientOption) (*storage.Client, error) {
+	if s.useGRPC {
+		if strings.HasPrefix(s.endpoint, "http://") {
+			return nil, errors.New("-grpc can't be used with an http:// -endpoint")
+		}
+		os.Setenv("STORAGE_USE_GRPC", "true")
+	}
+	opts, err := s.transportOptions(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewClient(ctx, opts...)
+}
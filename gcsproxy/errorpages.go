@@ -0,0 +1,165 @@
+package gcsproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errorPage is the value of an entry in the errorPages section of the
+// config file, keyed by status code: either an object (<bucket>/<object>)
+// or an inline HTML template, which gets the Status, StatusText and Path of
+// the request.
+//
+//	"errorPages": {
+//	  "404": "site-bucket/errors/404.html",
+//	  "503": {"template": "<h1>{{.StatusText}}</h1><p>Back soon.</p>"}
+//	}
+type errorPage struct {
+	Object   string `json:"object,omitempty"`
+	Template string `json:"template,omitempty"`
+
+	tmpl *template.Template
+}
+
+func (p *errorPage) UnmarshalJSON(data []byte) error {
+	var object string
+	if err := json.Unmarshal(data, &object); err == nil {
+		*p = errorPage{Object: object}
+		return nil
+	}
+	type plain errorPage
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+func compileErrorPages(pages map[string]errorPage) (map[int]*errorPage, error) {
+	compiled := make(map[int]*errorPage)
+	for key, p := range pages {
+		code, err := strconv.Atoi(key)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("error page %q: not an error status code", key)
+		}
+		p := p
+		switch {
+		case p.Object != "" && p.Template != "":
+			return nil, fmt.Errorf("error page %d: object and template are exclusive", code)
+		case p.Object != "":
+			if parts := strings.SplitN(p.Object, "/", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("error page %d: object must be <bucket>/<object>", code)
+			}
+		case p.Template != "":
+			if p.tmpl, err = template.New(key).Parse(p.Template); err != nil {
+				return nil, fmt.Errorf("error page %d: %v", code, err)
+			}
+		default:
+			return nil, fmt.Errorf("error page %d: object or template is required", code)
+		}
+		compiled[code] = &p
+	}
+	return compiled, nil
+}
+
+// withErrorPages replaces the body of error responses that have a page
+// configured, so clients never see the internal error text.
+func (s *server) withErrorPages(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pages := s.activeRules().errorPages
+		if len(pages) == 0 {
+			fn(w, r)
+			return
+		}
+		fn(&errorPageWriter{ResponseWriter: w, s: s, r: r, pages: pages}, r)
+	}
+}
+
+type errorPageWriter struct {
+	http.ResponseWriter
+	s     *server
+	r     *http.Request
+	pages map[int]*errorPage
+
+	// keep is set by handlers that write an error page of their own.
+	keep     bool
+	replaced bool
+}
+
+func (w *errorPageWriter) WriteHeader(status int) {
+	if p := w.pages[status]; p != nil && !w.keep && !w.replaced && w.render(p, status) {
+		w.replaced = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorPageWriter) Flush() {
+	if !w.replaced {
+		flush(w.ResponseWriter)
+	}
+}
+
+// render writes the page with the status. It returns false if the page
+// can't be produced, leaving the response untouched.
+func (w *errorPageWriter) render(p *errorPage, status int) bool {
+	var body []byte
+	contentType := "text/html; charset=utf-8"
+	if p.Object != "" {
+		parts := strings.SplitN(p.Object, "/", 2)
+		objr, err := w.s.bucketHandle(parts[0], parts[1]).Object(parts[1]).NewReader(w.r.Context())
+		if err != nil {
+			w.s.warnf("error-page:"+p.Object, "Error page %s can't be read: %v", p.Object, err)
+			return false
+		}
+		defer objr.Close()
+		if body, err = io.ReadAll(objr); err != nil {
+			return false
+		}
+		if objr.Attrs.ContentType != "" {
+			contentType = objr.Attrs.ContentType
+		}
+	} else {
+		var buf bytes.Buffer
+		err := p.tmpl.Execute(&buf, struct {
+			Status     int
+			StatusText string
+			Path       string
+		}{status, http.StatusText(status), w.r.URL.Path})
+		if err != nil {
+			return false
+		}
+		body = buf.Bytes()
+	}
+
+	h := w.Header()
+	for _, key := range []string{"Content-Encoding", "Content-Disposition", "ETag", "Last-Modified", "X-Content-Type-Options"} {
+		h.Del(key)
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Cache-Control", "no-store")
+	w.ResponseWriter.WriteHeader(status)
+	w.ResponseWriter.Write(body)
+	return true
+}
+
+// keepErrorPage tells the errorPageWriter under w, if any, that the handler
+// writes an error page of its own.
+func keepErrorPage(w http.ResponseWriter) {
+	if ew, ok := w.(*encryptingWriter); ok {
+		w = ew.ResponseWriter
+	}
+	if ew, ok := w.(*errorPageWriter); ok {
+		ew.keep = true
+	}
+}
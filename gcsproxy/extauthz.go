@@ -0,0 +1,225 @@
+package gcsproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// extAuthzForwardHeaders are always forwarded to the authorization service,
+// in addition to the ones listed in -ext-authz-headers.
+var extAuthzForwardHeaders = []string{"Authorization", "Cookie", "X-Forwarded-For"}
+
+// maxCachedDecisions is the cache size at which expired decisions are swept
+// on insert, and beyond which the cache doesn't grow.
+const maxCachedDecisions = 10000
+
+var (
+	extAuthzClient = &http.Client{}
+)
+
+type decision struct {
+	allowed bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+type decisionCache struct {
+	mu      sync.Mutex
+	entries map[string]*decision
+}
+
+func (c *decisionCache) get(key string) *decision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(d.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return d
+}
+
+func (c *decisionCache) put(key string, d *decision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedDecisions {
+		c.sweepLocked()
+		trimMap(c.entries, maxCachedDecisions)
+	}
+	c.entries[key] = d
+}
+
+// trimMap deletes arbitrary entries of m until a tenth of max is free, so
+// that a cache stays bounded when sweeping expired entries frees too little,
+// e.g. when a client sends many distinct requests within the TTL. Map
+// iteration order makes the choice random enough.
+func trimMap[K comparable, V any](m map[K]V, max int) {
+	for k := range m {
+		if len(m) < max-max/10 {
+			return
+		}
+		delete(m, k)
+	}
+}
+
+// sweep drops expired decisions and returns how many were removed.
+func (c *decisionCache) sweep() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sweepLocked()
+}
+
+func (c *decisionCache) sweepLocked() int {
+	now := time.Now()
+	n := 0
+	for k, d := range c.entries {
+		if now.After(d.expires) {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// authorize asks the external authorization service, if configured, whether
+// the request may be served. The service receives the original method, path
+// and the forwarded headers, in the manner of Envoy's HTTP ext_authz filter:
+// a 2xx response allows the request, anything else is returned to the client
+// as is. A grpc:// or grpcs:// -ext-authz is asked with the ext_authz gRPC
+// API instead, see checkExtAuthzGRPC.
+func (s *server) authorize(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.extAuthz == "" {
+			fn(w, r)
+			return
+		}
+		d, err := s.checkExtAuthz(r)
+		if err != nil {
+			// An unavailable service isn't a denial.
+			s.warnf("ext-authz", "ext_authz check failed: %v", err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		for k, vs := range d.header {
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+		if !d.allowed {
+			w.WriteHeader(d.status)
+			w.Write(d.body)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (s *server) checkExtAuthz(r *http.Request) (*decision, error) {
+	forward := s.extAuthzForward
+	key := extAuthzCacheKey(r, forward)
+	if s.extAuthzCacheTTL > 0 {
+		if d := s.extAuthzCache.get(key); d != nil {
+			return d, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.extAuthzTimeout)
+	defer cancel()
+	check := s.checkExtAuthzHTTP
+	if s.extAuthzConn != nil {
+		check = s.checkExtAuthzGRPC
+	}
+	d, err := check(ctx, r, forward)
+	if err != nil {
+		return nil, err
+	}
+	if s.extAuthzCacheTTL > 0 {
+		s.extAuthzCache.put(key, d)
+	}
+	return d, nil
+}
+
+// checkExtAuthzHTTP asks an HTTP authorization service.
+func (s *server) checkExtAuthzHTTP(ctx context.Context, r *http.Request, forward []string) (*decision, error) {
+	req, err := http.NewRequestWithContext(ctx, r.Method, strings.TrimSuffix(s.extAuthz, "/")+r.URL.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range forward {
+		if v := r.Header.Values(name); len(v) > 0 {
+			req.Header[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	resp, err := extAuthzClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	d := &decision{
+		allowed: resp.StatusCode >= 200 && resp.StatusCode < 300,
+		status:  resp.StatusCode,
+		header:  make(http.Header),
+		expires: time.Now().Add(s.extAuthzCacheTTL),
+	}
+	if d.allowed {
+		for _, name := range s.extAuthzInjected {
+			if v := resp.Header.Values(name); len(v) > 0 {
+				d.header[http.CanonicalHeaderKey(name)] = v
+			}
+		}
+	} else {
+		d.body, err = io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if err != nil {
+			return nil, err
+		}
+		setHeaderFrom(d.header, resp.Header, "Content-Type")
+		setHeaderFrom(d.header, resp.Header, "WWW-Authenticate")
+		setHeaderFrom(d.header, resp.Header, "Location")
+	}
+	return d, nil
+}
+
+func (s *server) extAuthzHeaderNames() []string {
+	return append(append([]string{}, extAuthzForwardHeaders...), splitList(s.extAuthzHeaders)...)
+}
+
+func extAuthzCacheKey(r *http.Request, forward []string) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.URL.RequestURI())
+	for _, name := range forward {
+		b.WriteByte('\n')
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func setHeaderFrom(dst, src http.Header, key string) {
+	if v := src.Get(key); v != "" {
+		dst.Set(key, v)
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,256 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	grpccreds "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// extAuthzCheckMethod is the method of Envoy's ext_authz gRPC service.
+const extAuthzCheckMethod = "/envoy.service.auth.v3.Authorization/Check"
+
+// dialExtAuthz connects to the authorization service of -ext-authz if it is
+// a gRPC one. grpcs:// uses TLS, grpc:// plain text.
+func (s *server) dialExtAuthz() error {
+	u, err := url.Parse(s.extAuthz)
+	if err != nil {
+		return fmt.Errorf("invalid -ext-authz: %v", err)
+	}
+	var creds grpccreds.TransportCredentials
+	switch u.Scheme {
+	case "grpc":
+		creds = insecure.NewCredentials()
+	case "grpcs":
+		creds = grpccreds.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	default:
+		return nil
+	}
+	if u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return fmt.Errorf("invalid -ext-authz %q, expected grpc://<host>:<port>", s.extAuthz)
+	}
+	s.extAuthzConn, err = grpc.Dial(u.Host, grpc.WithTransportCredentials(creds))
+	return err
+}
+
+// checkExtAuthzGRPC asks a gRPC authorization service, in the manner of
+// Envoy's ext_authz filter: an OK status allows the request, and the
+// denied response, by default a 403, is returned to the client otherwise.
+// The response headers the service adds to an allowed request are copied
+// onto the proxied response.
+func (s *server) checkExtAuthzGRPC(ctx context.Context, r *http.Request, forward []string) (*decision, error) {
+	var resp []byte
+	err := s.extAuthzConn.Invoke(ctx, extAuthzCheckMethod, s.checkRequest(r, forward), &resp, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseCheckResponse(resp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CheckResponse: %v", err)
+	}
+	d.expires = time.Now().Add(s.extAuthzCacheTTL)
+	return d, nil
+}
+
+// rawCodec passes encoded messages through, as the ext_authz messages are
+// encoded by hand rather than with generated code.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: can't marshal %T", v)
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec: can't unmarshal into %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+// checkRequest encodes an envoy.service.auth.v3.CheckRequest for the
+// request, with the client's address as the source and the method, path,
+// host, scheme and forwarded headers of the request.
+func (s *server) checkRequest(r *http.Request, forward []string) []byte {
+	var socket []byte // envoy.config.core.v3.SocketAddress
+	socket = appendString(socket, 2, s.clientIP(r))
+	var address []byte // envoy.config.core.v3.Address
+	address = appendMessage(address, 1, socket)
+	var source []byte // AttributeContext.Peer
+	source = appendMessage(source, 1, address)
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	var req []byte // AttributeContext.HttpRequest
+	req = appendString(req, 2, r.Method)
+	for _, name := range forward {
+		if v := r.Header.Values(name); len(v) > 0 {
+			var entry []byte
+			entry = appendString(entry, 1, strings.ToLower(name))
+			entry = appendString(entry, 2, strings.Join(v, ","))
+			req = appendMessage(req, 3, entry)
+		}
+	}
+	req = appendString(req, 4, r.URL.RequestURI())
+	req = appendString(req, 5, requestHost(r))
+	req = appendString(req, 6, scheme)
+	req = appendString(req, 10, r.Proto)
+	var request []byte // AttributeContext.Request
+	request = appendMessage(request, 2, req)
+
+	var attrs []byte // AttributeContext
+	attrs = appendMessage(attrs, 1, source)
+	attrs = appendMessage(attrs, 4, request)
+	var check []byte // CheckRequest
+	return appendMessage(check, 1, attrs)
+}
+
+// parseCheckResponse decodes an envoy.service.auth.v3.CheckResponse.
+func parseCheckResponse(b []byte) (*decision, error) {
+	d := &decision{allowed: true, header: make(http.Header)}
+	var denied []byte
+	err := eachField(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1: // google.rpc.Status
+			return eachField(v, func(num protowire.Number, v []byte) error {
+				if num == 1 {
+					code, n := protowire.ConsumeVarint(v)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					d.allowed = code == 0
+				}
+				return nil
+			})
+		case 2: // DeniedHttpResponse
+			denied = v
+		case 3: // OkHttpResponse
+			return eachField(v, func(num protowire.Number, v []byte) error {
+				if num == 6 { // response_headers_to_add
+					return addHeaderValueOption(d.header, v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || d.allowed {
+		return d, err
+	}
+
+	d.header = make(http.Header)
+	d.status = http.StatusForbidden
+	err = eachField(denied, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1: // envoy.type.v3.HttpStatus
+			return eachField(v, func(num protowire.Number, v []byte) error {
+				if num == 1 {
+					code, n := protowire.ConsumeVarint(v)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					if code >= 100 && code <= 599 {
+						d.status = int(code)
+					}
+				}
+				return nil
+			})
+		case 2:
+			return addHeaderValueOption(d.header, v)
+		case 3:
+			d.body = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return d, err
+}
+
+// addHeaderValueOption adds the header of an
+// envoy.config.core.v3.HeaderValueOption to h.
+func addHeaderValueOption(h http.Header, b []byte) error {
+	return eachField(b, func(num protowire.Number, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var key, value string
+		err := eachField(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case 1:
+				key = string(v)
+			case 2, 3:
+				value = string(v)
+			}
+			return nil
+		})
+		if err == nil && key != "" {
+			h.Add(key, value)
+		}
+		return err
+	})
+}
+
+// eachField calls fn with the number and value of each field of an encoded
+// message. Values are the bytes of length-delimited fields and the encoded
+// varint of varint fields; fields of other types are skipped.
+func eachField(b []byte, fn func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			_, n = protowire.ConsumeVarint(b)
+			if n >= 0 {
+				v = b[:n]
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if v == nil && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
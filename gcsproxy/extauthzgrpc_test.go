@@ -0,0 +1,196 @@
+package gcsproxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field returns the value of the field at path, e.g. field(b, 1, 4) is field
+// 4 of the message in field 1, or nil if there is none.
+func field(t *testing.T, b []byte, path ...protowire.Number) []byte {
+	t.Helper()
+	for _, num := range path {
+		var found []byte
+		if err := eachField(b, func(n protowire.Number, v []byte) error {
+			if n == num && found == nil {
+				found = v
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if found == nil {
+			return nil
+		}
+		b = found
+	}
+	return b
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// headerOption encodes an envoy.config.core.v3.HeaderValueOption.
+func headerOption(key, value string) []byte {
+	var h []byte
+	h = appendString(h, 1, key)
+	h = appendString(h, 2, value)
+	return appendMessage(nil, 1, h)
+}
+
+// allowResponse encodes a CheckResponse with an OK status adding a header.
+func allowResponse(key, value string) []byte {
+	var resp []byte
+	resp = appendMessage(resp, 1, appendVarint(nil, 1, 0))
+	return appendMessage(resp, 3, appendMessage(nil, 6, headerOption(key, value)))
+}
+
+// denyResponse encodes a CheckResponse with a PERMISSION_DENIED status and
+// the denied response; a zero status leaves it unset.
+func denyResponse(status int, key, value, body string) []byte {
+	var denied []byte
+	if status != 0 {
+		denied = appendMessage(denied, 1, appendVarint(nil, 1, uint64(status)))
+	}
+	denied = appendMessage(denied, 2, headerOption(key, value))
+	denied = appendString(denied, 3, body)
+	var resp []byte
+	resp = appendMessage(resp, 1, appendVarint(nil, 1, 7))
+	return appendMessage(resp, 2, denied)
+}
+
+func TestCheckRequest(t *testing.T) {
+	s := newServer()
+	r := httptest.NewRequest("GET", "http://files.example.com/b/o.txt?x=1", nil)
+	r.RemoteAddr = "192.0.2.1:4321"
+	r.Header.Set("Authorization", "Bearer t")
+	r.Header.Set("Cookie", "c=1")
+	b := s.checkRequest(r, []string{"Authorization", "X-Missing"})
+
+	// CheckRequest.attributes.request.http
+	req := field(t, b, 1, 4, 2)
+	for num, want := range map[protowire.Number]string{2: "GET", 4: "/b/o.txt?x=1", 5: "files.example.com", 6: "http", 10: "HTTP/1.1"} {
+		if got := string(field(t, req, num)); got != want {
+			t.Errorf("http field %d = %q, want %q", num, got, want)
+		}
+	}
+	if got := string(field(t, req, 3, 1)) + "=" + string(field(t, req, 3, 2)); got != "authorization=Bearer t" {
+		t.Errorf("header = %q", got)
+	}
+	var headers int
+	eachField(req, func(num protowire.Number, v []byte) error {
+		if num == 3 {
+			headers++
+		}
+		return nil
+	})
+	if headers != 1 {
+		t.Errorf("%d headers forwarded, want only Authorization", headers)
+	}
+	// CheckRequest.attributes.source.address.socket_address.address
+	if got := string(field(t, b, 1, 1, 1, 1, 2)); got != "192.0.2.1" {
+		t.Errorf("source address = %q", got)
+	}
+}
+
+func TestParseCheckResponse(t *testing.T) {
+	d, err := parseCheckResponse(allowResponse("X-User", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.allowed || d.header.Get("X-User") != "alice" {
+		t.Errorf("allow: allowed = %v, header = %v", d.allowed, d.header)
+	}
+
+	d, err = parseCheckResponse(denyResponse(http.StatusUnauthorized, "WWW-Authenticate", "Bearer", "sign in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.allowed || d.status != http.StatusUnauthorized || d.header.Get("WWW-Authenticate") != "Bearer" || string(d.body) != "sign in" {
+		t.Errorf("deny: %+v", d)
+	}
+
+	d, err = parseCheckResponse(denyResponse(0, "Content-Type", "text/plain", "no"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.allowed || d.status != http.StatusForbidden {
+		t.Errorf("deny without a status: allowed = %v, status = %d", d.allowed, d.status)
+	}
+
+	// An empty response is an OK one, as protobuf leaves zero values out.
+	if d, err := parseCheckResponse(nil); err != nil || !d.allowed {
+		t.Errorf("empty response: %+v, %v", d, err)
+	}
+
+	deny := denyResponse(http.StatusForbidden, "X-Reason", "policy", "denied")
+	for name, b := range map[string][]byte{
+		"truncated":     deny[:len(deny)-3],
+		"bad tag":       {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"bad length":    {0x0a, 0x10, 0x08},
+		"bad status":    appendMessage(nil, 1, []byte{0x08, 0xff}),
+		"bad http code": appendMessage(appendMessage(nil, 1, appendVarint(nil, 1, 7)), 2, appendMessage(nil, 1, []byte{0x08})),
+	} {
+		if _, err := parseCheckResponse(b); err == nil {
+			t.Errorf("%s: malformed response was accepted", name)
+		}
+	}
+}
+
+// newTestAuthzServer serves the ext_authz Check method, answering with the
+// response decide returns for the request path.
+func newTestAuthzServer(t *testing.T, decide func(path string) []byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		var req []byte
+		if err := stream.RecvMsg(&req); err != nil {
+			return err
+		}
+		if m, _ := grpc.MethodFromServerStream(stream); m != extAuthzCheckMethod {
+			t.Errorf("method = %q", m)
+		}
+		return stream.SendMsg(decide(string(field(t, req, 1, 4, 2, 4))))
+	}))
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String()
+}
+
+func TestExtAuthzGRPC(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put("b", "public.txt", "text/plain", "public")
+	f.put("b", "secret.txt", "text/plain", "secret")
+	addr := newTestAuthzServer(t, func(path string) []byte {
+		if strings.Contains(path, "secret") {
+			return denyResponse(http.StatusUnauthorized, "WWW-Authenticate", "Bearer", "sign in")
+		}
+		return allowResponse("X-User", "alice")
+	})
+	h := newTestProxy(t, f, map[string]string{"ext-authz": "grpc://" + addr, "ext-authz-inject": "X-User"}, "")
+
+	w := do(h, "GET", "/b/public.txt")
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "public" || w.Header().Get("X-User") != "alice" {
+		t.Errorf("allowed: body %q, X-User %q", w.Body.String(), w.Header().Get("X-User"))
+	}
+	w = do(h, "GET", "/b/secret.txt")
+	expectStatus(t, w, http.StatusUnauthorized)
+	if w.Body.String() != "sign in" || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("denied: body %q, WWW-Authenticate %q", w.Body.String(), w.Header().Get("WWW-Authenticate"))
+	}
+
+	// A service that can't be reached isn't a denial.
+	h = newTestProxy(t, f, map[string]string{"ext-authz": "grpc://127.0.0.1:1", "ext-authz-timeout": "1s"}, "")
+	expectStatus(t, do(h, "GET", "/b/public.txt"), http.StatusServiceUnavailable)
+}
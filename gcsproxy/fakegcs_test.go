@@ -0,0 +1,282 @@
+package gcsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// fakeObject is an object stored by fakeGCS.
+type fakeObject struct {
+	data        []byte
+	contentType string
+	metadata    map[string]string
+	generation  int64
+	updated     time.Time
+}
+
+// fakeGCS serves the parts of the GCS JSON and XML APIs the proxy uses:
+// object metadata, listings, reads (with ranges), multipart uploads and
+// deletes, with generation preconditions.
+type fakeGCS struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	objects    map[string]*fakeObject
+	generation int64
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	f := &fakeGCS{objects: make(map[string]*fakeObject), generation: 1000}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// client returns a storage client talking to the fake.
+func (f *fakeGCS) client(t *testing.T) *storage.Client {
+	c, err := storage.NewClient(context.Background(), option.WithEndpoint(f.URL+"/storage/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// put stores an object; metadata is given as key/value pairs.
+func (f *fakeGCS) put(bucket, name, contentType, data string, metadata ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o := &fakeObject{data: []byte(data), contentType: contentType, metadata: make(map[string]string)}
+	for i := 0; i+1 < len(metadata); i += 2 {
+		o.metadata[metadata[i]] = metadata[i+1]
+	}
+	f.store(bucket, name, o)
+}
+
+// get returns a stored object, or nil.
+func (f *fakeGCS) get(bucket, name string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[bucket+"/"+name]
+}
+
+// store adds the object as a new generation. f.mu must be held.
+func (f *fakeGCS) store(bucket, name string, o *fakeObject) {
+	f.generation++
+	o.generation = f.generation
+	o.updated = time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	f.objects[bucket+"/"+name] = o
+}
+
+func (f *fakeGCS) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := r.URL.EscapedPath()
+	switch {
+	case strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		bucket, _ := url.PathUnescape(strings.TrimSuffix(strings.TrimPrefix(path, "/upload/storage/v1/b/"), "/o"))
+		f.upload(w, r, bucket)
+	case strings.HasPrefix(path, "/storage/v1/b/"):
+		rest := strings.TrimPrefix(path, "/storage/v1/b/")
+		bucket, rest, _ := strings.Cut(rest, "/")
+		if rest == "o" {
+			f.list(w, r, bucket)
+			return
+		}
+		name, err := url.PathUnescape(strings.TrimPrefix(rest, "o/"))
+		if err != nil || !strings.HasPrefix(rest, "o/") {
+			fakeError(w, http.StatusNotFound)
+			return
+		}
+		o, ok := f.objects[bucket+"/"+name]
+		if !ok {
+			fakeError(w, http.StatusNotFound)
+			return
+		}
+		if !preconditionMet(r, o) {
+			fakeError(w, http.StatusPreconditionFailed)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(o.resource(bucket, name))
+		case "DELETE":
+			delete(f.objects, bucket+"/"+name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			fakeError(w, http.StatusMethodNotAllowed)
+		}
+	default:
+		bucket, name, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		name, _ = url.PathUnescape(name)
+		o, ok := f.objects[bucket+"/"+name]
+		if !ok {
+			fakeError(w, http.StatusNotFound)
+			return
+		}
+		f.read(w, r, o)
+	}
+}
+
+// read serves the content of an object as the XML API does.
+func (f *fakeGCS) read(w http.ResponseWriter, r *http.Request, o *fakeObject) {
+	h := w.Header()
+	h.Set("Content-Type", o.contentType)
+	h.Set("Last-Modified", o.updated.Format(http.TimeFormat))
+	h.Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+	h.Set("X-Goog-Metageneration", "1")
+	data := o.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var start, end int64
+		spec := strings.TrimPrefix(rng, "bytes=")
+		from, to, _ := strings.Cut(spec, "-")
+		start, _ = strconv.ParseInt(from, 10, 64)
+		end = int64(len(data)) - 1
+		if to != "" {
+			end, _ = strconv.ParseInt(to, 10, 64)
+		}
+		if end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		if start > end {
+			fakeError(w, http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(data)
+	}
+}
+
+func (f *fakeGCS) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	prefix, delim := q.Get("prefix"), q.Get("delimiter")
+	var names []string
+	prefixes := make(map[string]bool)
+	for key := range f.objects {
+		b, name, _ := strings.Cut(key, "/")
+		if b != bucket || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delim != "" {
+			if i := strings.Index(name[len(prefix):], delim); i >= 0 {
+				prefixes[name[:len(prefix)+i+len(delim)]] = true
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resp := struct {
+		Kind     string        `json:"kind"`
+		Items    []interface{} `json:"items"`
+		Prefixes []string      `json:"prefixes"`
+	}{Kind: "storage#objects"}
+	for _, name := range names {
+		resp.Items = append(resp.Items, f.objects[bucket+"/"+name].resource(bucket, name))
+	}
+	for p := range prefixes {
+		resp.Prefixes = append(resp.Prefixes, p)
+	}
+	sort.Strings(resp.Prefixes)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// upload handles a multipart upload: the object's metadata as JSON followed
+// by its content.
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request, bucket string) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.URL.Query().Get("uploadType") != "multipart" {
+		fakeError(w, http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var meta struct {
+		Name        string            `json:"name"`
+		ContentType string            `json:"contentType"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	part, err := mr.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&meta)
+	}
+	if err == nil {
+		part, err = mr.NextPart()
+	}
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(part)
+	}
+	if err != nil {
+		fakeError(w, http.StatusBadRequest)
+		return
+	}
+	if !preconditionMet(r, f.objects[bucket+"/"+meta.Name]) {
+		fakeError(w, http.StatusPreconditionFailed)
+		return
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = part.Header.Get("Content-Type")
+	}
+	o := &fakeObject{data: data, contentType: meta.ContentType, metadata: meta.Metadata}
+	f.store(bucket, meta.Name, o)
+	json.NewEncoder(w).Encode(o.resource(bucket, meta.Name))
+}
+
+// preconditionMet checks ifGenerationMatch, where 0 requires the object not
+// to exist.
+func preconditionMet(r *http.Request, o *fakeObject) bool {
+	v := r.URL.Query().Get("ifGenerationMatch")
+	if v == "" {
+		return true
+	}
+	gen, _ := strconv.ParseInt(v, 10, 64)
+	if o == nil {
+		return gen == 0
+	}
+	return o.generation == gen
+}
+
+func (o *fakeObject) resource(bucket, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":           "storage#object",
+		"bucket":         bucket,
+		"name":           name,
+		"size":           strconv.Itoa(len(o.data)),
+		"contentType":    o.contentType,
+		"metadata":       o.metadata,
+		"generation":     strconv.FormatInt(o.generation, 10),
+		"metageneration": "1",
+		"storageClass":   "STANDARD",
+		"updated":        o.updated.Format(time.RFC3339),
+		"timeCreated":    o.updated.Format(time.RFC3339),
+	}
+}
+
+func fakeError(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, code, http.StatusText(code))
+}
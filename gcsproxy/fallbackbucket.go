@@ -0,0 +1,45 @@
+package gcsproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// fallbackBucketFor returns the bucket tried when an object can't be read
+// from its own bucket, if any. A route's fallbackBucket takes precedence
+// over -fallback-bucket.
+func (s *server) fallbackBucketFor(rt *route) string {
+	if rt != nil && rt.FallbackBucket != "" {
+		return rt.FallbackBucket
+	}
+	return s.fallbackBucket
+}
+
+// shouldFallBack reports whether a lookup that failed with err is worth
+// trying in the fallback bucket: the object is missing, or GCS failed or
+// timed out. Errors such as a 403 are served as they are.
+func (s *server) shouldFallBack(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code >= 500 {
+		return true
+	}
+	return err == storage.ErrObjectNotExist || err == errGCSUnavailable ||
+		errors.Is(err, context.DeadlineExceeded) || s.retryable(err)
+}
+
+// fromFallbackBucket looks the object up in the fallback bucket. The lookup
+// gets a deadline of its own, as the primary's may have run out.
+func (s *server) fromFallbackBucket(r *http.Request, rt *route, bucket, object string, gzipAcceptable bool) (*storage.ObjectHandle, *storage.ObjectAttrs, error) {
+	fb := s.fallbackBucketFor(rt)
+	ctx, cancel := s.attrsContext(r.Context())
+	defer cancel()
+	obj, attr, err := s.objectAttrs(ctx, fb, object, gzipAcceptable)
+	if err == nil {
+		s.fallbackStats.Add(bucket, 1)
+	}
+	return obj, attr, err
+}
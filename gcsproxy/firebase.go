@@ -0,0 +1,10 @@
+package gcsproxy
+
+// firebaseJWKS holds the keys Firebase Auth signs ID tokens with.
+const firebaseJWKS = "https://www.googleapis.com/service_accounts/v1/jwk/securetoken@system.gserviceaccount.com"
+
+// newFirebaseVerifier returns a verifier of the ID tokens Firebase Auth
+// issues for users of the project, which carry the user's UID as sub.
+func (s *server) newFirebaseVerifier(project string) *jwtVerifier {
+	return s.newJWTVerifier(firebaseJWKS, project, s.jwtJWKSRefresh, "https://securetoken.google.com/"+project)
+}
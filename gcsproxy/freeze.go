@@ -0,0 +1,112 @@
+package gcsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Freeze modes.
+const (
+	// freezeWrites rejects anything but reads.
+	freezeWrites = "writes"
+	// freezeAll rejects reads as well. Downstream caches configured to serve
+	// stale content on errors keep serving what they have.
+	freezeAll = "all"
+)
+
+// freezeRetryAfter is sent with responses rejected because of a freeze.
+const freezeRetryAfter = "60"
+
+// freezeTable records frozen buckets. It isn't persisted: a restart lifts
+// all freezes.
+type freezeTable struct {
+	mu    sync.RWMutex
+	modes map[string]string
+}
+
+func (t *freezeTable) mode(bucket string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.modes[bucket]
+}
+
+func (t *freezeTable) set(bucket, mode string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if mode == "" {
+		delete(t.modes, bucket)
+	} else {
+		t.modes[bucket] = mode
+	}
+}
+
+func (t *freezeTable) all() map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	modes := make(map[string]string, len(t.modes))
+	for k, v := range t.modes {
+		modes[k] = v
+	}
+	return modes
+}
+
+func isRead(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// checkFreeze rejects requests to frozen buckets.
+func (s *server) checkFreeze(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket, _ := s.target(s.activeRules(), r)
+		if !s.checkFrozen(w, bucket, isRead(r)) {
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// checkFrozen answers with a 503 and returns false if the bucket is frozen
+// for the access, a read or a write. It applies to anything acting on a
+// bucket's objects, including URLs signed for them and restores.
+func (s *server) checkFrozen(w http.ResponseWriter, bucket string, read bool) bool {
+	switch mode := s.frozenBuckets.mode(bucket); {
+	case mode == freezeAll, mode == freezeWrites && !read:
+		w.Header().Set("Retry-After", freezeRetryAfter)
+		http.Error(w, "bucket is frozen", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// listFreezes returns the frozen buckets and their modes.
+func (s *server) listFreezes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.frozenBuckets.all())
+}
+
+// freezeBucket freezes a bucket (PUT /-/freeze/<bucket>?mode=writes|all) or
+// lifts the freeze (DELETE).
+func (s *server) freezeBucket(w http.ResponseWriter, r *http.Request) {
+	bucket := mux.Vars(r)["bucket"]
+	mode := ""
+	if r.Method == http.MethodPut {
+		mode = r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = freezeWrites
+		}
+		if mode != freezeWrites && mode != freezeAll {
+			http.Error(w, "mode must be writes or all", http.StatusBadRequest)
+			return
+		}
+	}
+	s.frozenBuckets.set(bucket, mode)
+	if mode == "" {
+		s.logger.Printf("[freeze] %s unfrozen", bucket)
+	} else {
+		s.logger.Printf("[freeze] %s frozen (%s)", bucket, mode)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,324 @@
+package gcsproxy
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// Logger is where the proxy writes its service and error logs. *log.Logger
+// satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Config configures a proxy created with New.
+type Config struct {
+	// Options sets the proxy's flags by name, without the leading dash,
+	// e.g. {"bucket": "assets", "max-concurrent": "64"}. Values use the
+	// command line syntax. Options take precedence over ConfigFile.
+	Options map[string]string
+
+	// ConfigFile is an optional JSON config file, as with -config.
+	ConfigFile string
+
+	// Client is used to read objects. If nil, one is created from the
+	// "credentials" option or Application Default Credentials.
+	Client *storage.Client
+
+	// Logger receives the proxy's logs; the default is log.Default().
+	Logger Logger
+
+	// AccessLogger receives the access log lines, in the format of the
+	// "log-format" option. The default is Logger if set, and otherwise as
+	// for the command.
+	AccessLogger Logger
+
+	// Metrics, if set, is called once for each of the proxy's metrics,
+	// e.g. to export them to something other than expvar.
+	Metrics func(name string, v expvar.Var)
+
+	// Hooks run custom code at points of each object request.
+	Hooks Hooks
+
+	// ReloadOnSIGHUP reloads the config file, credentials, htpasswd file and
+	// API keys when the process receives SIGHUP, as the command does. It
+	// takes over the process's handling of SIGHUP, so it is off by default.
+	ReloadOnSIGHUP bool
+}
+
+// Proxy is a proxy created with New. It serves requests until closed.
+type Proxy struct {
+	s *server
+	h http.Handler
+	// ownClient is set when the proxy created its storage client.
+	ownClient bool
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.h.ServeHTTP(w, r)
+}
+
+// Close stops the proxy's background work, such as config and credential
+// reloading, the object index, jobs and the canary, and its SIGHUP handling,
+// and closes the connections it opened. Config.Client is left open.
+func (p *Proxy) Close() error {
+	p.s.cancel()
+	var err error
+	if p.s.extAuthzConn != nil {
+		err = p.s.extAuthzConn.Close()
+	}
+	if p.ownClient {
+		if cerr := p.s.storageClient().Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// New returns a proxy serving GCS objects as the gcsproxy command does,
+// including the admin endpoints. Each call creates a separate proxy with its
+// own settings, caches and metrics.
+//
+// Environment variables aren't read and no listener is opened; the caller
+// serves the proxy however it likes. The grpc option is refused, as the
+// storage library only enables gRPC for the whole process. Background work
+// such as config and credential reloading runs until the proxy is closed.
+func New(c Config) (*Proxy, error) {
+	s := newServer()
+	s.reloadOnHUP = c.ReloadOnSIGHUP
+	if c.Logger != nil {
+		s.logger = c.Logger
+		s.accessLogger = c.Logger
+	}
+	if c.AccessLogger != nil {
+		s.accessLogger = c.AccessLogger
+	}
+	s.hooks = c.Hooks
+	for name, value := range c.Options {
+		if err := s.flags.Set(name, value); err != nil {
+			return nil, fmt.Errorf("gcsproxy: %s: %v", name, err)
+		}
+	}
+	if c.ConfigFile != "" {
+		s.configFile = c.ConfigFile
+	}
+	cfg, err := s.loadConfig(s.flags)
+	if err != nil {
+		return nil, fmt.Errorf("gcsproxy: failed to load config: %v", err)
+	}
+	if s.useGRPC {
+		return nil, errors.New("gcsproxy: the grpc option switches every storage client of the process to gRPC and is only available to the command")
+	}
+	if c.Client != nil {
+		s.setStorageClient(c.Client)
+	}
+	r, err := s.setup(cfg)
+	if err != nil {
+		// Stop what setup started before failing.
+		s.cancel()
+		return nil, fmt.Errorf("gcsproxy: %v", err)
+	}
+	if c.Metrics != nil {
+		for _, m := range s.metrics {
+			c.Metrics(m.name, m.v)
+		}
+	}
+	return &Proxy{s: s, h: r, ownClient: c.Client == nil}, nil
+}
+
+// metric is a variable served under /-/metrics.
+type metric struct {
+	name string
+	v    expvar.Var
+}
+
+// newStatsMap returns a new map served under /-/metrics and passed to
+// Config.Metrics. It isn't published to expvar, which is shared by all
+// proxies in the process.
+func (s *server) newStatsMap(name string) *expvar.Map {
+	m := new(expvar.Map).Init()
+	s.publishMetric(name, m)
+	return m
+}
+
+// publishMetric is newStatsMap for other expvar variables.
+func (s *server) publishMetric(name string, v expvar.Var) {
+	s.metrics = append(s.metrics, metric{name, v})
+}
+
+// serveMetrics writes the process's expvar variables followed by the
+// proxy's metrics, in the format of expvar.Handler.
+func (s *server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{\n")
+	first := true
+	write := func(name string, v expvar.Var) {
+		if !first {
+			fmt.Fprint(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", name, v)
+	}
+	expvar.Do(func(kv expvar.KeyValue) { write(kv.Key, kv.Value) })
+	for _, m := range s.metrics {
+		write(m.name, m.v)
+	}
+	fmt.Fprint(w, "\n}\n")
+}
+
+// setup validates the flags, starts the background work they ask for and
+// returns the router serving the proxy.
+func (s *server) setup(cfg *fileConfig) (*mux.Router, error) {
+	var err error
+	if s.configFile != "" {
+		go s.watchConfig(s.flags, s.configWatch, s.hangups())
+	}
+	if s.federatedSigner, err = s.inspectCredentials(); err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %v", err)
+	}
+	if s.currentClient.Load() == nil {
+		c, err := s.newClient()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create client: %v", err)
+		}
+		s.setStorageClient(c)
+		go s.watchCredentials(s.credentialsWatch, s.hangups())
+	}
+
+	if s.trustedProxies, err = parseTrustedProxies(s.trustedProxiesList); err != nil {
+		return nil, err
+	}
+	if s.singleBucket != "" && s.virtualHosts {
+		return nil, errors.New("-bucket and -vhost can't be used together")
+	}
+	if err := s.parseAccessFlags(); err != nil {
+		return nil, err
+	}
+	if s.responseRate, err = parseRate(s.responseBW); err != nil {
+		return nil, err
+	}
+	if rate, err := parseRate(s.bandwidth); err != nil {
+		return nil, err
+	} else if rate > 0 {
+		s.globalBandwidth = newTokenBucket(rate)
+	}
+	if err := s.parseColdStorageMode(s.coldStorage); err != nil {
+		return nil, err
+	}
+	s.defaultPrecompressed = splitList(s.precompressed)
+	if err := parsePrecompressed(s.defaultPrecompressed); err != nil {
+		return nil, err
+	}
+	if s.retryCodes, err = parseRetryCodes(s.gcsRetryCodes); err != nil {
+		return nil, err
+	}
+	if err := s.parseReadFlags(); err != nil {
+		return nil, err
+	}
+	if s.maxConcurrent > 0 {
+		s.readSlots = make(chan struct{}, s.maxConcurrent)
+	}
+	s.headerNames = parseHeaderNames(s.headerNamesList)
+	s.extAuthzForward, s.extAuthzInjected = s.extAuthzHeaderNames(), splitList(s.extAuthzInject)
+	if err := s.dialExtAuthz(); err != nil {
+		return nil, fmt.Errorf("failed to connect to the authorization service: %v", err)
+	}
+	s.allowedDomainList, s.allowedGroupList = splitList(s.allowedDomains), splitList(s.allowedGroups)
+	if err := s.setupAccessLog(s.logFormat); err != nil {
+		return nil, err
+	}
+	if s.receiptKeyFile != "" {
+		if s.receiptKey, err = loadReceiptKey(s.receiptKeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load receipt key: %v", err)
+		}
+	}
+	if s.secureLinkKeyFile != "" {
+		if s.secureLinkKey, err = loadSecureLinkKey(s.secureLinkKeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load secure link key: %v", err)
+		}
+	}
+	if s.jwtJWKS != "" {
+		s.bearerVerifier = s.newJWTVerifier(s.jwtJWKS, s.jwtAudience, s.jwtJWKSRefresh, splitList(s.jwtIssuer)...)
+	}
+	if s.firebaseProject != "" {
+		if s.jwtJWKS != "" {
+			return nil, errors.New("-firebase-project and -jwt-jwks are mutually exclusive")
+		}
+		s.bearerVerifier = s.newFirebaseVerifier(s.firebaseProject)
+	}
+	if s.googleAudience != "" && s.iapAudience != "" {
+		return nil, errors.New("-google-audience and -iap-audience are mutually exclusive")
+	}
+	if s.googleAudience != "" && s.bearerVerifier != nil {
+		return nil, errors.New("-google-audience can't be combined with -jwt-jwks or -firebase-project, which also use the Authorization header")
+	}
+	if s.googleAudience != "" {
+		s.googleVerifier = s.newJWTVerifier(googleJWKS, s.googleAudience, s.jwtJWKSRefresh, googleIssuers...)
+	}
+	if s.iapAudience != "" {
+		s.iapVerifier = s.newJWTVerifier(iapJWKS, s.iapAudience, s.jwtJWKSRefresh, iapIssuer)
+	}
+	if s.htpasswd != "" {
+		if s.bearerVerifier != nil || s.googleAudience != "" {
+			return nil, errors.New("-htpasswd can't be combined with -jwt-jwks, -firebase-project or -google-audience, which also use the Authorization header")
+		}
+		users, err := loadHtpasswd(s.htpasswd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load htpasswd file: %v", err)
+		}
+		s.htpasswdUsers.Store(users)
+		go s.watchHtpasswd(s.htpasswd, s.hangups())
+	}
+	if s.apiKeysFile != "" {
+		keys, err := loadAPIKeys(ctx, s.apiKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load API keys: %v", err)
+		}
+		s.apiKeys.Store(keys)
+		go s.watchAPIKeys(s.apiKeysFile, s.apiKeysRefresh, s.hangups())
+	}
+	if (s.allowedDomains != "" || s.allowedGroups != "") && s.googleVerifier == nil && s.iapVerifier == nil {
+		return nil, errors.New("-allowed-domains and -allowed-groups require -google-audience or -iap-audience")
+	}
+	if s.csekKeys != "" {
+		if s.bucketKeys, err = loadBucketKeys(ctx, s.csekKeys); err != nil {
+			return nil, fmt.Errorf("failed to load CSEK keys: %v", err)
+		}
+	}
+	if s.encryptionKeys != "" {
+		if s.recipientKeys, err = loadRecipientKeys(s.encryptionKeys); err != nil {
+			return nil, fmt.Errorf("failed to load encryption keys: %v", err)
+		}
+	}
+
+	if roots := parseIndexRoots(s.indexRoots); len(roots) > 0 {
+		go s.refreshIndexEvery(s.ctx, roots, s.indexInterval)
+	}
+	if err := s.startJobs(s.ctx, cfg.Jobs); err != nil {
+		return nil, fmt.Errorf("failed to schedule jobs: %v", err)
+	}
+	if s.canary != "" && s.canaryInterval > 0 {
+		if err := s.monitorCanary(s.ctx, s.canary, s.canaryInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	// Object names are used verbatim, see encoding.go.
+	r := mux.NewRouter().SkipClean(true)
+	s.registerAdminRoutes(r)
+	r.HandleFunc(s.objectPath(), s.objectHandler(s.proxy)).Methods("GET", "HEAD")
+	r.HandleFunc(s.objectPath(), s.objectHandler(s.upload)).Methods("POST")
+	r.HandleFunc(s.objectPath(), s.objectHandler(s.deleteObject)).Methods("DELETE")
+	return r, nil
+}
+
+// objectHandler wraps a handler of object requests in the checks every
+// object request goes through.
+func (s *server) objectHandler(h func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return s.wrapper(s.withErrorPages(s.checkEncoding(s.checkFreeze(s.runPreAuthHooks(s.checkSecureLink(s.authenticate(s.verifyIdentity(s.basicAuth(s.requireAPIKey(s.limitRate(s.authorize(s.limitConcurrency(h)))))))))))))
+}
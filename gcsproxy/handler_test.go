@@ -0,0 +1,406 @@
+package gcsproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a proxy reading from the fake, with the given options
+// and, unless empty, config file contents.
+func newTestProxy(t *testing.T, f *fakeGCS, options map[string]string, config string) http.Handler {
+	t.Helper()
+	c := Config{Options: options, Client: f.client(t), Logger: log.New(io.Discard, "", 0)}
+	if config != "" {
+		c.ConfigFile = writeTestFile(t, "config.json", config)
+	}
+	h, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// writeTestFile writes a file to a temporary directory and returns its path.
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// do serves a request and returns the response.
+func do(h http.Handler, method, target string, header ...string) *httptest.ResponseRecorder {
+	return doBody(h, method, target, nil, header...)
+}
+
+func doBody(h http.Handler, method, target string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d (body %q)", w.Code, want, w.Body.String())
+	}
+}
+
+func TestMain(m *testing.M) {
+	// Requests of the proxies' storage clients must reach the fakes.
+	os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+	os.Exit(m.Run())
+}
+
+func TestServeObject(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put("assets", "css/site.css", "text/css", "body{}", "Owner", "web", "Secret", "x")
+	f.put("assets", "private.txt", "text/plain", "hidden", "Blocked", "true")
+	h := newTestProxy(t, f, map[string]string{"block-if": "Blocked:true", "pass-through": "Owner"}, "")
+
+	w := do(h, "GET", "/assets/css/site.css")
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Body.String(); got != "body{}" {
+		t.Errorf("body = %q", got)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/css" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := w.Header().Get("X-Goog-Meta-Owner"); got != "web" {
+		t.Errorf("X-Goog-Meta-Owner = %q", got)
+	}
+	if got := w.Header().Get("X-Goog-Meta-Secret"); got != "" {
+		t.Errorf("metadata not passed through was sent: %q", got)
+	}
+
+	expectStatus(t, do(h, "GET", "/assets/private.txt"), http.StatusNotFound)
+	expectStatus(t, do(h, "GET", "/assets/missing.txt"), http.StatusNotFound)
+
+	lastModified := w.Header().Get("Last-Modified")
+	expectStatus(t, do(h, "GET", "/assets/css/site.css", "If-Modified-Since", lastModified), http.StatusNotModified)
+
+	w = do(h, "GET", "/assets/css/site.css", "If-Modified-Since", "Thu, 01 Jan 2004 00:00:00 GMT")
+	expectStatus(t, w, http.StatusOK)
+
+	// Partial content isn't served; Range requests get the whole object.
+	w = do(h, "GET", "/assets/css/site.css", "Range", "bytes=1-3")
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Body.String(); got != "body{}" {
+		t.Errorf("range body = %q", got)
+	}
+}
+
+func TestSeveralProxies(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put("a", "x.txt", "text/plain", "a")
+	f.put("b", "x.txt", "text/plain", "b")
+	ha := newTestProxy(t, f, map[string]string{"bucket": "a"}, "")
+	hb := newTestProxy(t, f, map[string]string{"bucket": "b"}, "")
+	if got := do(ha, "GET", "/x.txt").Body.String(); got != "a" {
+		t.Errorf("first proxy served %q", got)
+	}
+	if got := do(hb, "GET", "/x.txt").Body.String(); got != "b" {
+		t.Errorf("second proxy served %q", got)
+	}
+}
+
+func TestRoutesAndRewrites(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put("assets", "public/a.txt", "text/plain", "a")
+	f.put("assets", "public/v2/app.js", "text/javascript", "v2")
+	f.put("assets", "private/b.txt", "text/plain", "b")
+	f.put("assets", "scripts/app.js", "text/javascript", "js")
+	f.put("assets", "scripts/app.css", "text/css", "css")
+	h := newTestProxy(t, f, nil, `{
+		"strict": true,
+		"routes": [
+			{"bucket": "assets", "prefix": "public/"},
+			{"bucket": "assets", "prefix": "scripts/", "pattern": "\\.js$"}
+		],
+		"rewrites": [
+			{"match": "^blog/\\d+/(.*)$", "to": "/assets/public/posts/$1", "redirect": 301},
+			{"bucket": "assets", "strip": "static/", "prepend": "public/v2/"}
+		]
+	}`)
+
+	tests := []struct {
+		path string
+		want int
+		body string
+	}{
+		{"/assets/public/a.txt", http.StatusOK, "a"},
+		{"/assets/private/b.txt", http.StatusNotFound, ""},
+		{"/assets/scripts/app.js", http.StatusOK, "js"},
+		{"/assets/scripts/app.css", http.StatusNotFound, ""},
+		{"/assets/static/app.js", http.StatusOK, "v2"},
+		{"/other/public/a.txt", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := do(h, "GET", tt.path)
+		if w.Code != tt.want || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s: %d %q, want %d %q", tt.path, w.Code, w.Body.String(), tt.want, tt.body)
+		}
+	}
+
+	w := do(h, "GET", "/assets/blog/2022/hello?ref=feed")
+	expectStatus(t, w, http.StatusMovedPermanently)
+	if got := w.Header().Get("Location"); got != "/assets/public/posts/hello?ref=feed" {
+		t.Errorf("Location = %q", got)
+	}
+}
+
+// uploadFile is a file posted in a form.
+type uploadFile struct {
+	name, contentType, content string
+}
+
+// postForm posts the files as multipart/form-data.
+func postForm(h http.Handler, target string, files ...uploadFile) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, f := range files {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, f.name))
+		header.Set("Content-Type", f.contentType)
+		part, _ := mw.CreatePart(header)
+		io.WriteString(part, f.content)
+	}
+	mw.Close()
+	return doBody(h, "POST", target, &body, "Content-Type", mw.FormDataContentType())
+}
+
+func TestUpload(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put("uploads", "inbox/notes.txt", "text/plain", "old")
+	h := newTestProxy(t, f, nil, `{
+		"routes": [
+			{"bucket": "uploads", "prefix": "avatars/", "upload": {"maxSize": "16", "contentTypes": ["image/*"]}},
+			{"bucket": "uploads", "prefix": "inbox/", "upload": {"overwrite": true}},
+			{"bucket": "uploads", "prefix": "static/"}
+		],
+		"rewrites": [
+			{"bucket": "uploads", "strip": "in/", "prepend": "inbox/"}
+		]
+	}`)
+
+	w := postForm(h, "/uploads/avatars/", uploadFile{"me.png", "image/png", "png"}, uploadFile{"you.jpg", "image/jpeg", "jpeg"})
+	expectStatus(t, w, http.StatusCreated)
+	if !strings.Contains(w.Body.String(), `"name":"avatars/me.png"`) {
+		t.Errorf("response doesn't list the object: %s", w.Body.String())
+	}
+	if o := f.get("uploads", "avatars/me.png"); o == nil || string(o.data) != "png" || o.contentType != "image/png" {
+		t.Errorf("stored object = %+v", o)
+	}
+	if f.get("uploads", "avatars/you.jpg") == nil {
+		t.Error("second file wasn't stored")
+	}
+
+	expectStatus(t, postForm(h, "/uploads/avatars/", uploadFile{"me.png", "image/png", "again"}), http.StatusConflict)
+	expectStatus(t, postForm(h, "/uploads/avatars/", uploadFile{"doc.pdf", "application/pdf", "pdf"}), http.StatusUnsupportedMediaType)
+	expectStatus(t, postForm(h, "/uploads/avatars/", uploadFile{"big.png", "image/png", strings.Repeat("x", 17)}), http.StatusRequestEntityTooLarge)
+	expectStatus(t, postForm(h, "/uploads/avatars/", uploadFile{`..\escape.png`, "image/png", "x"}), http.StatusBadRequest)
+	expectStatus(t, postForm(h, "/uploads/static/", uploadFile{"a.txt", "text/plain", "a"}), http.StatusMethodNotAllowed)
+	// A rejected file means none of the form is stored.
+	expectStatus(t, postForm(h, "/uploads/avatars/", uploadFile{"ok.png", "image/png", "ok"}, uploadFile{"bad.txt", "text/plain", "bad"}), http.StatusUnsupportedMediaType)
+	if f.get("uploads", "avatars/ok.png") != nil {
+		t.Error("file of a rejected form was stored")
+	}
+
+	// Names go through the rewrites.
+	expectStatus(t, postForm(h, "/uploads/in/", uploadFile{"report.txt", "text/plain", "report"}), http.StatusCreated)
+	if f.get("uploads", "inbox/report.txt") == nil {
+		t.Error("rewritten upload wasn't stored under inbox/")
+	}
+
+	// Posted to an object, the single file replaces it.
+	expectStatus(t, postForm(h, "/uploads/inbox/notes.txt", uploadFile{"any.txt", "text/plain", "new"}), http.StatusCreated)
+	if o := f.get("uploads", "inbox/notes.txt"); o == nil || string(o.data) != "new" {
+		t.Errorf("overwritten object = %+v", o)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put("artifacts", "builds/1.zip", "application/zip", "zip")
+	f.put("artifacts", "release.zip", "application/zip", "zip")
+	h := newTestProxy(t, f, nil, `{
+		"routes": [
+			{"bucket": "artifacts", "prefix": "builds/", "delete": true},
+			{"bucket": "artifacts"}
+		],
+		"rewrites": [
+			{"bucket": "artifacts", "strip": "ci/", "prepend": "builds/"}
+		]
+	}`)
+
+	expectStatus(t, do(h, "DELETE", "/artifacts/ci/1.zip"), http.StatusNoContent)
+	if f.get("artifacts", "builds/1.zip") != nil {
+		t.Error("object wasn't deleted")
+	}
+	expectStatus(t, do(h, "DELETE", "/artifacts/builds/1.zip"), http.StatusNotFound)
+	expectStatus(t, do(h, "DELETE", "/artifacts/release.zip"), http.StatusMethodNotAllowed)
+	if f.get("artifacts", "release.zip") == nil {
+		t.Error("object of a route without delete was deleted")
+	}
+}
+
+func TestBackendFallback(t *testing.T) {
+	f := newFakeGCS(t)
+	root := t.TempDir()
+	for name, content := range map[string]string{"app.html": "app", "private/app.html": "private"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o755)
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := func(fallback string) string {
+		return fmt.Sprintf(`{
+			"backends": [{"name": "disk", "type": "file", "root": %q}],
+			"routes": [{"bucket": "site", "prefix": "", "backend": "disk", "fallback": %q}]
+		}`, root, fallback)
+	}
+
+	h := newTestProxy(t, f, map[string]string{"deny-prefixes": "site/private/"}, config("app.html"))
+	w := do(h, "GET", "/site/some/page")
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "app" {
+		t.Errorf("body = %q, want the fallback", w.Body.String())
+	}
+
+	// A fallback the request may not read isn't served in its place.
+	h = newTestProxy(t, f, map[string]string{"deny-prefixes": "site/private/"}, config("private/app.html"))
+	expectStatus(t, do(h, "GET", "/site/some/page"), http.StatusNotFound)
+}
+
+func TestAsofAndGeneration(t *testing.T) {
+	f := newFakeGCS(t)
+	h := newTestProxy(t, f, nil, "")
+	// The conflict is refused before asof has the versions listed, which
+	// would find nothing here.
+	w := do(h, "GET", "/b/gone.txt?asof=2022-09-01T00:00:00Z&generation=1001")
+	expectStatus(t, w, http.StatusBadRequest)
+	expectStatus(t, do(h, "GET", "/b/gone.txt?generation=0"), http.StatusBadRequest)
+}
+
+// recordingLogger keeps the lines logged to it.
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.lines, "\n")
+}
+
+func TestLoggers(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put("b", "o.txt", "text/plain", "hello")
+	options := map[string]string{"v": "true", "log-format": "$status $request_uri"}
+
+	logger := &recordingLogger{}
+	h, err := New(Config{Options: options, Client: f.client(t), Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	do(h, "GET", "/b/o.txt")
+	if got := logger.String(); got != "200 /b/o.txt" {
+		t.Errorf("Logger got %q, want the access log line", got)
+	}
+
+	logger, access := &recordingLogger{}, &recordingLogger{}
+	h, err = New(Config{Options: options, Client: f.client(t), Logger: logger, AccessLogger: access})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	do(h, "GET", "/b/missing.txt")
+	if got := access.String(); got != "404 /b/missing.txt" {
+		t.Errorf("AccessLogger got %q", got)
+	}
+	if strings.Contains(logger.String(), "404 /b/missing.txt") {
+		t.Errorf("Logger got the access log line: %q", logger.String())
+	}
+}
+
+func TestRefuseGRPC(t *testing.T) {
+	if _, err := New(Config{Options: map[string]string{"grpc": "true"}}); err == nil {
+		t.Fatal("New accepted the grpc option")
+	}
+	if v, ok := os.LookupEnv("STORAGE_USE_GRPC"); ok {
+		t.Errorf("STORAGE_USE_GRPC was set to %q", v)
+	}
+}
+
+// waitFor polls cond for up to a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	f := newFakeGCS(t)
+	f.put("b", "canary.txt", "text/plain", "ok")
+	logger := &recordingLogger{}
+	p, err := New(Config{
+		Options: map[string]string{
+			"config-watch":    "10ms",
+			"canary":          "b/canary.txt",
+			"canary-interval": "10ms",
+			"index":           "b",
+		},
+		ConfigFile:     writeTestFile(t, "config.json", `{"jobs": [{"name": "sweep", "kind": "sweep-caches", "schedule": "@every 1h"}]}`),
+		Client:         f.client(t),
+		Logger:         logger,
+		ReloadOnSIGHUP: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitFor(t, "the config to be reloaded on SIGHUP", func() bool {
+		return strings.Contains(logger.String(), "[config] reloaded")
+	})
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the background work to stop", func() bool {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		return !strings.Contains(stacks, "gcsproxy.(*server).") && !strings.Contains(stacks, "gcsproxy.(*job).")
+	})
+}
@@ -0,0 +1,48 @@
+package gcsproxy
+
+import (
+	"net/http"
+	"net/textproto"
+)
+
+func parseHeaderNames(s string) map[string]string {
+	names := make(map[string]string)
+	for _, name := range splitList(s) {
+		names[textproto.CanonicalMIMEHeaderKey(name)] = name
+	}
+	return names
+}
+
+// casingResponseWriter renames response headers to their configured
+// spelling just before the header is written. net/http writes header keys
+// as they appear in the map, in sorted order, so renamed keys keep a stable
+// position as well.
+type casingResponseWriter struct {
+	http.ResponseWriter
+	names map[string]string
+}
+
+func (w *casingResponseWriter) recase() {
+	h := w.Header()
+	for canonical, name := range w.names {
+		if v, ok := h[canonical]; ok && canonical != name {
+			delete(h, canonical)
+			h[name] = append(h[name], v...)
+		}
+	}
+}
+
+func (w *casingResponseWriter) WriteHeader(status int) {
+	w.recase()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *casingResponseWriter) Write(b []byte) (int, error) {
+	w.recase()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *casingResponseWriter) Flush() {
+	w.recase()
+	flush(w.ResponseWriter)
+}
@@ -0,0 +1,95 @@
+package gcsproxy
+
+import (
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+)
+
+// RequestHook runs before a request is authenticated. It returns true if it
+// has answered the request itself, which ends it.
+type RequestHook func(w http.ResponseWriter, r *http.Request) bool
+
+// FetchHook runs once the bucket and object of a request are known and it
+// passed the access checks, before the object is looked up. It returns true
+// if it has answered the request itself, which ends it.
+type FetchHook func(w http.ResponseWriter, r *http.Request, bucket, object string) bool
+
+// HeadersHook runs once the response headers for the object have been set,
+// before the body is sent, and may change them. It returns true if it has
+// answered the request itself, which ends it.
+type HeadersHook func(w http.ResponseWriter, r *http.Request, attr *storage.ObjectAttrs) bool
+
+// BodyHook runs once the body has been sent, with the number of bytes read
+// from the object and the error that ended the copy, if any.
+type BodyHook func(r *http.Request, attr *storage.ObjectAttrs, n int64, err error)
+
+// Hooks let programs embedding the proxy run their own code at points of
+// each object request, e.g. for custom authentication, header changes or
+// metrics. The hooks of each point run in order; admin endpoints don't run
+// them, and uploads and deletes only run the PreAuth hooks.
+type Hooks struct {
+	PreAuth     []RequestHook
+	PreFetch    []FetchHook
+	PostHeaders []HeadersHook
+	PostBody    []BodyHook
+}
+
+// runPreAuthHooks runs the PreAuth hooks before h.
+func (s *server) runPreAuthHooks(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, hook := range s.hooks.PreAuth {
+			if hook(w, r) {
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// runPreFetchHooks reports whether the request may go on.
+func (s *server) runPreFetchHooks(w http.ResponseWriter, r *http.Request, bucket, object string) bool {
+	for _, hook := range s.hooks.PreFetch {
+		if hook(w, r, bucket, object) {
+			return false
+		}
+	}
+	return true
+}
+
+// runPostHeadersHooks reports whether the request may go on.
+func (s *server) runPostHeadersHooks(w http.ResponseWriter, r *http.Request, attr *storage.ObjectAttrs) bool {
+	for _, hook := range s.hooks.PostHeaders {
+		if hook(w, r, attr) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendBody writes the object's body, applying the DLP rules if any, and
+// runs the PostBody hooks.
+func (s *server) sendBody(w http.ResponseWriter, r *http.Request, rules *rules, bucket string, attr *storage.ObjectAttrs, encoding string, body io.Reader) {
+	cr := &countingReader{r: body}
+	var err error
+	if len(rules.dlp) > 0 && inspectable(attr.ContentType, encoding) {
+		s.serveInspected(w, rules.dlp, bucket+"/"+attr.Name, cr)
+	} else {
+		_, err = s.copyBody(w, cr)
+	}
+	for _, hook := range s.hooks.PostBody {
+		hook(r, attr, cr.n, err)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
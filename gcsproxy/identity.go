@@ -0,0 +1,192 @@
+package gcsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	googleJWKS = "https://www.googleapis.com/oauth2/v3/certs"
+	iapJWKS    = "https://www.gstatic.com/iap/verify/public_key-jwk"
+	iapIssuer  = "https://cloud.google.com/iap"
+	// iapHeader carries the identity token IAP signs for every request it
+	// lets through.
+	iapHeader = "X-Goog-IAP-JWT-Assertion"
+
+	cloudIdentityAPI   = "https://cloudidentity.googleapis.com/v1/"
+	cloudIdentityScope = "https://www.googleapis.com/auth/cloud-identity.groups.readonly"
+)
+
+// googleIssuers are the iss claims of Google-signed ID tokens.
+var googleIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+// verifyIdentity requires a Google identity when -google-audience or
+// -iap-audience is set: a Google-signed ID token in an Authorization: Bearer
+// header, or the assertion IAP adds to requests. Requests without a valid
+// token get a 401, users outside -allowed-domains and -allowed-groups a 403.
+// The token's claims are available to the route claims checks.
+func (s *server) verifyIdentity(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.googleVerifier == nil && s.iapVerifier == nil {
+			fn(w, r)
+			return
+		}
+		v, token := s.iapVerifier, r.Header.Get(iapHeader)
+		if v == nil {
+			auth := r.Header.Get("Authorization")
+			v, token = s.googleVerifier, strings.TrimPrefix(auth, "Bearer ")
+			if token == auth {
+				token = ""
+			}
+		}
+		if token == "" {
+			if s.aclActive() {
+				fn(w, passAnonymous(r, `Bearer realm="gcsproxy"`))
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gcsproxy"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		c, err := v.verify(r.Context(), token)
+		if err == nil && v == s.googleVerifier && !c.has("email_verified", "true") {
+			err = fmt.Errorf("email %v not verified", c["email"])
+		}
+		if err != nil {
+			s.warnf("identity", "Rejected identity token from %s: %v", s.clientIP(r), err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gcsproxy", error="invalid_token"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		email, _ := c["email"].(string)
+		allowed, err := s.identityAllowed(r.Context(), email, c)
+		if err != nil {
+			s.warnf("identity-groups", "Failed to check group membership of %s: %v", email, err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if !allowed {
+			s.noticef("identity-denied:"+email, "Denied %s to %s", r.URL.Path, email)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		fn(w, withClaims(r, c))
+	}
+}
+
+// identityAllowed reports whether the user is in one of -allowed-domains,
+// matched against the hosted domain (hd) claim or the domain of the email,
+// or a member of one of -allowed-groups. Everyone is allowed if neither is
+// set.
+func (s *server) identityAllowed(ctx context.Context, email string, c claims) (bool, error) {
+	domains, groups := s.allowedDomainList, s.allowedGroupList
+	if len(domains) == 0 && len(groups) == 0 {
+		return true, nil
+	}
+	if email == "" {
+		return false, nil
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	for _, d := range domains {
+		if strings.EqualFold(d, domain) || c.has("hd", strings.ToLower(d)) {
+			return true, nil
+		}
+	}
+	for _, group := range groups {
+		member, err := s.isGroupMember(ctx, group, email)
+		if err != nil || member {
+			return member, err
+		}
+	}
+	return false, nil
+}
+
+// isGroupMember asks Cloud Identity whether the user is a member of the
+// group, directly or through nested groups. Answers are cached for
+// -allowed-groups-ttl.
+func (s *server) isGroupMember(ctx context.Context, group, email string) (bool, error) {
+	key := group + "\n" + strings.ToLower(email)
+	if d := s.groupCache.get(key); d != nil {
+		return d.allowed, nil
+	}
+	name, err := s.groupLookup.name(ctx, group)
+	if err != nil {
+		return false, err
+	}
+	query := url.Values{"query": {fmt.Sprintf("member_key_id == '%s'", strings.ReplaceAll(email, "'", ""))}}
+	var resp struct {
+		HasMembership bool `json:"hasMembership"`
+	}
+	if err := cloudIdentityGet(ctx, name+"/memberships:checkTransitiveMembership?"+query.Encode(), &resp); err != nil {
+		return false, err
+	}
+	s.groupCache.put(key, &decision{allowed: resp.HasMembership, expires: time.Now().Add(s.allowedGroupsTTL)})
+	return resp.HasMembership, nil
+}
+
+// groupNames maps group emails to their Cloud Identity resource names,
+// which don't change.
+type groupNames struct {
+	mu    sync.Mutex
+	names map[string]string
+}
+
+func (g *groupNames) name(ctx context.Context, group string) (string, error) {
+	g.mu.Lock()
+	name, ok := g.names[group]
+	g.mu.Unlock()
+	if ok {
+		return name, nil
+	}
+	var resp struct {
+		Name string `json:"name"`
+	}
+	if err := cloudIdentityGet(ctx, "groups:lookup?"+url.Values{"groupKey.id": {group}}.Encode(), &resp); err != nil {
+		return "", fmt.Errorf("group %s: %v", group, err)
+	}
+	g.mu.Lock()
+	g.names[group] = resp.Name
+	g.mu.Unlock()
+	return resp.Name, nil
+}
+
+var (
+	cloudIdentityOnce   sync.Once
+	cloudIdentityClient *http.Client
+	cloudIdentityErr    error
+)
+
+// cloudIdentityGet calls the Cloud Identity API with the default
+// credentials, which need read access to the groups.
+func cloudIdentityGet(ctx context.Context, path string, v interface{}) error {
+	cloudIdentityOnce.Do(func() {
+		cloudIdentityClient, cloudIdentityErr = google.DefaultClient(context.Background(), cloudIdentityScope)
+	})
+	if cloudIdentityErr != nil {
+		return cloudIdentityErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", cloudIdentityAPI+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cloudIdentityClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cloud identity: %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,189 @@
+package gcsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// defaultSearchLimit caps search results unless ?limit= asks otherwise.
+const defaultSearchLimit = 100
+
+type indexedObject struct {
+	Bucket      string            `json:"bucket"`
+	Name        string            `json:"name"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	Updated     time.Time         `json:"updated"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+
+	lowerName string
+}
+
+// searchIndex is an in-memory snapshot of the objects under the prefixes
+// listed in -index, rebuilt in the background.
+type searchIndex struct {
+	mu        sync.RWMutex
+	objects   []indexedObject
+	indexedAt time.Time
+}
+
+type indexRoot struct {
+	bucket, prefix string
+}
+
+// parseIndexRoots parses the <bucket>[/<prefix>] entries of -index.
+func parseIndexRoots(s string) []indexRoot {
+	var roots []indexRoot
+	for _, item := range splitList(s) {
+		parts := strings.SplitN(item, "/", 2)
+		root := indexRoot{bucket: parts[0]}
+		if len(parts) == 2 {
+			root.prefix = parts[1]
+		}
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+// refresh rebuilds the index from scratch. Searches keep using the previous
+// snapshot until the new one is complete.
+func (idx *searchIndex) refresh(ctx context.Context, client *storage.Client, roots []indexRoot) error {
+	var objects []indexedObject
+	for _, root := range roots {
+		it := client.Bucket(root.bucket).Objects(ctx, &storage.Query{Prefix: root.prefix})
+		for {
+			attr, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			objects = append(objects, indexedObject{
+				Bucket:      attr.Bucket,
+				Name:        attr.Name,
+				Size:        attr.Size,
+				ContentType: attr.ContentType,
+				Updated:     attr.Updated,
+				Metadata:    attr.Metadata,
+				lowerName:   strings.ToLower(attr.Name),
+			})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Bucket != objects[j].Bucket {
+			return objects[i].Bucket < objects[j].Bucket
+		}
+		return objects[i].Name < objects[j].Name
+	})
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.objects = objects
+	idx.indexedAt = time.Now()
+	return nil
+}
+
+// refreshIndexEvery keeps the index up to date until ctx is done.
+func (s *server) refreshIndexEvery(ctx context.Context, roots []indexRoot, interval time.Duration) {
+	for {
+		start := time.Now()
+		if err := s.objectIndex.refresh(ctx, s.storageClient(), roots); err != nil {
+			s.logger.Printf("[index] refresh failed: %v", err)
+		} else if s.verbose {
+			s.logger.Printf("[index] refreshed in %.3fs", time.Since(start).Seconds())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+type searchQuery struct {
+	bucket, prefix, name string
+	metadata             map[string]string
+	limit                int
+}
+
+func (idx *searchIndex) search(q searchQuery) ([]indexedObject, time.Time) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var results []indexedObject
+	for _, obj := range idx.objects {
+		if len(results) == q.limit {
+			break
+		}
+		if q.bucket != "" && obj.Bucket != q.bucket {
+			continue
+		}
+		if !strings.HasPrefix(obj.Name, q.prefix) || !strings.Contains(obj.lowerName, q.name) {
+			continue
+		}
+		matches := true
+		for k, v := range q.metadata {
+			if obj.Metadata[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			results = append(results, obj)
+		}
+	}
+	return results, idx.indexedAt
+}
+
+// searchObjects answers queries against the index:
+//
+//	GET /-/search?q=<name substring>&bucket=<bucket>&prefix=<prefix>&meta.<key>=<value>&limit=<n>
+//
+// All conditions are optional and must match together. The name match is
+// case-insensitive, metadata values must match exactly.
+func (s *server) searchObjects(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := searchQuery{
+		bucket:   params.Get("bucket"),
+		prefix:   params.Get("prefix"),
+		name:     strings.ToLower(params.Get("q")),
+		metadata: make(map[string]string),
+		limit:    defaultSearchLimit,
+	}
+	for k, v := range params {
+		if strings.HasPrefix(k, "meta.") && len(v) > 0 {
+			q.metadata[strings.TrimPrefix(k, "meta.")] = v[0]
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		q.limit = n
+	}
+
+	results, indexedAt := s.objectIndex.search(q)
+	if indexedAt.IsZero() {
+		http.Error(w, "index not ready", http.StatusServiceUnavailable)
+		return
+	}
+	if results == nil {
+		results = []indexedObject{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Results   []indexedObject `json:"results"`
+		IndexedAt time.Time       `json:"indexedAt"`
+	}{results, indexedAt})
+}
@@ -0,0 +1,460 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwtLeeway is the clock skew tolerated when checking exp and nbf.
+	jwtLeeway = time.Minute
+	// jwksMinRefresh is how often a token with an unknown key may make the
+	// verifier fetch the key set again.
+	jwksMinRefresh = time.Minute
+	// minRSAKeyBits is the smallest RSA key accepted from a key set.
+	minRSAKeyBits = 2048
+)
+
+// claims are the claims of a verified token.
+type claims map[string]interface{}
+
+type claimsKey struct{}
+
+// requestClaims returns the claims of the token the request was
+// authenticated with, or nil.
+func requestClaims(r *http.Request) claims {
+	c, _ := r.Context().Value(claimsKey{}).(claims)
+	return c
+}
+
+// withClaims returns r with the claims attached.
+func withClaims(r *http.Request, c claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, c))
+}
+
+// jwtVerifier verifies JWTs signed with the keys of a JWKS URL. Keys are
+// fetched on first use, every -jwt-jwks-refresh and when a token names an
+// unknown key.
+type jwtVerifier struct {
+	jwksURL  string
+	audience string
+	refresh  time.Duration
+	// issuers are the accepted iss claims; any is accepted if empty.
+	issuers []string
+
+	// warnf logs problems with the key set.
+	warnf func(key, format string, args ...interface{})
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	fetching *jwksFetch
+}
+
+func (s *server) newJWTVerifier(jwksURL, audience string, refresh time.Duration, issuers ...string) *jwtVerifier {
+	return &jwtVerifier{jwksURL: jwksURL, audience: audience, refresh: refresh, issuers: issuers, warnf: s.warnf}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the signature, issuer, audience and validity period of a
+// compact-serialized JWT and returns its claims.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var h jwtHeader
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %v", err)
+	}
+	key, err := v.key(ctx, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(h.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	return c, v.check(c, time.Now())
+}
+
+// check validates the registered claims.
+func (v *jwtVerifier) check(c claims, now time.Time) error {
+	exp, ok := c["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := c["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not yet valid")
+	}
+	if len(v.issuers) > 0 && !c.hasAny("iss", v.issuers) {
+		return fmt.Errorf("unexpected issuer %v", c["iss"])
+	}
+	if v.audience != "" && !c.has("aud", v.audience) {
+		return fmt.Errorf("unexpected audience %v", c["aud"])
+	}
+	return nil
+}
+
+// has reports whether the claim is value or, if it's a list, contains it.
+// Numbers and booleans compare by their JSON text.
+func (c claims) has(name, value string) bool {
+	switch v := c[name].(type) {
+	case []interface{}:
+		for _, item := range v {
+			if claimString(item) == value {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return claimString(v) == value
+	}
+}
+
+// hasAny reports whether the claim has any of the values.
+func (c claims) hasAny(name string, values []string) bool {
+	for _, value := range values {
+		if c.has(name, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func claimString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks an RS256/384/512 or ES256/384/512 signature. Other
+// algorithms, "none" in particular, are refused.
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256([]byte(signed))
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384([]byte(signed))
+		digest = sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512([]byte(signed))
+		digest = sum[:]
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %q doesn't match an RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, sig); err != nil {
+			return errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return fmt.Errorf("algorithm %q doesn't match an EC key", alg)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+	return nil
+}
+
+// key returns the key with the given ID, fetching the key set if it's
+// stale or doesn't have the key. The set is fetched without holding v.mu,
+// by one caller at a time; the others wait for its result.
+func (v *jwtVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	stale := time.Since(v.fetched) > v.refresh
+	k, ok := v.keys[kid]
+	if !stale && (ok || time.Since(v.fetched) <= jwksMinRefresh) {
+		v.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		return k, nil
+	}
+	fetch := v.fetching
+	if fetch == nil {
+		fetch = &jwksFetch{done: make(chan struct{})}
+		v.fetching = fetch
+		v.mu.Unlock()
+		keys, err := v.fetchJWKS(ctx)
+		v.mu.Lock()
+		fetch.err = err
+		if err == nil {
+			v.keys = keys
+		} else if v.keys != nil {
+			// Keep using the keys we have.
+			v.warnf("jwks:"+v.jwksURL, "Failed to fetch %s: %v", v.jwksURL, err)
+		}
+		if v.keys != nil {
+			v.fetched = time.Now()
+		}
+		v.fetching = nil
+		close(fetch.done)
+	} else {
+		v.mu.Unlock()
+		select {
+		case <-fetch.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		v.mu.Lock()
+	}
+	defer v.mu.Unlock()
+	if k, ok := v.keys[kid]; ok {
+		return k, nil
+	}
+	if v.keys == nil {
+		return nil, fetch.err
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// jwksFetch is a key set fetch in progress; done is closed when it's over.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS fetches the JSON Web Key Set and returns its RSA and EC signing
+// keys by key ID.
+func (v *jwtVerifier) fetchJWKS(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	url := v.jwksURL
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			v.warnf("jwks-key:"+k.Kid, "Skipping key %q of %s: %v", k.Kid, url, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key of %d bits, at least %d are required", key.N.BitLen(), minRSAKeyBits)
+		}
+		return key, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// authenticate requires a valid bearer token when -jwt-jwks is set, and
+// makes its claims available to the route claims checks. Requests without
+// a valid token get a 401, except that with an acl section requests without
+// any token are passed on, for checkACL to serve them public objects only.
+func (s *server) authenticate(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.bearerVerifier == nil {
+			fn(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if token == auth || token == "" {
+			if s.aclActive() {
+				fn(w, passAnonymous(r, `Bearer realm="gcsproxy"`))
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gcsproxy"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		c, err := s.bearerVerifier.verify(r.Context(), token)
+		if err != nil {
+			s.warnf("jwt", "Rejected bearer token from %s: %v", s.clientIP(r), err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gcsproxy", error="invalid_token"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		fn(w, withClaims(r, c))
+	}
+}
+
+// checkClaims answers with a 403 and returns false if the route requires
+// claims the request's token doesn't have, or the object isn't under the
+// route's owner prefix for the token.
+func checkClaims(w http.ResponseWriter, r *http.Request, rt *route, object string) bool {
+	if !claimsAllow(r, rt, object) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// claimsAllow reports whether the request's claims satisfy the route's
+// "claims" and "ownerPrefix" for the object.
+func claimsAllow(r *http.Request, rt *route, object string) bool {
+	if rt == nil || len(rt.Claims) == 0 && rt.OwnerPrefix == "" {
+		return true
+	}
+	c := requestClaims(r)
+	for name, value := range rt.Claims {
+		if !c.has(name, value) {
+			return false
+		}
+	}
+	if rt.OwnerPrefix != "" {
+		prefix, ok := expandClaims(rt.OwnerPrefix, c)
+		if !ok || !strings.HasPrefix(object, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandClaims replaces the {name} placeholders of a template with the
+// string claims of that name; {uid} is the subject (sub). It returns false
+// if a claim is missing or empty.
+func expandClaims(template string, c claims) (string, bool) {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		end := strings.IndexByte(template, '}')
+		if start < 0 || end < start {
+			b.WriteString(template)
+			return b.String(), true
+		}
+		name := template[start+1 : end]
+		if name == "uid" {
+			name = "sub"
+		}
+		value, _ := c[name].(string)
+		if value == "" {
+			return "", false
+		}
+		b.WriteString(template[:start])
+		b.WriteString(value)
+		template = template[end+1:]
+	}
+}
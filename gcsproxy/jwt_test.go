@@ -0,0 +1,238 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// testSigningKey returns the RSA key the test tokens are signed with.
+func testSigningKey(t *testing.T) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+	})
+	return testKey
+}
+
+// signTestToken returns an RS256 token with the claims, signed with the
+// test key under the key ID "test".
+func signTestToken(t *testing.T, c claims) string {
+	t.Helper()
+	return signTestTokenWith(t, `{"alg":"RS256","kid":"test"}`, c)
+}
+
+func signTestTokenWith(t *testing.T, header string, c claims) string {
+	t.Helper()
+	payload, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, testSigningKey(t), crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newTestJWKS serves a key set holding the public test key.
+func newTestJWKS(t *testing.T) *httptest.Server {
+	key := testSigningKey(t).PublicKey
+	set := map[string]interface{}{"keys": []jwk{{
+		Kty: "RSA",
+		Kid: "test",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestVerifier(t *testing.T, audience string, issuers ...string) *jwtVerifier {
+	s := newServer()
+	return s.newJWTVerifier(newTestJWKS(t).URL, audience, time.Hour, issuers...)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	v := newTestVerifier(t, "gcsproxy", "https://issuer.example.com/")
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	valid := claims{"sub": "alice", "aud": "gcsproxy", "iss": "https://issuer.example.com/", "exp": exp}
+
+	good := signTestToken(t, valid)
+	c, err := v.verify(context.Background(), good)
+	if err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	if c["sub"] != "alice" {
+		t.Errorf("sub = %v", c["sub"])
+	}
+
+	with := func(name string, value interface{}) claims {
+		c := claims{}
+		for k, v := range valid {
+			c[k] = v
+		}
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+		return c
+	}
+	invalid := map[string]string{
+		"expired":         signTestToken(t, with("exp", float64(time.Now().Add(-time.Hour).Unix()))),
+		"no expiry":       signTestToken(t, with("exp", nil)),
+		"not yet valid":   signTestToken(t, with("nbf", float64(time.Now().Add(time.Hour).Unix()))),
+		"wrong audience":  signTestToken(t, with("aud", "other")),
+		"wrong issuer":    signTestToken(t, with("iss", "https://evil.example.com/")),
+		"unknown key":     signTestTokenWith(t, `{"alg":"RS256","kid":"other"}`, valid),
+		"alg none":        signTestTokenWith(t, `{"alg":"none","kid":"test"}`, valid),
+		"EC alg":          signTestTokenWith(t, `{"alg":"ES256","kid":"test"}`, valid),
+		"malformed":       "a.b",
+		"bad signature":   good[:len(good)-4] + "AAAA",
+		"tampered claims": tamper(good),
+	}
+	for name, token := range invalid {
+		if _, err := v.verify(context.Background(), token); err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+}
+
+// tamper replaces the claims of a token, keeping its signature.
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","exp":9999999999}`))
+	return strings.Join(parts, ".")
+}
+
+func TestAudienceList(t *testing.T) {
+	v := newTestVerifier(t, "gcsproxy")
+	token := signTestToken(t, claims{"aud": []string{"other", "gcsproxy"}, "exp": float64(time.Now().Add(time.Hour).Unix())})
+	if _, err := v.verify(context.Background(), token); err != nil {
+		t.Errorf("audience in a list: %v", err)
+	}
+}
+
+func TestRejectShortRSAKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := jwk{
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+	if _, err := k.publicKey(); err == nil {
+		t.Error("1024-bit key was accepted")
+	}
+}
+
+func TestClaimsHas(t *testing.T) {
+	c := claims{"groups": []interface{}{"finance", "ops"}, "admin": true, "level": float64(3), "sub": "alice"}
+	tests := []struct {
+		name, value string
+		want        bool
+	}{
+		{"groups", "ops", true},
+		{"groups", "dev", false},
+		{"admin", "true", true},
+		{"level", "3", true},
+		{"sub", "alice", true},
+		{"sub", "bob", false},
+		{"missing", "", false},
+	}
+	for _, tt := range tests {
+		if got := c.has(tt.name, tt.value); got != tt.want {
+			t.Errorf("has(%q, %q) = %v, want %v", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newServer()
+	setRules(t, s, &fileConfig{})
+	s.bearerVerifier = newTestVerifier(t, "gcsproxy", "https://auth.example.com/")
+	finance := &route{Claims: map[string]string{"groups": "finance"}}
+	home := &route{OwnerPrefix: "users/{uid}/"}
+	h := s.authenticate(func(w http.ResponseWriter, r *http.Request) {
+		rt := (*route)(nil)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/reports/finance/"):
+			rt = finance
+		case strings.HasPrefix(r.URL.Path, "/reports/users/"):
+			rt = home
+		}
+		if checkClaims(w, r, rt, strings.TrimPrefix(r.URL.Path, "/reports/")) {
+			fmt.Fprint(w, requestClaims(r)["sub"])
+		}
+	})
+	token := func(c claims) string {
+		c["iss"], c["aud"] = "https://auth.example.com/", "gcsproxy"
+		if _, ok := c["exp"]; !ok {
+			c["exp"] = float64(time.Now().Add(time.Hour).Unix())
+		}
+		return "Bearer " + signTestToken(t, c)
+	}
+	do := func(path, auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	w := do("/reports/summary.txt", "")
+	if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+		t.Errorf("without a token: status = %d, WWW-Authenticate = %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	w = do("/reports/summary.txt", token(claims{"sub": "alice"}))
+	if w.Code != http.StatusOK || w.Body.String() != "alice" {
+		t.Errorf("valid token: status = %d, body = %q", w.Code, w.Body.String())
+	}
+	tests := []struct {
+		name, path, auth string
+		want             int
+	}{
+		{"missing claim", "/reports/finance/q3.txt", token(claims{"sub": "alice"}), http.StatusForbidden},
+		{"claim in a list", "/reports/finance/q3.txt", token(claims{"sub": "bob", "groups": []string{"finance"}}), http.StatusOK},
+		{"own prefix", "/reports/users/alice/notes.txt", token(claims{"sub": "alice"}), http.StatusOK},
+		{"other's prefix", "/reports/users/bob/notes.txt", token(claims{"sub": "alice"}), http.StatusForbidden},
+		{"expired", "/reports/summary.txt", token(claims{"sub": "alice", "exp": float64(time.Now().Add(-time.Hour).Unix())}), http.StatusUnauthorized},
+		{"other audience", "/reports/summary.txt", "Bearer " + signTestToken(t, claims{"iss": "https://auth.example.com/", "aud": "other", "exp": float64(time.Now().Add(time.Hour).Unix())}), http.StatusUnauthorized},
+		{"not a bearer token", "/reports/summary.txt", "Basic YWxpY2U6c2VjcmV0", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if w := do(tt.path, tt.auth); w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// listen returns the socket passed by systemd socket activation if there is
+// one, and binds addr otherwise.
+func listen(addr string) (net.Listener, error) {
+	l, err := systemdListener()
+	if err != nil || l != nil {
+		return l, err
+	}
+	return net.Listen("tcp", addr)
+}
+
+// systemdListener implements the receiving side of sd_listen_fds(3). It
+// returns nil if the process wasn't socket activated.
+func systemdListener() (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds == 0 {
+		return nil, nil
+	}
+	if nfds > 1 {
+		return nil, fmt.Errorf("expected a single socket from systemd, got %d", nfds)
+	}
+	// Don't pass the sockets on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket: %v", err)
+	}
+	return l, nil
+}
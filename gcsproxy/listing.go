@@ -0,0 +1,142 @@
+package gcsproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// maxListingPage is the largest page ?list returns.
+const maxListingPage = 1000
+
+type listedObject struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+type listedVersion struct {
+	Generation int64      `json:"generation,string"`
+	Size       int64      `json:"size"`
+	Created    time.Time  `json:"created"`
+	Deleted    *time.Time `json:"deleted,omitempty"`
+}
+
+type objectListing struct {
+	Prefixes      []string       `json:"prefixes"`
+	Objects       []listedObject `json:"objects"`
+	NextPageToken string         `json:"nextPageToken,omitempty"`
+}
+
+// listingEnabled reports whether ?list requests are answered for the
+// objects covered by rt. A route's listing setting takes precedence over
+// -listing.
+func (s *server) listingEnabled(rt *route) bool {
+	if rt != nil && rt.Listing != nil {
+		return *rt.Listing
+	}
+	return s.listing
+}
+
+// serveListing answers GET <dir>?list with a page of the objects under dir,
+// in the manner of the GCS JSON API: ?prefix= narrows the listing down
+// within dir, ?delimiter=/ groups names into prefixes, ?max= sets the page
+// size and ?pageToken= continues a previous listing. Objects the proxy
+// wouldn't serve are left out.
+func (s *server) serveListing(w http.ResponseWriter, r *http.Request, rules *rules, bucket, dir string) {
+	q := r.URL.Query()
+	size := maxListingPage
+	if v := q.Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid max", http.StatusBadRequest)
+			return
+		}
+		if n < size {
+			size = n
+		}
+	}
+	query := &storage.Query{Prefix: dir + q.Get("prefix"), Delimiter: q.Get("delimiter")}
+	it := s.bucketHandle(bucket, query.Prefix).Objects(r.Context(), query)
+	var page []*storage.ObjectAttrs
+	token, err := iterator.NewPager(it, size, q.Get("pageToken")).NextPage(&page)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	result := objectListing{Prefixes: []string{}, Objects: []listedObject{}, NextPageToken: token}
+	for _, attr := range page {
+		if attr.Prefix != "" {
+			if s.objectAllowed(bucket, attr.Prefix) {
+				result.Prefixes = append(result.Prefixes, attr.Prefix)
+			}
+			continue
+		}
+		if !s.listable(r, rules, bucket, attr) {
+			continue
+		}
+		result.Objects = append(result.Objects, listedObject{
+			Name:        attr.Name,
+			Size:        attr.Size,
+			ContentType: attr.ContentType,
+			Updated:     attr.Updated,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// listable reports whether a listing includes the object: whether the
+// request could read it, as far as can be told without fetching it.
+func (s *server) listable(r *http.Request, rules *rules, bucket string, attr *storage.ObjectAttrs) bool {
+	if !s.objectAllowed(bucket, attr.Name) || isBlocked(rules, attr) {
+		return false
+	}
+	rt, err := s.matchRoute(rules, bucket, attr.Name)
+	if err != nil || s.strict && rt == nil {
+		return false
+	}
+	if status, _, _ := s.aclVerdict(r, rules, bucket, attr.Name); status != 0 {
+		return false
+	}
+	return claimsAllow(r, rt, attr.Name) && apiKeyScoped(r, bucket, attr.Name)
+}
+
+// serveVersions answers GET <object>?versions with the generations of the
+// object, newest first, for use with ?generation=. Generations that have
+// been replaced or deleted carry the time they were.
+func (s *server) serveVersions(w http.ResponseWriter, r *http.Request, bucket, object string) {
+	versions, err := s.listVersions(r.Context(), bucket, object)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if len(versions) == 0 {
+		s.handleError(w, storage.ErrObjectNotExist)
+		return
+	}
+
+	result := struct {
+		Versions []listedVersion `json:"versions"`
+	}{}
+	for _, v := range versions {
+		lv := listedVersion{Generation: v.generation, Size: v.size, Created: v.created}
+		if !v.deleted.IsZero() {
+			deleted := v.deleted
+			lv.Deleted = &deleted
+		}
+		result.Versions = append(result.Versions, lv)
+	}
+	sort.Slice(result.Versions, func(i, j int) bool {
+		return result.Versions[i].Generation > result.Versions[j].Generation
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
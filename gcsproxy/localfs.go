@@ -0,0 +1,100 @@
+package gcsproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// localStore serves the files under a directory as objects, named by their
+// slash-separated paths relative to it. Content types are guessed from the
+// file extension.
+type localStore struct {
+	root string
+}
+
+func compileLocalFS(b *backend) error {
+	if b.Root == "" {
+		return fmt.Errorf("root is required")
+	}
+	fi, err := os.Stat(b.Root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", b.Root)
+	}
+	// The root is resolved so that files under it can be told from those
+	// that symlinks lead to.
+	root, err := filepath.EvalSymlinks(b.Root)
+	if err != nil {
+		return err
+	}
+	store := &localStore{root: root}
+	b.open = func(string) objectStore { return store }
+	return nil
+}
+
+// file returns the path of the object's file. Names that would leave the
+// root, that are directories or that lead through a symlink don't exist, so
+// a link can't expose files outside the root.
+func (s *localStore) file(object string) (string, error) {
+	if object == "" || strings.HasSuffix(object, "/") || path.Clean("/"+object) != "/"+object || strings.ContainsRune(object, 0) {
+		return "", storage.ErrObjectNotExist
+	}
+	name := filepath.Join(s.root, filepath.FromSlash(object))
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil || resolved != name {
+		return "", storage.ErrObjectNotExist
+	}
+	return name, nil
+}
+
+func (s *localStore) Attrs(ctx context.Context, object string) (*storage.ObjectAttrs, error) {
+	name, err := s.file(object)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) || err == nil && !fi.Mode().IsRegular() {
+		return nil, storage.ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &storage.ObjectAttrs{
+		Name:        object,
+		ContentType: mime.TypeByExtension(path.Ext(object)),
+		Size:        fi.Size(),
+		Updated:     fi.ModTime(),
+	}, nil
+}
+
+func (s *localStore) Open(ctx context.Context, object string) (io.ReadCloser, error) {
+	name, err := s.file(object)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, storage.ErrObjectNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The file may have been replaced since it was checked.
+	fi, err := f.Stat()
+	li, lerr := os.Lstat(name)
+	if err != nil || lerr != nil || !fi.Mode().IsRegular() || !os.SameFile(fi, li) {
+		f.Close()
+		return nil, storage.ErrObjectNotExist
+	}
+	return f, nil
+}
@@ -0,0 +1,239 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// policyCase is an entry of a test-policy fixture file.
+type policyCase struct {
+	Name string `json:"name"`
+	// URL is the request path, or a full URL in -vhost mode.
+	URL string `json:"url"`
+	// Method is the request method, GET by default.
+	Method string `json:"method,omitempty"`
+	// Claims are the claims the request is authenticated with, as by a
+	// bearer token; APIKey is the name of the -api-keys key it carries.
+	// Without either the request is anonymous.
+	Claims claims `json:"claims,omitempty"`
+	APIKey string `json:"apiKey,omitempty"`
+	// TLS is the TLS version the request arrives with, e.g. "1.2". An https
+	// URL without it arrives with TLS 1.3, anything else in plain text.
+	TLS string `json:"tls,omitempty"`
+	// Metadata is the metadata of the object, for -block-if.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Expect   policyResult      `json:"expect"`
+}
+
+// policyResult is how the proxy's rules treat a request. Only the fields set
+// in a fixture's expect are compared.
+type policyResult struct {
+	// Outcome is serve, deny (not served from the bucket or prefix), block
+	// (-block-if), redirect, invalid (rejected object name), unauthorized
+	// (credentials required), forbidden (route claims, API key scope, acl or
+	// the route's minimum TLS version) or unavailable (route matching exceeded -route-match-budget, or group
+	// memberships couldn't be checked).
+	Outcome  string `json:"outcome,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Bucket   string `json:"bucket,omitempty"`
+	Object   string `json:"object,omitempty"`
+	Location string `json:"location,omitempty"`
+}
+
+// runTestPolicy implements "gcsproxy test-policy [flags] <fixtures> ...". It
+// evaluates the bucket and prefix restrictions, rewrites, routes, access
+// checks and -block-if rule of the configuration against the requests of
+// fixture files, without contacting GCS, and exits non-zero if any doesn't
+// have the expected result, so policy changes can be tested in CI. Fixtures
+// are JSON like the config file rather than YAML, which would need a parser
+// the proxy doesn't otherwise depend on.
+func (s *server) runTestPolicy(args []string) {
+	s.flags.Parse(args)
+	if s.flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gcsproxy test-policy [flags] <fixtures.json> ...")
+		os.Exit(2)
+	}
+	fatal := func(err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	fatal(applyEnv(s.flags))
+	_, err := s.loadConfig(s.flags)
+	fatal(err)
+	fatal(s.parseAccessFlags())
+	// Not-found pages would be read from GCS.
+	s.notFoundObject = ""
+	if s.apiKeysFile != "" {
+		keys, err := loadAPIKeys(context.Background(), s.apiKeysFile)
+		fatal(err)
+		s.apiKeys.Store(keys)
+	}
+
+	failed, total := 0, 0
+	for _, path := range s.flags.Args() {
+		data, err := os.ReadFile(path)
+		fatal(err)
+		var cases []policyCase
+		if err := json.Unmarshal(data, &cases); err != nil {
+			fatal(fmt.Errorf("%s: %v", path, err))
+		}
+		for i, c := range cases {
+			name := c.Name
+			if name == "" {
+				name = fmt.Sprintf("%s[%d] %s", path, i, c.URL)
+			}
+			got, err := s.evalPolicy(s.activeRules(), c)
+			fatal(err)
+			total++
+			if diff := c.Expect.diff(got); diff != "" {
+				failed++
+				fmt.Printf("FAIL %s: %s\n", name, diff)
+			} else {
+				fmt.Printf("ok   %s\n", name)
+			}
+		}
+	}
+	fmt.Printf("%d of %d cases passed\n", total-failed, total)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// evalPolicy follows the checks of the object handlers up to fetching the
+// object, running the access checks of authorizeObject on a recorder.
+func (s *server) evalPolicy(rules *rules, c policyCase) (policyResult, error) {
+	method := c.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	r, err := http.NewRequest(method, c.URL, nil)
+	if err != nil {
+		return policyResult{}, err
+	}
+	r.RequestURI = r.URL.RequestURI()
+	if r.URL.Scheme == "https" || c.TLS != "" {
+		v, ok := tlsVersions[c.TLS]
+		if !ok {
+			if c.TLS != "" {
+				return policyResult{}, fmt.Errorf("%s: invalid tls %q", c.URL, c.TLS)
+			}
+			v = tls.VersionTLS13
+		}
+		r.TLS = &tls.ConnectionState{Version: v}
+	}
+	var match mux.RouteMatch
+	if !mux.NewRouter().SkipClean(true).NewRoute().Path(s.objectPath()).Match(r, &match) {
+		return policyResult{Outcome: "deny", Status: http.StatusNotFound}, nil
+	}
+	r = mux.SetURLVars(r, match.Vars)
+	r, err = s.withPolicyCredentials(r, c)
+	if err != nil {
+		return policyResult{}, err
+	}
+	if r == nil {
+		return policyResult{Outcome: "unauthorized", Status: http.StatusUnauthorized}, nil
+	}
+
+	bucket, object := s.target(rules, r)
+	if bucket == "" || !s.bucketAllowed(bucket) {
+		return policyResult{Outcome: "deny", Status: http.StatusNotFound, Bucket: bucket}, nil
+	}
+	object, status := rules.rewriteObject(bucket, object)
+	if status != 0 {
+		return policyResult{Outcome: "redirect", Status: status, Bucket: bucket, Location: object}, nil
+	}
+	if status, _, _ := s.objectNameProblem(object); status != 0 {
+		return policyResult{Outcome: "invalid", Status: status, Bucket: bucket, Object: object}, nil
+	}
+	if loc, ok := s.cleanURLRedirect(r); ok {
+		return policyResult{Outcome: "redirect", Status: http.StatusMovedPermanently, Bucket: bucket, Location: loc}, nil
+	}
+	res := policyResult{Bucket: bucket, Object: object}
+	rec := httptest.NewRecorder()
+	if _, ok := s.authorizeObject(rec, r, rules, bucket, object); !ok {
+		res.Status = rec.Code
+		switch rec.Code {
+		case http.StatusNotFound:
+			res.Outcome = "deny"
+		case http.StatusUnauthorized:
+			res.Outcome = "unauthorized"
+		case http.StatusServiceUnavailable:
+			res.Outcome = "unavailable"
+		default:
+			res.Outcome = "forbidden"
+		}
+		return res, nil
+	}
+	if isBlocked(rules, &storage.ObjectAttrs{Bucket: bucket, Name: object, Metadata: c.Metadata}) {
+		res.Outcome = "block"
+		return res, nil
+	}
+	res.Outcome, res.Status = "serve", http.StatusOK
+	return res, nil
+}
+
+// withPolicyCredentials attaches the claims and API key of a fixture to r
+// as the authentication options would. It returns nil if the request lacks
+// credentials that the configuration requires.
+func (s *server) withPolicyCredentials(r *http.Request, c policyCase) (*http.Request, error) {
+	if c.Claims != nil {
+		r = withClaims(r, c.Claims)
+	}
+	if c.APIKey != "" {
+		k := s.policyAPIKey(c.APIKey)
+		if k == nil {
+			return nil, fmt.Errorf("%s: no API key named %q in -api-keys", c.URL, c.APIKey)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyKey{}, k))
+		r = withClaims(r, apiKeyClaims(requestClaims(r), k))
+	}
+	tokens := s.jwtJWKS != "" || s.firebaseProject != "" || s.googleAudience != "" || s.iapAudience != "" || s.htpasswd != ""
+	if c.Claims == nil && tokens || c.APIKey == "" && s.apiKeysFile != "" {
+		if !s.aclActive() {
+			return nil, nil
+		}
+		r = passAnonymous(r, "")
+	}
+	return r, nil
+}
+
+// policyAPIKey returns the -api-keys key with the given name, or nil.
+func (s *server) policyAPIKey(name string) *apiKey {
+	keys, _ := s.apiKeys.Load().(map[[sha256.Size]byte]*apiKey)
+	for _, k := range keys {
+		if k.Name == name {
+			return k
+		}
+	}
+	return nil
+}
+
+// diff describes how got differs from the expected result, or returns "".
+func (want policyResult) diff(got policyResult) string {
+	var d []string
+	check := func(name, w, g string) {
+		if w != "" && w != g {
+			d = append(d, fmt.Sprintf("%s is %q, want %q", name, g, w))
+		}
+	}
+	check("outcome", want.Outcome, got.Outcome)
+	if want.Status != 0 && want.Status != got.Status {
+		d = append(d, fmt.Sprintf("status is %d, want %d", got.Status, want.Status))
+	}
+	check("bucket", want.Bucket, got.Bucket)
+	check("object", want.Object, got.Object)
+	check("location", want.Location, got.Location)
+	return strings.Join(d, ", ")
+}
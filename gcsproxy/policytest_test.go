@@ -0,0 +1,80 @@
+package gcsproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEvalPolicy(t *testing.T) {
+	options := map[string]string{"deny-prefixes": "site/private/"}
+	config := `{
+		"routes": [{"bucket": "site", "prefix": "secure/", "secure": "1.2"}],
+		"acl": [
+			{"path": "site/team/**", "groups": ["ops"]},
+			{"path": "site/**", "public": true}
+		],
+		"rewrites": [{"bucket": "site", "strip": "v1/"}]
+	}`
+	s := newServer()
+	s.logger = log.New(io.Discard, "", 0)
+	for name, value := range options {
+		s.flags.Set(name, value)
+	}
+	s.configFile = writeTestFile(t, "config.json", config)
+	if _, err := s.loadConfig(s.flags); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.parseAccessFlags(); err != nil {
+		t.Fatal(err)
+	}
+
+	f := newFakeGCS(t)
+	for _, name := range []string{"index.html", "private/key.txt", "secure/report.txt", "team/plan.txt"} {
+		f.put("site", name, "text/plain", name)
+	}
+	h := newTestProxy(t, f, options, config)
+
+	ops := claims{"sub": "1", "groups": []interface{}{"ops"}}
+	tests := []struct {
+		c    policyCase
+		want string
+	}{
+		{policyCase{URL: "/site/index.html"}, "serve"},
+		{policyCase{URL: "/site/v1/index.html"}, "serve"},
+		{policyCase{URL: "/site/private/key.txt"}, "deny"},
+		{policyCase{URL: "/site/team/plan.txt"}, "unauthorized"},
+		{policyCase{URL: "/site/team/plan.txt", Claims: ops}, "serve"},
+		{policyCase{URL: "/site/team/plan.txt", Claims: claims{"sub": "2"}}, "forbidden"},
+		// The route's minimum TLS version is checked too.
+		{policyCase{URL: "/site/secure/report.txt"}, "forbidden"},
+		{policyCase{URL: "https://proxy.example.com/site/secure/report.txt", TLS: "1.1"}, "forbidden"},
+		{policyCase{URL: "https://proxy.example.com/site/secure/report.txt", TLS: "1.2"}, "serve"},
+	}
+	for _, tt := range tests {
+		got, err := s.evalPolicy(s.activeRules(), tt.c)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.c.URL, err)
+		}
+		if got.Outcome != tt.want {
+			t.Errorf("%s (tls %q, claims %v): outcome = %q, want %q", tt.c.URL, tt.c.TLS, tt.c.Claims, got.Outcome, tt.want)
+		}
+
+		// The proxy treats the same anonymous request alike.
+		if tt.c.Claims != nil {
+			continue
+		}
+		r := httptest.NewRequest("GET", tt.c.URL, nil)
+		r.TLS = nil
+		if tt.c.TLS != "" {
+			r.TLS = &tls.ConnectionState{Version: tlsVersions[tt.c.TLS]}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != got.Status {
+			t.Errorf("%s (tls %q): proxy answered %d, test-policy %d", tt.c.URL, tt.c.TLS, w.Code, got.Status)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package gcsproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// precompressedSuffixes are the name suffixes of pre-compressed siblings by
+// content coding.
+var precompressedSuffixes = map[string]string{"br": ".br", "gzip": ".gz", "zstd": ".zst"}
+
+// parsePrecompressed validates a list of content codings for
+// -precompressed or the precompressed setting of a route.
+func parsePrecompressed(encodings []string) error {
+	for _, enc := range encodings {
+		if _, ok := precompressedSuffixes[enc]; !ok {
+			return fmt.Errorf("unknown precompressed encoding %q, expected br, gzip or zstd", enc)
+		}
+	}
+	return nil
+}
+
+// precompressedEncodings returns the content codings whose siblings are
+// looked up, in order of preference. A route's precompressed setting, even
+// an empty one, takes precedence over -precompressed.
+func (s *server) precompressedEncodings(rt *route) []string {
+	if rt != nil && rt.Precompressed != nil {
+		return rt.Precompressed
+	}
+	return s.defaultPrecompressed
+}
+
+// precompressedSibling looks for a pre-compressed sibling of the object,
+// such as app.js.br for app.js, in an encoding the client accepts. It
+// returns the sibling's handle, its attributes with the original's content
+// headers and metadata, and its encoding, or a nil handle to serve the
+// original.
+func (s *server) precompressedSibling(ctx context.Context, w http.ResponseWriter, r *http.Request, rules *rules, rt *route, attr *storage.ObjectAttrs) (*storage.ObjectHandle, *storage.ObjectAttrs, string) {
+	encodings := s.precompressedEncodings(rt)
+	if len(encodings) == 0 || attr.ContentEncoding != "" {
+		return nil, nil, ""
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	// Compressed content can't be inspected, and siblings have their own
+	// generations.
+	if len(rules.dlp) > 0 || historicalRead(r) {
+		return nil, nil, ""
+	}
+	for _, enc := range encodings {
+		name := attr.Name + precompressedSuffixes[enc]
+		if !acceptsEncoding(r, enc) || !s.objectAllowed(attr.Bucket, name) {
+			continue
+		}
+		// The sibling must be served as stored, even if it was uploaded
+		// with Content-Encoding: gzip.
+		obj, sattr, err := s.objectAttrs(ctx, attr.Bucket, name, true)
+		if err != nil {
+			if err != storage.ErrObjectNotExist {
+				s.warnf("precompressed:"+attr.Bucket+"/"+name, "Failed to look up %s/%s: %v", attr.Bucket, name, err)
+			}
+			continue
+		}
+		if isBlocked(rules, sattr) {
+			continue
+		}
+		a := *sattr
+		a.ContentType = attr.ContentType
+		a.ContentLanguage = attr.ContentLanguage
+		a.ContentDisposition = attr.ContentDisposition
+		a.Metadata = attr.Metadata
+		if a.CacheControl == "" {
+			a.CacheControl = attr.CacheControl
+		}
+		return obj, &a, enc
+	}
+	return nil, nil, ""
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding includes
+// the content coding, or "*", with a non-zero quality.
+func acceptsEncoding(r *http.Request, enc string) bool {
+	wildcard := false
+	for _, item := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(item, ";")
+		coding = strings.TrimSpace(coding)
+		ok := true
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			q, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			ok = err != nil || q > 0
+		}
+		switch {
+		case strings.EqualFold(coding, enc):
+			return ok
+		case coding == "*":
+			wildcard = ok
+		}
+	}
+	return wildcard
+}
@@ -0,0 +1,64 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// preloadMetadataKey is the object metadata listing resources to preload.
+const preloadMetadataKey = "preload"
+
+// announcePreloads adds the Link headers of the route's preload entries,
+// sending them as 103 Early Hints with -early-hints.
+func (s *server) announcePreloads(w http.ResponseWriter, rt *route) {
+	if rt == nil || len(rt.Preload) == 0 {
+		return
+	}
+	for _, link := range preloadLinks(rt.Preload) {
+		w.Header().Add("Link", link)
+	}
+	if s.earlyHints {
+		w.WriteHeader(http.StatusEarlyHints)
+	}
+}
+
+// preloadLinks turns preload entries into Link header values. An entry is
+// either "<path>[;<as>]", e.g. "/css/app.css;style", or a complete Link
+// value such as "</app.js>; rel=modulepreload".
+func preloadLinks(entries []string) []string {
+	var links []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, "<") {
+			links = append(links, entry)
+			continue
+		}
+		path, as, _ := strings.Cut(entry, ";")
+		link := fmt.Sprintf("<%s>; rel=preload", strings.TrimSpace(path))
+		if as = strings.TrimSpace(as); as != "" {
+			link += "; as=" + as
+			// Fonts are always fetched in CORS mode.
+			if as == "font" {
+				link += "; crossorigin"
+			}
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// objectPreloads returns the Link values listed in the object's preload
+// metadata, separated by commas.
+func objectPreloads(attr *storage.ObjectAttrs) []string {
+	value, ok := attr.Metadata[preloadMetadataKey]
+	if !ok {
+		return nil
+	}
+	return preloadLinks(strings.Split(value, ","))
+}
@@ -0,0 +1,850 @@
+package gcsproxy
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// options are the settings of a proxy, one per flag.
+type options struct {
+	flags *flag.FlagSet
+
+	configFile        string
+	showVersionFlag   bool
+	configWatch       time.Duration
+	selfTest          bool
+	canary            string
+	selfTestHost      string
+	canaryInterval    time.Duration
+	canaryMaxAge      time.Duration
+	canaryMaxLatency  time.Duration
+	bind              string
+	verbose           bool
+	logRate           int
+	logFormat         string
+	credentials       string
+	credentialsWatch  time.Duration
+	endpoint          string
+	useGRPC           bool
+	blockIfMeta       string
+	passthroughMeta   string
+	earlyHints        bool
+	singleBucket      string
+	virtualHosts      bool
+	allowBuckets      string
+	denyBuckets       string
+	allowPrefixes     string
+	denyPrefixes      string
+	hideDotfiles      bool
+	maxObjectName     int
+	maxPathDepth      int
+	strictEncoding    bool
+	strict            bool
+	fallbackBucket    string
+	fallback          string
+	indexDoc          string
+	notFoundObject    string
+	cleanURLs         bool
+	cleanURLsRedirect bool
+	trailingSlash     bool
+	autoindex         bool
+	listing           bool
+	bandwidth         string
+	responseBW        string
+	precompressed     string
+	coldStorage       string
+	restoreBucket     string
+	restoreRetryAfter time.Duration
+	signedRedirect    time.Duration
+	redirectMinSize   int64
+	routeMatchBudget  time.Duration
+
+	adminToken  string
+	diffMaxSize int64
+
+	signToken      string
+	signDefaultTTL time.Duration
+	signMaxTTL     time.Duration
+
+	signingAccountFlag string
+
+	indexRoots    string
+	indexInterval time.Duration
+
+	accessStatsDepth int
+
+	asofCacheTTL time.Duration
+
+	secureLinkKeyFile string
+	secureLinkOnce    bool
+	secureLinkStore   string
+	secureLinkCookie  string
+
+	receiptKeyFile string
+
+	encryptionKeys     string
+	encryptionRequired bool
+
+	dlpMaxSize int64
+
+	trustedProxiesList string
+	headerNamesList    string
+	proxyProtocol      bool
+	tlsCertDir         string
+	tlsVersionHeader   string
+
+	reapChildren bool
+	umask        string
+	runAsUser    string
+
+	jwtJWKS        string
+	jwtIssuer      string
+	jwtAudience    string
+	jwtJWKSRefresh time.Duration
+
+	firebaseProject string
+
+	googleAudience   string
+	iapAudience      string
+	allowedDomains   string
+	allowedGroups    string
+	allowedGroupsTTL time.Duration
+
+	htpasswd       string
+	basicAuthRealm string
+
+	apiKeysFile    string
+	apiKeyHeader   string
+	apiKeyParam    string
+	apiKeysRefresh time.Duration
+
+	rateLimit      float64
+	rateLimitBurst int
+
+	maxConcurrent int
+	maxQueue      int
+	queueTimeout  time.Duration
+
+	csekHeaders bool
+	csekKeys    string
+
+	gcsMaxAttempts     int
+	gcsRetryBackoff    time.Duration
+	gcsRetryMaxBackoff time.Duration
+	gcsRetryCodes      string
+	gcsBreakerFailures int
+	gcsBreakerCooldown time.Duration
+
+	replicaFailures   int
+	replicaMaxLatency time.Duration
+	replicaCooldown   time.Duration
+
+	gcsAttrsTimeout time.Duration
+	gcsReadTimeout  time.Duration
+
+	gcsMaxIdleConnsPerHost int
+	gcsMaxConnsPerHost     int
+	gcsIdleConnTimeout     time.Duration
+	gcsDialTimeout         time.Duration
+	gcsKeepAlive           time.Duration
+	gcsTLSHandshakeTimeout time.Duration
+	gcsTLSSessionCache     int
+
+	parallelThresholdFlag string
+	sliceSizeFlag         string
+	parallelSlices        int
+	readAheadFlag         string
+
+	copyBufferFlag string
+	flushInterval  time.Duration
+
+	singleRoundtripFlag bool
+
+	extAuthz         string
+	extAuthzTimeout  time.Duration
+	extAuthzCacheTTL time.Duration
+	extAuthzHeaders  string
+	extAuthzInject   string
+}
+
+// newOptions returns the default options and the flag set that sets them.
+func newOptions() *options {
+	o := &options{flags: flag.NewFlagSet("gcsproxy", flag.ExitOnError)}
+	fs := o.flags
+	fs.StringVar(&o.configFile, "config", "", "Optional path to a JSON config file. Flags given on the command line override its settings.")
+	fs.BoolVar(&o.showVersionFlag, "version", false, "Print version information and exit")
+	fs.DurationVar(&o.configWatch, "config-watch", 0, "How often to check the config file for changes and reload it (0 only reloads on SIGHUP)")
+	fs.BoolVar(&o.selfTest, "self-test", false, "Start the proxy, check end to end that it serves the -canary object, then exit (non-zero on failure)")
+	fs.StringVar(&o.canary, "canary", "", "Object (<bucket>/<object>) used to check that the proxy can read from GCS")
+	fs.StringVar(&o.selfTestHost, "self-test-host", "", "Server name the self-test uses for the TLS handshake (default: the host serving -canary in -vhost mode, or localhost)")
+	fs.DurationVar(&o.canaryInterval, "canary-interval", 0, "How often to read the -canary object and report the result under /-/metrics (0 disables monitoring)")
+	fs.DurationVar(&o.canaryMaxAge, "canary-max-age", 0, "Report the canary unhealthy if the object hasn't been updated for this long (0 for no limit)")
+	fs.DurationVar(&o.canaryMaxLatency, "canary-max-latency", 0, "Report the canary unhealthy if reading it takes longer than this (0 for no limit)")
+	fs.StringVar(&o.bind, "b", "127.0.0.1:8080", "Bind address")
+	fs.BoolVar(&o.verbose, "v", false, "Show access log")
+	fs.IntVar(&o.logRate, "log-rate", 10, "Log at most this many repetitions of a warning per minute (0 for no limit)")
+	fs.StringVar(&o.logFormat, "log-format", "", "Access log format with nginx-style variables such as $remote_addr, $status or $http_user_agent (default \"[$remote_addr] $request_time $status $request_method $request_uri\")")
+	fs.StringVar(&o.credentials, "c", "", "The path to the keyfile, or an sm://projects/<project>/secrets/<name> Secret Manager reference. If not present, client will use your default application credentials.")
+	fs.DurationVar(&o.credentialsWatch, "credentials-watch", 0, "How often to check the keyfile, or its secret, for changes and rotate to the new credentials (0 only rotates on SIGHUP)")
+	fs.StringVar(&o.endpoint, "endpoint", "", "Optional URL of the storage JSON API, such as a private endpoint (example: https://storage-myendpoint.p.googleapis.com/storage/v1/); plain http:// URLs, as for fake-gcs-server, are used without authentication")
+	fs.BoolVar(&o.useGRPC, "grpc", false, "Talk to GCS over its gRPC API instead of JSON over HTTP (experimental in the storage library; -endpoint is then a host:port)")
+	fs.StringVar(&o.blockIfMeta, "block-if", "", "Optional metadata which, if present on an object, results in a 404 from the proxy (example: Blocked:true)")
+	fs.StringVar(&o.passthroughMeta, "pass-through", "", "Set to a comma-separated metadata keys to pass through as headers")
+	fs.BoolVar(&o.earlyHints, "early-hints", false, "Send the preload links configured for a route in a 103 Early Hints response before fetching the object")
+	fs.StringVar(&o.singleBucket, "bucket", "", "Serve only this bucket, with object paths directly under / instead of /<bucket>/")
+	fs.BoolVar(&o.virtualHosts, "vhost", false, "Take the bucket from the Host header (or the hosts section of the config file), with object paths directly under /")
+	fs.StringVar(&o.allowBuckets, "allow-buckets", "", "Comma-separated buckets to serve, which may contain wildcards (example: assets-*). If not present, every bucket the credentials can read is served.")
+	fs.StringVar(&o.denyBuckets, "deny-buckets", "", "Comma-separated buckets never to serve, which may contain wildcards")
+	fs.StringVar(&o.allowPrefixes, "allow-prefixes", "", "Comma-separated <bucket>/<prefix> entries; objects of the buckets listed are only served from under these prefixes (example: assets/public/)")
+	fs.StringVar(&o.denyPrefixes, "deny-prefixes", "", "Comma-separated <bucket>/<prefix> entries whose objects are never served; the bucket may contain wildcards (example: */internal/)")
+	fs.BoolVar(&o.hideDotfiles, "hide-dotfiles", false, "Refuse to serve objects with a name segment starting with a dot, such as .env or .git/config (.well-known is still served)")
+	fs.IntVar(&o.maxObjectName, "max-object-name", 1024, "Longest object name, in bytes, served; longer ones get a 414 (GCS allows 1024)")
+	fs.IntVar(&o.maxPathDepth, "max-path-depth", 0, "Most segments an object path may have; deeper ones get a 400 (0 for no limit)")
+	fs.BoolVar(&o.strictEncoding, "strict-encoding", false, "Reject request paths that contain characters RFC 3986 requires to be percent-encoded")
+	fs.BoolVar(&o.strict, "strict", false, "Only serve objects covered by the routes section of the config file")
+	fs.StringVar(&o.fallbackBucket, "fallback-bucket", "", "Optional bucket to read objects from when they are missing from the requested bucket or GCS fails to serve them")
+	fs.StringVar(&o.fallback, "fallback", "", "Object served with a 200 instead of a 404 for paths that don't exist, for single-page apps (example: index.html)")
+	fs.StringVar(&o.indexDoc, "index-document", "", "Object served for paths ending in a slash, and for paths naming a folder that contains it (example: index.html)")
+	fs.StringVar(&o.notFoundObject, "not-found-page", "", "Object of the requested bucket served as the body of 404 responses (example: 404.html)")
+	fs.BoolVar(&o.cleanURLs, "clean-urls", false, "Serve <path>.html for paths that don't name an object, as static site generators expect")
+	fs.BoolVar(&o.cleanURLsRedirect, "clean-urls-redirect", false, "With -clean-urls, redirect requests for <path>.html (and <dir>/<index document>) to the clean URL")
+	fs.BoolVar(&o.trailingSlash, "trailing-slash-redirect", false, "Redirect /<dir> to /<dir>/ if it names a folder with an index document, and /<dir>/ to /<dir> if it has none but <dir> is an object, so each page has a single URL")
+	fs.BoolVar(&o.autoindex, "autoindex", false, "List the objects under paths ending in a slash as an HTML page when there is no index document")
+	fs.BoolVar(&o.listing, "listing", false, "Answer requests for paths ending in a slash with ?list with a JSON listing of the objects under them")
+	fs.StringVar(&o.bandwidth, "bandwidth", "", "Bytes per second all responses together may be sent at, which may end in K, M or G (example: 50M); the bandwidth section of the config file can set other caps by time of day")
+	fs.StringVar(&o.responseBW, "response-bandwidth", "", "Bytes per second each response may be sent at, which may end in K, M or G (example: 2M); routes can override it")
+	fs.StringVar(&o.precompressed, "precompressed", "", "Comma-separated content codings (br, gzip, zstd) of pre-compressed siblings, such as app.js.br for app.js, to serve instead when the client accepts them; routes can override it")
+	fs.StringVar(&o.coldStorage, "cold-storage", "", "How to answer requests for Nearline, Coldline and Archive objects: serve (default), reject with a 409, or restore, which answers with a 202 and copies them to -restore-bucket to be served from there")
+	fs.StringVar(&o.restoreBucket, "restore-bucket", "", "Bucket that objects in cold storage are copied to, as <bucket>/<object>, in the restore mode of -cold-storage")
+	fs.DurationVar(&o.restoreRetryAfter, "restore-retry-after", time.Minute, "Retry-After sent with the 202 answering a request for an object being restored")
+	fs.DurationVar(&o.signedRedirect, "signed-redirect", 0, "Redirect clients to a V4 signed GCS URL valid this long instead of proxying the object (0 proxies)")
+	fs.Int64Var(&o.redirectMinSize, "signed-redirect-min-size", 0, "Only redirect to signed URLs for objects of at least this many bytes, and proxy smaller ones")
+	fs.DurationVar(&o.routeMatchBudget, "route-match-budget", time.Millisecond, "How long matching route patterns may take per request before the request is answered with a 503 (0 for no limit)")
+
+	fs.StringVar(&o.adminToken, "admin-token", "", "Bearer token required by the admin endpoints under /-/. If not present, they are disabled.")
+	fs.Int64Var(&o.diffMaxSize, "diff-max-size", 1<<20, "Objects larger than this many bytes are compared by metadata only in the diff endpoint")
+
+	fs.StringVar(&o.signToken, "sign-token", "", "Bearer token for POST /-/sign, so that backends can sign URLs without the admin token (default: the admin token)")
+	fs.DurationVar(&o.signDefaultTTL, "sign-default-ttl", 15*time.Minute, "Lifetime of URLs signed by POST /-/sign that don't ask for one")
+	fs.DurationVar(&o.signMaxTTL, "sign-max-ttl", time.Hour, "Longest lifetime POST /-/sign grants (at most 7 days)")
+
+	fs.StringVar(&o.signingAccountFlag, "signing-account", "", "Service account email that signs URLs through the IAM API, for credentials the storage library can't sign with, such as workload identity federation without service account impersonation")
+
+	fs.StringVar(&o.indexRoots, "index", "", "Comma-separated <bucket>[/<prefix>] entries to keep in the search index served by /-/search")
+	fs.DurationVar(&o.indexInterval, "index-interval", 10*time.Minute, "How often to rebuild the search index")
+
+	fs.IntVar(&o.accessStatsDepth, "access-stats-depth", 1, "Number of leading name segments that group objects in the access counts written by export-access jobs (0 disables counting)")
+
+	fs.DurationVar(&o.asofCacheTTL, "asof-cache-ttl", time.Minute, "How long to cache object version listings used to resolve ?asof= requests (0 disables caching)")
+
+	fs.StringVar(&o.secureLinkKeyFile, "secure-link-key", "", "Optional path to a file with a secret signing expiring links; requests for objects must then carry valid expires and signature query parameters")
+	fs.BoolVar(&o.secureLinkOnce, "secure-link-once", false, "Accept each signed link only once")
+	fs.StringVar(&o.secureLinkStore, "secure-link-store", "", "<bucket>/<prefix> under which the one-time links used are recorded, so that all instances share them (default: in memory)")
+	fs.StringVar(&o.secureLinkCookie, "secure-link-cookie", "", "Name of a cookie that, signed with -secure-link-key, grants access to all objects under a path prefix until it expires (example: gcsproxy-access)")
+
+	fs.StringVar(&o.receiptKeyFile, "receipt-key", "", "Optional path to a PEM-encoded Ed25519 private key used to sign an X-Gcsproxy-Receipt header on every response")
+
+	fs.StringVar(&o.encryptionKeys, "encryption-keys", "", "Optional path to a JSON file mapping recipient names to base64-encoded 32-byte keys; responses to requests naming a recipient in X-Gcsproxy-Recipient are encrypted with its key")
+	fs.BoolVar(&o.encryptionRequired, "encryption-required", false, "Refuse requests that don't name a recipient of -encryption-keys")
+
+	fs.Int64Var(&o.dlpMaxSize, "dlp-max-size", 10<<20, "Responses inspected by the dlp rules of the config file are buffered up to this many bytes, so that block rules can refuse them; larger ones are inspected while streaming")
+
+	fs.StringVar(&o.trustedProxiesList, "trusted-proxies", "", "Comma-separated IPs or CIDRs of proxies whose X-Forwarded-For entries are trusted")
+	fs.StringVar(&o.headerNamesList, "header-names", "", "Comma-separated response header names to write with exactly this spelling instead of the canonical one (example: ETag,X-Goog-Meta-userId)")
+	fs.BoolVar(&o.proxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol (v1 or v2) header on every connection, as sent by HAProxy or TCP load balancers")
+	fs.StringVar(&o.tlsCertDir, "tls-cert-dir", "", "Serve HTTPS with the certificate for each host name read from <host>.crt and <host>.key (or _wildcard.<domain>.crt and .key) in this directory")
+	fs.StringVar(&o.tlsVersionHeader, "tls-version-header", "", "Request header in which a trusted proxy that terminates TLS passes the TLS version (example: X-Forwarded-TLS-Version)")
+
+	fs.BoolVar(&o.reapChildren, "reap-zombies", os.Getpid() == 1, "Reap exited child processes, as needed when running as PID 1 in a container (default true when running as PID 1)")
+	fs.StringVar(&o.umask, "umask", "", "Octal umask to set at startup (example: 027)")
+	fs.StringVar(&o.runAsUser, "user", "", "User (name or uid, optionally :group) to switch to once the listening socket is bound, e.g. to bind port 80 as root and serve as nobody")
+
+	fs.StringVar(&o.jwtJWKS, "jwt-jwks", "", "Optional JWKS URL; requests must then carry an Authorization: Bearer JWT signed with one of its keys")
+	fs.StringVar(&o.jwtIssuer, "jwt-issuer", "", "Issuer (iss) bearer tokens must have, or a comma-separated list of accepted issuers")
+	fs.StringVar(&o.jwtAudience, "jwt-audience", "", "Audience (aud) bearer tokens must have")
+	fs.DurationVar(&o.jwtJWKSRefresh, "jwt-jwks-refresh", time.Hour, "How often to fetch the -jwt-jwks keys again")
+
+	fs.StringVar(&o.firebaseProject, "firebase-project", "", "Optional Firebase project ID; requests must then carry an Authorization: Bearer Firebase Auth ID token of one of its users")
+
+	fs.StringVar(&o.googleAudience, "google-audience", "", "Optional OAuth client ID; requests must then carry an Authorization: Bearer Google ID token issued for it")
+	fs.StringVar(&o.iapAudience, "iap-audience", "", "Optional IAP audience (/projects/<number>/global/backendServices/<id> or /projects/<number>/apps/<project>); requests must then carry the X-Goog-IAP-JWT-Assertion of Identity-Aware Proxy")
+	fs.StringVar(&o.allowedDomains, "allowed-domains", "", "Comma-separated email domains of the Google identities allowed (example: example.com)")
+	fs.StringVar(&o.allowedGroups, "allowed-groups", "", "Comma-separated Google groups whose members are allowed, checked with the Cloud Identity API")
+	fs.DurationVar(&o.allowedGroupsTTL, "allowed-groups-ttl", 5*time.Minute, "How long to cache group memberships")
+
+	fs.StringVar(&o.htpasswd, "htpasswd", "", "Optional htpasswd file (MD5 or SHA-1 hashes); requests must then carry HTTP Basic credentials of one of its users")
+	fs.StringVar(&o.basicAuthRealm, "basic-auth-realm", "gcsproxy", "Realm sent to clients in HTTP Basic challenges")
+
+	fs.StringVar(&o.apiKeysFile, "api-keys", "", "Optional JSON file, or Secret Manager secret (sm://projects/<project>/secrets/<name>), of API keys scoped to buckets, prefixes and methods; requests must then carry one of them")
+	fs.StringVar(&o.apiKeyHeader, "api-key-header", "X-API-Key", "Request header carrying the API key")
+	fs.StringVar(&o.apiKeyParam, "api-key-param", "", "Query parameter that may carry the API key instead of the header (example: key)")
+	fs.DurationVar(&o.apiKeysRefresh, "api-keys-refresh", 0, "How often to reload -api-keys, e.g. to pick up new Secret Manager versions (0 only reloads on SIGHUP)")
+
+	fs.Float64Var(&o.rateLimit, "rate-limit", 0, "Requests per second each client (API key, or else address) may make; more get a 429 (0 disables the limit)")
+	fs.IntVar(&o.rateLimitBurst, "rate-limit-burst", 0, "Requests a client may make at once before -rate-limit applies (default: a second's worth)")
+
+	fs.IntVar(&o.maxConcurrent, "max-concurrent", 0, "Requests served at once; more wait in a queue (0 disables the limit)")
+	fs.IntVar(&o.maxQueue, "max-queue", 100, "Requests that may wait for one of the -max-concurrent slots; more get a 503")
+	fs.DurationVar(&o.queueTimeout, "queue-timeout", 5*time.Second, "How long a request may wait for a -max-concurrent slot before it gets a 503")
+
+	fs.BoolVar(&o.csekHeaders, "csek-headers", false, "Accept customer-supplied encryption keys in X-Goog-Encryption-Key request headers to read objects encrypted with them")
+	fs.StringVar(&o.csekKeys, "csek-keys", "", "Comma-separated bucket=file pairs of customer-supplied encryption keys to read the buckets' encrypted objects with; files may be sm:// Secret Manager references")
+
+	fs.IntVar(&o.gcsMaxAttempts, "gcs-max-attempts", 3, "How many times a GCS metadata lookup or read is attempted when it fails with a transient error (1 disables retries)")
+	fs.DurationVar(&o.gcsRetryBackoff, "gcs-retry-backoff", 100*time.Millisecond, "Initial pause between GCS attempts, doubled after each retry")
+	fs.DurationVar(&o.gcsRetryMaxBackoff, "gcs-retry-max-backoff", 2*time.Second, "Longest pause between GCS attempts")
+	fs.StringVar(&o.gcsRetryCodes, "gcs-retry-codes", "408,429,500,502,503,504", "Comma-separated HTTP statuses of GCS errors that are retried")
+	fs.IntVar(&o.gcsBreakerFailures, "gcs-breaker-failures", 0, "Consecutive failed GCS calls after which requests get a 503 without calling GCS until -gcs-breaker-cooldown has passed (0 disables the breaker)")
+	fs.DurationVar(&o.gcsBreakerCooldown, "gcs-breaker-cooldown", 30*time.Second, "How long requests fail fast once the GCS breaker has tripped before a call is let through to probe GCS")
+
+	fs.IntVar(&o.replicaFailures, "replica-failures", 3, "Consecutive failed lookups after which a replica bucket is taken out of rotation for -replica-cooldown")
+	fs.DurationVar(&o.replicaMaxLatency, "replica-max-latency", 0, "Take a replica bucket out of rotation when its average lookup latency exceeds this (0 for no limit)")
+	fs.DurationVar(&o.replicaCooldown, "replica-cooldown", 30*time.Second, "How long an unhealthy replica bucket is out of rotation before it is tried again")
+
+	fs.DurationVar(&o.gcsAttrsTimeout, "gcs-attrs-timeout", 10*time.Second, "How long looking up an object's metadata in GCS may take before the request gets a 504 (0 for no limit)")
+	fs.DurationVar(&o.gcsReadTimeout, "gcs-read-timeout", 30*time.Second, "How long GCS may send nothing while an object is opened or read before the request fails (0 for no limit)")
+
+	fs.IntVar(&o.gcsMaxIdleConnsPerHost, "gcs-max-idle-conns-per-host", 0, "Idle connections to GCS kept for reuse (default 100)")
+	fs.IntVar(&o.gcsMaxConnsPerHost, "gcs-max-conns-per-host", 0, "Maximum connections to GCS, including those in use (0 for no limit)")
+	fs.DurationVar(&o.gcsIdleConnTimeout, "gcs-idle-conn-timeout", 0, "How long an idle connection to GCS is kept (default 90s)")
+	fs.DurationVar(&o.gcsDialTimeout, "gcs-dial-timeout", 0, "Timeout for connecting to GCS (default 30s)")
+	fs.DurationVar(&o.gcsKeepAlive, "gcs-keepalive", 0, "Interval of TCP keep-alive probes on connections to GCS, negative to disable them (default 30s)")
+	fs.DurationVar(&o.gcsTLSHandshakeTimeout, "gcs-tls-handshake-timeout", 0, "Timeout for TLS handshakes with GCS (default 10s)")
+	fs.IntVar(&o.gcsTLSSessionCache, "gcs-tls-session-cache", 0, "Number of TLS sessions to GCS cached for resumption, which makes new connections cheaper (0 disables resumption)")
+
+	fs.StringVar(&o.parallelThresholdFlag, "parallel-threshold", "", "Size from which objects are read from GCS in slices fetched in parallel, such as 256M (default never)")
+	fs.StringVar(&o.sliceSizeFlag, "parallel-slice-size", "16M", "Size of the slices of parallel reads")
+	fs.IntVar(&o.parallelSlices, "parallel-slices", 4, "Number of slices of an object read from GCS at a time")
+	fs.StringVar(&o.readAheadFlag, "read-ahead", "", "How much of an object to read from GCS ahead of what the client has taken, such as 4M (default none)")
+
+	fs.StringVar(&o.copyBufferFlag, "copy-buffer", "32K", "Size of the buffer objects are copied to clients with")
+	fs.DurationVar(&o.flushInterval, "flush-interval", 0, "How often to flush responses to the client while copying, or -1ns to flush after every write (default only when the buffer of net/http is full)")
+
+	fs.BoolVar(&o.singleRoundtripFlag, "single-roundtrip", false, "Open objects right away and take their headers from the read instead of looking up their metadata first, where no setting needs the full metadata")
+
+	fs.StringVar(&o.extAuthz, "ext-authz", "", "Optional URL of an external authorization service consulted before serving each request (grpc:// or grpcs:// for the ext_authz gRPC API)")
+	fs.DurationVar(&o.extAuthzTimeout, "ext-authz-timeout", 2*time.Second, "Timeout for external authorization requests")
+	fs.DurationVar(&o.extAuthzCacheTTL, "ext-authz-cache-ttl", 0, "How long to cache external authorization decisions (0 disables caching)")
+	fs.StringVar(&o.extAuthzHeaders, "ext-authz-headers", "", "Comma-separated request headers to forward to the authorization service in addition to Authorization, Cookie and X-Forwarded-For")
+	fs.StringVar(&o.extAuthzInject, "ext-authz-inject", "", "Comma-separated headers from an allowing authorization response to add to the proxied response")
+	return o
+}
+
+var ctx = context.Background()
+
+func (s *server) handleError(w http.ResponseWriter, err error) {
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else if gerr := (*googleapi.Error)(nil); errors.As(err, &gerr) && gerr.Code == http.StatusBadRequest {
+			// Such as a missing or wrong customer-supplied encryption key.
+			http.Error(w, gerr.Message, http.StatusBadRequest)
+		} else if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+			// The object was overwritten after its metadata was read.
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "object changed while being read", http.StatusServiceUnavailable)
+		} else if err == errGCSUnavailable {
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.gcsBreakerCooldown/time.Second)+1))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		} else if errors.Is(err, context.Canceled) {
+			// The client went away; 499 keeps it out of the 5xx counts.
+			w.WriteHeader(499)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+}
+
+func setStrHeader(w http.ResponseWriter, key string, value string) {
+	if value != "" {
+		w.Header().Add(key, value)
+	}
+}
+
+func setIntHeader(w http.ResponseWriter, key string, value int64) {
+	if value > 0 {
+		w.Header().Add(key, strconv.FormatInt(value, 10))
+	}
+}
+
+func setTimeHeader(w http.ResponseWriter, key string, value time.Time) {
+	if !value.IsZero() {
+		w.Header().Add(key, value.UTC().Format(http.TimeFormat))
+	}
+}
+
+type wrapResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *wrapResponseWriter) WriteHeader(status int) {
+	w.ResponseWriter.WriteHeader(status)
+	// Informational responses such as 103 Early Hints precede the real one.
+	if status >= 200 {
+		w.status = status
+	}
+}
+
+func (w *wrapResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *wrapResponseWriter) Flush() {
+	flush(w.ResponseWriter)
+}
+
+func (s *server) wrapper(fn func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		proc := time.Now()
+		if len(s.headerNames) > 0 {
+			w = &casingResponseWriter{ResponseWriter: w, names: s.headerNames}
+		}
+		writer := &wrapResponseWriter{
+			ResponseWriter: w,
+			status:         http.StatusOK,
+		}
+		fn(writer, r)
+		if s.verbose {
+			s.logAccess(&logEntry{s: s, r: r, w: writer, start: proc, end: time.Now()})
+		}
+	}
+}
+
+// objectPath returns the route template of object requests.
+func (s *server) objectPath() string {
+	if s.singleBucket != "" || s.virtualHosts {
+		return "/{object:.*}"
+	}
+	return "/{bucket:[0-9a-zA-Z-_.]+}/{object:.*}"
+}
+
+// target returns the bucket and object a request is for. The bucket is empty
+// if the request doesn't map to one.
+func (s *server) target(rules *rules, r *http.Request) (bucket, object string) {
+	vars := mux.Vars(r)
+	switch {
+	case s.singleBucket != "":
+		bucket, object = s.singleBucket, vars["object"]
+	case s.virtualHosts:
+		bucket, object = hostTarget(rules, r, vars["object"])
+	default:
+		bucket, object = vars["bucket"], vars["object"]
+	}
+	return bucket, object
+}
+
+// authorizeObject runs the access checks for serving the object: the allow
+// and deny lists, -strict, route claims, API key scopes, the acl section and
+// secure transport. It returns the object's route, or false once the
+// request has been answered. Objects served in place of the requested one,
+// such as index documents, go through it as well.
+func (s *server) authorizeObject(w http.ResponseWriter, r *http.Request, rules *rules, bucket, object string) (*route, bool) {
+	if !s.objectAllowed(bucket, object) {
+		s.notFound(w, r, nil, bucket)
+		return nil, false
+	}
+	rt, ok := s.checkRoute(w, rules, bucket, object)
+	if !ok {
+		return nil, false
+	}
+	if s.strict && rt == nil {
+		s.notFound(w, r, nil, bucket)
+		return nil, false
+	}
+	if !checkClaims(w, r, rt, object) || !s.checkAPIKeyScope(w, r, bucket, object) || !s.checkACL(w, r, rules, bucket, object) {
+		return nil, false
+	}
+	if rt != nil && !s.checkTransport(w, r, rt.minTLS) {
+		return nil, false
+	}
+	return rt, true
+}
+
+func (s *server) proxy(w http.ResponseWriter, r *http.Request) {
+	rules := s.activeRules()
+	bucket, object := s.target(rules, r)
+	if bucket == "" || !s.bucketAllowed(bucket) {
+		http.NotFound(w, r)
+		return
+	}
+	object, status := rules.rewriteObject(bucket, object)
+	if status != 0 {
+		redirect(w, r, object, status)
+		return
+	}
+	if !s.checkObjectName(w, object) {
+		return
+	}
+	if loc, ok := s.cleanURLRedirect(r); ok {
+		redirect(w, r, loc, http.StatusMovedPermanently)
+		return
+	}
+	rt, ok := s.authorizeObject(w, r, rules, bucket, object)
+	if !ok {
+		return
+	}
+	if !s.checkEgressQuota(w, rules, bucket) {
+		return
+	}
+	ew, ok := s.encryptResponse(w, r)
+	if !ok {
+		return
+	}
+	if ew != nil {
+		defer ew.Close()
+		w = ew
+	}
+	dir := isDirectory(object)
+	dirName := object
+	indexed := false
+	if idx := s.indexDocument(rt); idx != "" && dir {
+		object += idx
+		indexed = true
+	}
+	if store := storeFor(rt); store != nil {
+		if object == "" || isDirectory(object) {
+			s.notFound(w, r, rt, bucket)
+			return
+		}
+		if !s.runPreFetchHooks(w, r, bucket, object) {
+			return
+		}
+		s.announcePreloads(w, rt)
+		s.serveFromStore(w, r, rules, rt, store, bucket, object)
+		return
+	}
+	if _, ok := r.URL.Query()["list"]; ok && dir && s.listingEnabled(rt) {
+		s.serveListing(w, r, rules, bucket, dirName)
+		return
+	}
+	if _, ok := r.URL.Query()["versions"]; ok && !dir && s.listingEnabled(rt) {
+		s.serveVersions(w, r, bucket, object)
+		return
+	}
+	if isDirectory(object) && s.autoindexEnabled(rt) {
+		s.serveAutoindex(w, r, rules, bucket, dirName)
+		return
+	}
+	if object == "" {
+		s.notFound(w, r, rt, bucket)
+		return
+	}
+	if !s.runPreFetchHooks(w, r, bucket, object) {
+		return
+	}
+	s.announcePreloads(w, rt)
+	// Compressed content can't be inspected, so have GCS decompress it.
+	gzipAcceptable := clientAcceptsGzip(r) && len(rules.dlp) == 0
+	obj := s.objectHandle(bucket, object)
+	actx, cancel := s.attrsContext(r.Context())
+	defer cancel()
+	// Both parameters are checked before asof has versions listed.
+	asof, g := r.URL.Query().Get("asof"), r.URL.Query().Get("generation")
+	if asof != "" && g != "" {
+		http.Error(w, "asof and generation can't be used together", http.StatusBadRequest)
+		return
+	}
+	if asof != "" {
+		t, err := time.Parse(time.RFC3339, asof)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid asof: %v", err), http.StatusBadRequest)
+			return
+		}
+		gen, err := s.generationAsOf(actx, bucket, object, t)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		obj = obj.Generation(gen)
+	}
+	if g != "" {
+		gen, err := strconv.ParseInt(g, 10, 64)
+		if err != nil || gen <= 0 {
+			http.Error(w, fmt.Sprintf("invalid generation %q", g), http.StatusBadRequest)
+			return
+		}
+		obj = obj.Generation(gen)
+	}
+	// src is the bucket objects are read from, which may be a replica of
+	// the requested one.
+	src := bucket
+	var attr *storage.ObjectAttrs
+	var err error
+	// objr is opened right away in single-roundtrip mode.
+	var objr *storage.Reader
+	var objBody io.Reader
+	if !historicalRead(r) && s.replicaOrder(rules, bucket) != nil {
+		obj, attr, src, err = s.readReplica(r.Context(), rules, bucket, object, gzipAcceptable)
+	} else if s.singleRoundtrip(rules, rt) {
+		obj = obj.ReadCompressed(gzipAcceptable)
+		var cancelRead context.CancelFunc
+		if objr, objBody, cancelRead, err = s.openObject(r.Context(), obj, nil); err == nil {
+			defer cancelRead()
+			defer objr.Close()
+			attr = readerAttrs(bucket, object, objr)
+		}
+	} else {
+		obj = obj.ReadCompressed(gzipAcceptable)
+		err = s.withRetries(actx, func() (err error) {
+			attr, err = obj.Attrs(actx)
+			return err
+		})
+	}
+	if indexed && err == nil {
+		if _, ok := s.authorizeObject(w, r, rules, bucket, object); !ok {
+			return
+		}
+	}
+	if name, ok := s.cleanURLObject(object); err == storage.ErrObjectNotExist && ok {
+		if o, a, err2 := s.objectAttrs(actx, src, name, gzipAcceptable); err2 != storage.ErrObjectNotExist {
+			if err2 == nil {
+				if _, ok := s.authorizeObject(w, r, rules, bucket, name); !ok {
+					return
+				}
+			}
+			obj, attr, err = o, a, err2
+		}
+	}
+	if idx := s.indexDocument(rt); err == storage.ErrObjectNotExist && idx != "" && !isDirectory(object) {
+		// The path may name a "folder" with an index document.
+		if o, a, err2 := s.objectAttrs(actx, src, object+"/"+idx, gzipAcceptable); err2 != storage.ErrObjectNotExist {
+			if err2 == nil {
+				if _, ok := s.authorizeObject(w, r, rules, bucket, object+"/"+idx); !ok {
+					return
+				}
+			}
+			if err2 == nil && s.trailingSlash {
+				redirect(w, r, r.URL.EscapedPath()+"/", http.StatusMovedPermanently)
+				return
+			}
+			obj, attr, err = o, a, err2
+		}
+	}
+	if fb := s.fallbackBucketFor(rt); err != nil && fb != "" && fb != bucket && s.shouldFallBack(err) && !historicalRead(r) && s.objectAllowed(fb, object) {
+		if o, a, err2 := s.fromFallbackBucket(r, rt, bucket, object, gzipAcceptable); err2 == nil || err == storage.ErrObjectNotExist {
+			obj, attr, err = o, a, err2
+		}
+	}
+	if err == storage.ErrObjectNotExist && dirName != "" && dir && s.trailingSlash && s.namesObject(actx, src, dirName) {
+		redirect(w, r, strings.TrimSuffix(r.URL.EscapedPath(), "/"), http.StatusMovedPermanently)
+		return
+	}
+	if err == storage.ErrObjectNotExist && dir && s.autoindexEnabled(rt) {
+		s.serveAutoindex(w, r, rules, bucket, dirName)
+		return
+	}
+	if fb := s.fallbackObject(rt); err == storage.ErrObjectNotExist && fb != "" && fb != object {
+		// Let client-side routing handle paths that aren't objects.
+		obj, attr, err = s.objectAttrs(actx, src, fb, gzipAcceptable)
+		if err == nil {
+			if _, ok := s.authorizeObject(w, r, rules, bucket, fb); !ok {
+				return
+			}
+		}
+	}
+	if err == storage.ErrObjectNotExist {
+		s.warnf("not-found:"+bucket+"/"+object, "Object %s/%s not found", bucket, object)
+		s.notFound(w, r, rt, bucket)
+		return
+	}
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if isBlocked(rules, attr) {
+		s.warnf("blocked:"+attr.Bucket+"/"+attr.Name, "Object %v is blocked", attr.Name)
+		s.notFound(w, r, rt, bucket)
+		return
+	}
+	if !s.checkTransport(w, r, s.objectMinTLS(attr)) {
+		return
+	}
+	encoding := ""
+	if o, a, enc := s.precompressedSibling(actx, w, r, rules, rt, attr); o != nil {
+		obj, attr, encoding = o, a, enc
+	}
+	if obj, ok = s.serveCold(actx, w, r, rt, obj, attr, gzipAcceptable || encoding != ""); !ok {
+		return
+	}
+	var private bool
+	if obj, private, ok = s.withCSEK(w, r, obj, attr); !ok {
+		return
+	}
+	s.accessStats.record(s.accessStatsDepth, attr.Bucket, attr.Name, attr.Size, attr.StorageClass)
+	// Signed URLs serve siblings without their Content-Encoding.
+	if encoding == "" && s.redirectable(rules, rt, ew, attr) {
+		s.redirectSigned(w, r, obj, attr)
+		return
+	}
+	if !s.writeObjectHeaders(w, r, rules, attr) {
+		return
+	}
+	if objr == nil {
+		// The read stops when the client goes away.
+		var cancelRead context.CancelFunc
+		if objr, objBody, cancelRead, err = s.openObject(r.Context(), pinGeneration(obj, attr), attr); err != nil {
+			s.handleError(w, err)
+			return
+		}
+		defer cancelRead()
+		defer objr.Close()
+	}
+	cacheControl := attr.CacheControl
+	if private {
+		cacheControl = "private"
+	}
+	if encoding == "" {
+		encoding = objr.Attrs.ContentEncoding
+	}
+	writeContentHeaders(w, attr, cacheControl, encoding, objr.Attrs.Size)
+	if s.receiptKey != nil {
+		rcpt, err := signReceipt(s.receiptKey, receipt{
+			Bucket:     attr.Bucket,
+			Object:     attr.Name,
+			Generation: objr.Attrs.Generation,
+			CRC32C:     attr.CRC32C,
+			Bytes:      objr.Attrs.Size,
+		})
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		setStrHeader(w, "X-Gcsproxy-Receipt", rcpt)
+	}
+	if !s.runPostHeadersHooks(w, r, attr) {
+		return
+	}
+	body := s.countEgress(bucket, s.throttle(r.Context(), rules, rt, bucket, attr.Name, s.readAhead(r.Context(), objBody)))
+	s.sendBody(w, r, rules, bucket, attr, encoding, body)
+}
+
+// writeObjectHeaders sets the configured headers and those taken from the
+// object's metadata. It answers with a 304 and returns false if the client's
+// copy, per If-Modified-Since, is current.
+func (s *server) writeObjectHeaders(w http.ResponseWriter, r *http.Request, rules *rules, attr *storage.ObjectAttrs) bool {
+	for k, v := range rules.headers {
+		setStrHeader(w, k, v)
+	}
+	writeMetadataHeaders(rules, attr, w)
+	for _, link := range objectPreloads(attr) {
+		w.Header().Add("Link", link)
+	}
+
+	if lastStrs, ok := r.Header["If-Modified-Since"]; ok && len(lastStrs) > 0 {
+		last, err := http.ParseTime(lastStrs[0])
+		if err != nil {
+			s.warnf("if-modified-since", "could not parse If-Modified-Since: %v", err)
+		}
+		if !attr.Updated.Truncate(time.Second).After(last) {
+			w.WriteHeader(304)
+			return false
+		}
+	}
+	return true
+}
+
+// writeContentHeaders sets the headers describing the body sent for the
+// object, which may be encoded differently from it.
+func writeContentHeaders(w http.ResponseWriter, attr *storage.ObjectAttrs, cacheControl, encoding string, size int64) {
+	setTimeHeader(w, "Last-Modified", attr.Updated)
+	setStrHeader(w, "Content-Type", attr.ContentType)
+	setStrHeader(w, "Content-Language", attr.ContentLanguage)
+	setStrHeader(w, "Cache-Control", cacheControl)
+	setStrHeader(w, "Content-Encoding", encoding)
+	setStrHeader(w, "Content-Disposition", attr.ContentDisposition)
+	setIntHeader(w, "Content-Length", size)
+}
+
+func isBlocked(rules *rules, attr *storage.ObjectAttrs) bool {
+	if rules.blockIfKey == "" {
+		return false
+	}
+	// S3 and Azure Blob Storage return metadata keys lower-cased.
+	for k, v := range attr.Metadata {
+		if strings.EqualFold(k, rules.blockIfKey) && v == rules.blockIfValue {
+			return true
+		}
+	}
+	return false
+}
+
+func parseBlockIfMeta(s string) (key, value string, err error) {
+	if s == "" {
+		return "", "", nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("unexpected block-if argument: %v", s)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func writeMetadataHeaders(rules *rules, attr *storage.ObjectAttrs, w http.ResponseWriter) {
+	prefix := "X-Goog-Meta-"
+	for k, v := range attr.Metadata {
+		if passesThrough(rules, k) {
+			setStrHeader(w, fmt.Sprintf("%s%s", prefix, k), v)
+		}
+	}
+}
+
+// passesThrough reports whether the metadata key is one of -pass-through,
+// ignoring case like isBlocked.
+func passesThrough(rules *rules, key string) bool {
+	if _, ok := rules.passthrough[key]; ok {
+		return true
+	}
+	for name := range rules.passthrough {
+		if strings.EqualFold(name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePassthroughMeta(s string) map[string]struct{} {
+	set := make(map[string]struct{})
+	metas := strings.Split(s, ",")
+	for _, meta := range metas {
+		set[meta] = struct{}{}
+	}
+	return set
+}
+
+func clientAcceptsGzip(r *http.Request) bool {
+	acceptHeader := r.Header.Get("Accept-Encoding")
+	return strings.Contains(acceptHeader, "gzip")
+}
+
+func (s *server) newClient() (*storage.Client, error) {
+	opts := s.endpointOptions()
+	if s.credentials != "" && !s.usingEmulator() {
+		data, err := readSecret(ctx, s.credentials)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithCredentialsJSON(data))
+	}
+	return s.newStorageClient(ctx, opts...)
+}
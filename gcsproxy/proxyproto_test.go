@@ -0,0 +1,126 @@
+package gcsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header returns a v2 header with the given command (0 LOCAL, 1
+// PROXY), address family and address block.
+func proxyV2Header(command, family byte, addrs []byte) []byte {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, 0x20|command, family<<4|1, 0, 0)
+	binary.BigEndian.PutUint16(h[len(h)-2:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x1f, 0x90, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6[32:], 4000)
+	tests := []struct {
+		name   string
+		header string
+		want   string // the address, "" for none
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 8080 443\r\n", "192.0.2.1:8080"},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n", "[2001:db8::1]:4000"},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", ""},
+		{"v2 IPv4", string(proxyV2Header(1, 1, v4)), "192.0.2.1:8080"},
+		{"v2 IPv6", string(proxyV2Header(1, 2, v6)), "[2001:db8::1]:4000"},
+		{"v2 LOCAL", string(proxyV2Header(0, 1, v4)), ""},
+		{"v2 unspecified family", string(proxyV2Header(1, 0, nil)), ""},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.header + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: address = %q, want %q", tt.name, got, tt.want)
+		}
+		// The header is consumed, the request isn't.
+		if rest, _ := io.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: left %q", tt.name, rest)
+		}
+	}
+}
+
+func TestReadProxyHeaderErrors(t *testing.T) {
+	v2 := proxyV2Header(1, 1, []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x1f, 0x90, 0x01, 0xbb})
+	version3 := append([]byte{}, v2...)
+	version3[12] = 0x31
+	tests := map[string][]byte{
+		"no header":        []byte("GET / HTTP/1.1\r\n\r\n"),
+		"v1 too long":      []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"),
+		"v1 bad protocol":  []byte("PROXY UDP4 192.0.2.1 198.51.100.1 8080 443\r\n"),
+		"v1 bad address":   []byte("PROXY TCP4 192.0.2 198.51.100.1 8080 443\r\n"),
+		"v1 bad port":      []byte("PROXY TCP4 192.0.2.1 198.51.100.1 80800 443\r\n"),
+		"v1 missing field": []byte("PROXY TCP4 192.0.2.1 198.51.100.1 8080\r\n"),
+		"v1 no CRLF":       []byte("PROXY TCP4 192.0.2.1 198.51.100.1 8080 443\n"),
+		"v2 version 3":     version3,
+		"v2 truncated":     v2[:len(v2)-4],
+		"v2 short block":   proxyV2Header(1, 1, []byte{192, 0, 2, 1}),
+	}
+	for name, header := range tests {
+		if addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header))); err == nil {
+			t.Errorf("%s: accepted, address %v", name, addr)
+		}
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})}
+	go srv.Serve(&proxyProtoListener{Listener: l})
+	defer srv.Close()
+
+	get := func(header string) (string, error) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "%sGET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", header)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("status %d", resp.StatusCode)
+		}
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	if got, err := get("PROXY TCP4 192.0.2.1 198.51.100.1 8080 443\r\n"); err != nil || got != "192.0.2.1:8080" {
+		t.Errorf("v1: remote address %q, %v", got, err)
+	}
+	if got, err := get(string(proxyV2Header(0, 1, nil))); err != nil || !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("LOCAL: remote address %q, %v, want the connection's", got, err)
+	}
+	// Connections without a header aren't served.
+	if _, err := get(""); err == nil {
+		t.Error("connection without a header was served")
+	}
+}
@@ -0,0 +1,96 @@
+package gcsproxy
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+type clientLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// bucket returns the client's bucket, creating it with the given rate and
+// burst size if the client has none.
+func (l *clientLimiter) bucket(key string, rate, burst float64) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxCachedDecisions {
+			l.sweepLocked()
+			trimMap(l.buckets, maxCachedDecisions)
+		}
+		b = newBurstBucket(rate, burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// sweep drops the buckets of clients that have been idle long enough for
+// them to refill, and returns how many were removed.
+func (l *clientLimiter) sweep() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sweepLocked()
+}
+
+func (l *clientLimiter) sweepLocked() int {
+	n := 0
+	for key, b := range l.buckets {
+		if b.full() {
+			delete(l.buckets, key)
+			n++
+		}
+	}
+	return n
+}
+
+// rateLimitNetwork returns the /64 of an IPv6 address, and other addresses
+// as they are.
+func rateLimitNetwork(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// rateLimitBurstSize returns -rate-limit-burst, or by default a second's
+// worth of requests.
+func (s *server) rateLimitBurstSize() float64 {
+	if s.rateLimitBurst > 0 {
+		return float64(s.rateLimitBurst)
+	}
+	return math.Max(1, math.Ceil(s.rateLimit))
+}
+
+// limitRate answers with a 429 if the client has made more requests than
+// -rate-limit allows. Clients are told apart by their API key, if they
+// present one, or else by address. IPv6 clients are told apart by their /64,
+// the smallest prefix usually assigned to a host, so rotating through the
+// addresses of one network doesn't get a client fresh buckets.
+func (s *server) limitRate(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.rateLimit <= 0 {
+			fn(w, r)
+			return
+		}
+		key := "ip:" + rateLimitNetwork(s.clientIP(r))
+		if k, _ := r.Context().Value(apiKeyKey{}).(*apiKey); k != nil {
+			key = "key:" + k.Name
+		}
+		ok, retry := s.clientLimits.bucket(key, s.rateLimit, s.rateLimitBurstSize()).take()
+		if !ok {
+			s.rateLimitStats.Add("limited", 1)
+			s.noticef("rate-limit:"+key, "Rate limited %s", key)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		fn(w, r)
+	}
+}
@@ -0,0 +1,102 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// logRateWindow is the period -log-rate applies to.
+const logRateWindow = time.Minute
+
+// maxLogKeys bounds the number of warnings tracked at once. Beyond it,
+// warnings share a single budget.
+const maxLogKeys = 1000
+
+type logWindow struct {
+	start time.Time
+	n     int
+}
+
+// logLimiter counts repetitions of warnings per key, so that a client
+// sending the same bad request over and over can't flood the log.
+type logLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*logWindow
+}
+
+// allow reports whether a warning with the given key may be logged, and how
+// many were suppressed in the previous window.
+func (l *logLimiter) allow(key string, limit int) (ok bool, suppressed int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	e, found := l.entries[key]
+	if !found {
+		if len(l.entries) >= maxLogKeys {
+			l.sweepLocked(now)
+		}
+		if len(l.entries) >= maxLogKeys {
+			key = "*"
+			e, found = l.entries[key]
+		}
+		if !found {
+			e = &logWindow{start: now}
+			l.entries[key] = e
+		}
+	}
+	if now.Sub(e.start) >= logRateWindow {
+		if e.n > limit {
+			suppressed = e.n - limit
+		}
+		e.start, e.n = now, 0
+	}
+	e.n++
+	return e.n <= limit, suppressed
+}
+
+// sweep drops the windows that have ended and returns how many were
+// removed.
+func (l *logLimiter) sweep() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sweepLocked(time.Now())
+}
+
+func (l *logLimiter) sweepLocked(now time.Time) int {
+	n := 0
+	for k, e := range l.entries {
+		if now.Sub(e.start) >= logRateWindow {
+			delete(l.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// warnf logs a warning about a request if -v is set, rate limited like
+// noticef.
+func (s *server) warnf(key, format string, args ...interface{}) {
+	if s.verbose {
+		s.noticef(key, format, args...)
+	}
+}
+
+// noticef logs a message about a request. At most -log-rate messages with
+// the same key are logged per minute; the number of suppressed ones is added
+// to the next one that gets through.
+func (s *server) noticef(key, format string, args ...interface{}) {
+	if s.logRate <= 0 {
+		s.logger.Printf(format, args...)
+		return
+	}
+	ok, suppressed := s.warnings.allow(key, s.logRate)
+	if !ok {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s (%d similar messages suppressed)", msg, suppressed)
+	}
+	s.logger.Printf("%s", msg)
+}
@@ -0,0 +1,68 @@
+package gcsproxy
+
+import (
+	"context"
+	"io"
+)
+
+// readAheadChunk is the largest read from GCS while reading ahead.
+const readAheadChunk = 256 << 10
+
+// readAhead returns a reader of r's content that keeps reading up to
+// -read-ahead bytes ahead in the background, so GCS isn't idle while a slow
+// client takes the previous chunk. The background read stops when the
+// context is done.
+func (s *server) readAhead(ctx context.Context, r io.Reader) io.Reader {
+	if s.readAheadSize <= 0 {
+		return r
+	}
+	n := s.readAheadSize / readAheadChunk
+	if n < 1 {
+		n = 1
+	}
+	a := &aheadReader{chunks: make(chan []byte, n)}
+	go a.fill(ctx, r)
+	return a
+}
+
+// aheadReader reads the chunks filled from the underlying reader.
+type aheadReader struct {
+	chunks chan []byte
+	cur    []byte
+	// err is the error that ended the background read, io.EOF at the
+	// end. It is set before chunks is closed.
+	err error
+}
+
+func (a *aheadReader) fill(ctx context.Context, r io.Reader) {
+	defer close(a.chunks)
+	for {
+		buf := make([]byte, readAheadChunk)
+		n, err := r.Read(buf)
+		if n > 0 {
+			select {
+			case a.chunks <- buf[:n]:
+			case <-ctx.Done():
+				a.err = ctx.Err()
+				return
+			}
+		}
+		if err != nil {
+			a.err = err
+			return
+		}
+	}
+}
+
+func (a *aheadReader) Read(p []byte) (int, error) {
+	for len(a.cur) == 0 {
+		chunk, ok := <-a.chunks
+		if !ok {
+			return 0, a.err
+		}
+		a.cur = chunk
+	}
+	n := copy(p, a.cur)
+	a.cur = a.cur[n:]
+	return n, nil
+}
@@ -0,0 +1,56 @@
+package gcsproxy
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// receipt records which exact object version was delivered.
+type receipt struct {
+	Bucket     string `json:"bucket"`
+	Object     string `json:"object"`
+	Generation int64  `json:"generation"`
+	CRC32C     uint32 `json:"crc32c"`
+	Bytes      int64  `json:"bytes"`
+	Time       string `json:"time"`
+}
+
+func loadReceiptKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T, expected Ed25519", key)
+	}
+	return edKey, nil
+}
+
+// signReceipt returns "<payload>.<signature>", both base64url encoded, where
+// the Ed25519 signature covers the encoded payload.
+func signReceipt(key ed25519.PrivateKey, rcpt receipt) (string, error) {
+	rcpt.Time = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(rcpt)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	sig := ed25519.Sign(key, []byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
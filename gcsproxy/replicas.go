@@ -0,0 +1,175 @@
+package gcsproxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// replicaSet is an entry of the replicas section of the config file: buckets
+// holding the same objects, such as copies in different regions. Requests
+// for any of them are read from the requested bucket while it is healthy,
+// and otherwise from the first healthy one in the list:
+//
+//	{"replicas": [{"buckets": ["assets-us", "assets-eu"]}]}
+type replicaSet struct {
+	Buckets []string `json:"buckets"`
+}
+
+// compileReplicas validates replica sets.
+func compileReplicas(sets []replicaSet) error {
+	seen := make(map[string]bool)
+	for i, set := range sets {
+		if len(set.Buckets) < 2 {
+			return fmt.Errorf("replica set %d: at least two buckets are required", i)
+		}
+		for _, b := range set.Buckets {
+			if b == "" || seen[b] {
+				return fmt.Errorf("replica set %d: invalid or repeated bucket %q", i, b)
+			}
+			seen[b] = true
+		}
+	}
+	return nil
+}
+
+// replicaOrder returns the buckets to read the bucket's objects from, in
+// order of preference: the bucket itself and the other replicas that are
+// healthy, then the unhealthy ones. It returns nil if the bucket has no
+// replicas.
+func (s *server) replicaOrder(rules *rules, bucket string) []string {
+	for _, set := range rules.replicas {
+		for _, b := range set.Buckets {
+			if b != bucket {
+				continue
+			}
+			var healthy, down []string
+			for _, b := range append([]string{bucket}, set.Buckets...) {
+				switch {
+				case contains(healthy, b) || contains(down, b):
+				case s.replicaHealth.healthy(b):
+					healthy = append(healthy, b)
+				default:
+					down = append(down, b)
+				}
+			}
+			return append(healthy, down...)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readReplica looks the object up in the bucket's replicas in order of
+// preference, failing over to the next one when GCS fails or times out. Each
+// lookup gets its own -gcs-attrs-timeout. It returns the replica that
+// answered.
+func (s *server) readReplica(parent context.Context, rules *rules, bucket, object string, gzipAcceptable bool) (obj *storage.ObjectHandle, attr *storage.ObjectAttrs, src string, err error) {
+	for i, b := range s.replicaOrder(rules, bucket) {
+		if i > 0 {
+			s.replicaStats.Add("failovers", 1)
+		}
+		ctx, cancel := s.attrsContext(parent)
+		start := time.Now()
+		obj, attr, err = s.objectAttrs(ctx, b, object, gzipAcceptable)
+		cancel()
+		s.observeReplica(b, time.Since(start), err)
+		src = b
+		if err == nil || err == storage.ErrObjectNotExist || !s.shouldFallBack(err) || parent.Err() != nil {
+			break
+		}
+	}
+	return obj, attr, src, err
+}
+
+type bucketHealth struct {
+	failures  int           // consecutive
+	latency   time.Duration // moving average
+	downUntil time.Time
+	reason    string
+}
+
+// healthTracker marks a replica down for -replica-cooldown after
+// -replica-failures consecutive failed lookups, or when its average lookup
+// latency exceeds -replica-max-latency.
+type healthTracker struct {
+	mu      sync.Mutex
+	buckets map[string]*bucketHealth
+}
+
+func (t *healthTracker) healthy(bucket string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.buckets[bucket]
+	return !ok || !time.Now().Before(h.downUntil)
+}
+
+// observeReplica records the outcome of a lookup in the replica.
+func (s *server) observeReplica(bucket string, latency time.Duration, err error) {
+	t := s.replicaHealth
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.buckets[bucket]
+	if !ok {
+		h = &bucketHealth{}
+		t.buckets[bucket] = h
+	}
+	if err != nil && err != storage.ErrObjectNotExist && s.shouldFallBack(err) {
+		h.failures++
+		if h.failures >= s.replicaFailures {
+			s.markReplicaDown(bucket, h, err.Error())
+		}
+		return
+	}
+	h.failures = 0
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency = (4*h.latency + latency) / 5
+	}
+	if s.replicaMaxLatency > 0 && h.latency > s.replicaMaxLatency {
+		s.markReplicaDown(bucket, h, fmt.Sprintf("average latency %v", h.latency))
+		// Start over once the replica is tried again.
+		h.latency = 0
+	}
+}
+
+// markReplicaDown takes the replica out of rotation. s.replicaHealth.mu must
+// be held.
+func (s *server) markReplicaDown(bucket string, h *bucketHealth, reason string) {
+	if time.Now().Before(h.downUntil) {
+		return
+	}
+	h.downUntil, h.reason = time.Now().Add(s.replicaCooldown), reason
+	s.logger.Printf("[replicas] %s is down for %v: %s", bucket, s.replicaCooldown, reason)
+}
+
+func (t *healthTracker) snapshot() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := make(map[string]interface{}, len(t.buckets))
+	for bucket, h := range t.buckets {
+		down := time.Now().Before(h.downUntil)
+		b := map[string]interface{}{
+			"healthy":              !down,
+			"consecutive_failures": h.failures,
+			"latency_seconds":      h.latency.Seconds(),
+		}
+		if down {
+			b["reason"] = h.reason
+		}
+		s[bucket] = b
+	}
+	return s
+}
@@ -0,0 +1,66 @@
+package gcsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// restoreObject copies a past generation of an object over the live one
+// (POST /-/restore/<bucket>/<object>?generation=<n>). Without a generation
+// it brings back the newest generation of a deleted object. The copy keeps
+// the metadata of the restored generation and becomes a new generation, so
+// a restore can itself be undone.
+func (s *server) restoreObject(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	bucket, object := params["bucket"], params["object"]
+	if !s.checkFrozen(w, bucket, false) {
+		return
+	}
+
+	// The restore must see the generations as they are now.
+	s.versionCache.drop(bucket + "/" + object)
+	defer s.versionCache.drop(bucket + "/" + object)
+
+	var gen int64
+	if g := r.URL.Query().Get("generation"); g != "" {
+		var err error
+		if gen, err = strconv.ParseInt(g, 10, 64); err != nil || gen <= 0 {
+			http.Error(w, fmt.Sprintf("invalid generation %q", g), http.StatusBadRequest)
+			return
+		}
+	} else {
+		versions, err := s.listVersions(r.Context(), bucket, object)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		for _, v := range versions {
+			if v.deleted.IsZero() {
+				http.Error(w, "object exists; give the generation to restore", http.StatusConflict)
+				return
+			}
+			if v.generation > gen {
+				gen = v.generation
+			}
+		}
+		if gen == 0 {
+			s.handleError(w, storage.ErrObjectNotExist)
+			return
+		}
+	}
+
+	obj := s.bucketHandle(bucket, object).Object(object)
+	attr, err := obj.CopierFrom(obj.Generation(gen)).Run(r.Context())
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	s.logger.Printf("[restore] %s/%s restored from generation %d as %d", bucket, object, gen, attr.Generation)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summarize(attr))
+}
@@ -0,0 +1,89 @@
+package gcsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// parseRetryCodes parses a comma-separated list of HTTP statuses.
+func parseRetryCodes(s string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	for _, c := range splitList(s) {
+		code, err := strconv.Atoi(c)
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("invalid retry status %q", c)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+// objectHandle returns a handle for the object whose calls are retried by
+// withRetries rather than by the storage library, so that -gcs-max-attempts
+// bounds them.
+func (s *server) objectHandle(bucket, object string) *storage.ObjectHandle {
+	return s.bucketHandle(bucket, object).Object(object).Retryer(storage.WithPolicy(storage.RetryNever))
+}
+
+// withRetries calls fn until it succeeds, fails with an error that isn't
+// transient, or has been called -gcs-max-attempts times. Attempts are
+// spaced by exponential backoff with jitter, starting at -gcs-retry-backoff
+// and capped at -gcs-retry-max-backoff. While the circuit breaker is open,
+// fn isn't called and errGCSUnavailable is returned.
+func (s *server) withRetries(ctx context.Context, fn func() error) error {
+	if !s.breakerAllows() {
+		s.breakerStats.Add("rejected", 1)
+		return errGCSUnavailable
+	}
+	err := s.retry(ctx, fn)
+	s.recordGCSCall(err)
+	return err
+}
+
+func (s *server) retry(ctx context.Context, fn func() error) error {
+	pause := s.gcsRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !s.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if attempt >= s.gcsMaxAttempts {
+			s.retryStats.Add("exhausted", 1)
+			return err
+		}
+		s.retryStats.Add("retries", 1)
+		wait := time.Millisecond
+		if pause > 0 {
+			wait = time.Duration(rand.Int63n(int64(pause))) + time.Millisecond
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		if pause *= 2; pause > s.gcsRetryMaxBackoff {
+			pause = s.gcsRetryMaxBackoff
+		}
+	}
+}
+
+// retryable reports whether err is a transient GCS error: a status in
+// -gcs-retry-codes or a dropped connection.
+func (s *server) retryable(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return s.retryCodes[gerr.Code]
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,107 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// rewrite is an entry of the rewrites section of the config file. It maps
+// the object path of a request to the object name in the bucket, so the
+// proxy's URL layout can differ from the bucket's:
+//
+//	{"rewrites": [{"strip": "static/", "prepend": "site/v2/"}]}
+//
+// serves /assets/static/app.js from gs://assets/site/v2/app.js. Bucket, if
+// set, limits the rewrite to one bucket.
+//
+// A rewrite with Match is a regex rule instead: paths matching it are
+// rewritten to To, which may refer to submatches as $1 or ${name}. With
+// Redirect, To is a URL the client is redirected to with that status:
+//
+//	{"rewrites": [{"match": "^blog/(\\d+)/(.*)$", "to": "/posts/$2", "redirect": 301}]}
+type rewrite struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Strip   string `json:"strip,omitempty"`
+	Prepend string `json:"prepend,omitempty"`
+
+	Match    string `json:"match,omitempty"`
+	To       string `json:"to,omitempty"`
+	Redirect int    `json:"redirect,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// compileRewrites validates rewrites and compiles their patterns.
+func compileRewrites(rewrites []rewrite) error {
+	for i := range rewrites {
+		rw := &rewrites[i]
+		if rw.Match == "" {
+			if rw.Strip == "" && rw.Prepend == "" {
+				return fmt.Errorf("rewrite %d: strip, prepend or match is required", i)
+			}
+			if rw.To != "" || rw.Redirect != 0 {
+				return fmt.Errorf("rewrite %d: to and redirect need match", i)
+			}
+			continue
+		}
+		if rw.Strip != "" || rw.Prepend != "" {
+			return fmt.Errorf("rewrite %d: match can't be combined with strip or prepend", i)
+		}
+		switch rw.Redirect {
+		case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return fmt.Errorf("rewrite %d: unsupported redirect status %d", i, rw.Redirect)
+		}
+		if rw.Redirect != 0 && rw.To == "" {
+			return fmt.Errorf("rewrite %d: redirect needs to", i)
+		}
+		re, err := compileRoutePattern(rw.Match)
+		if err != nil {
+			return fmt.Errorf("rewrite %d: %v", i, err)
+		}
+		rw.re = re
+	}
+	return nil
+}
+
+// rewriteObject maps the object path of a request to an object name. Regex
+// rules are tried first, in order, and the first one matching is applied.
+// Otherwise the prefix rewrite with the longest matching strip prefix is
+// applied, if any. If the applied rule is a redirect, rewriteObject returns
+// the location and status code instead.
+func (rules *rules) rewriteObject(bucket, object string) (string, int) {
+	var match *rewrite
+	for i, rw := range rules.rewrites {
+		if rw.Bucket != "" && rw.Bucket != bucket {
+			continue
+		}
+		if rw.re != nil {
+			m := rw.re.FindStringSubmatchIndex(object)
+			if m == nil {
+				continue
+			}
+			return string(rw.re.ExpandString(nil, rw.To, object, m)), rw.Redirect
+		}
+		if !strings.HasPrefix(object, rw.Strip) {
+			continue
+		}
+		if match == nil || len(rw.Strip) > len(match.Strip) {
+			match = &rules.rewrites[i]
+		}
+	}
+	if match == nil {
+		return object, 0
+	}
+	return match.Prepend + strings.TrimPrefix(object, match.Strip), 0
+}
+
+// redirect sends the client to location, keeping the query string of the
+// request unless location has one.
+func redirect(w http.ResponseWriter, r *http.Request, location string, status int) {
+	if r.URL.RawQuery != "" && !strings.Contains(location, "?") {
+		location += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, location, status)
+}
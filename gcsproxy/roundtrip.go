@@ -0,0 +1,41 @@
+package gcsproxy
+
+import "cloud.google.com/go/storage"
+
+// singleRoundtrip reports whether objects of the route are opened without
+// looking up their metadata first. The read only returns some of the
+// attributes, so this is the case with -single-roundtrip unless a setting
+// needs the others: -block-if, -pass-through, receipts, CSEK, replicas,
+// pre-compressed siblings, cold storage handling and signed URL redirects.
+func (s *server) singleRoundtrip(rules *rules, rt *route) bool {
+	if !s.singleRoundtripFlag || rules.blockIfKey != "" || s.receiptKey != nil || s.bucketKeys != nil || s.csekHeaders || s.signedRedirect > 0 {
+		return false
+	}
+	for key := range rules.passthrough {
+		if key != "" {
+			return false
+		}
+	}
+	if len(s.precompressedEncodings(rt)) > 0 {
+		return false
+	}
+	mode := s.coldStorageMode(rt)
+	return mode == "" || mode == "serve"
+}
+
+// readerAttrs returns the attributes of the object known from its reader.
+// Metadata, Content-Language, Content-Disposition, the storage class and
+// checksums are missing.
+func readerAttrs(bucket, object string, objr *storage.Reader) *storage.ObjectAttrs {
+	return &storage.ObjectAttrs{
+		Bucket:          bucket,
+		Name:            object,
+		ContentType:     objr.Attrs.ContentType,
+		ContentEncoding: objr.Attrs.ContentEncoding,
+		CacheControl:    objr.Attrs.CacheControl,
+		Updated:         objr.Attrs.LastModified,
+		Size:            objr.Attrs.Size,
+		Generation:      objr.Attrs.Generation,
+		Metageneration:  objr.Attrs.Metageneration,
+	}
+}
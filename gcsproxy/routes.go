@@ -0,0 +1,197 @@
+package gcsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+)
+
+// Limits on route patterns. Go regexps run in linear time, so these bound
+// the size of the compiled program rather than guard against backtracking.
+const (
+	maxRoutePatternLen  = 1024
+	maxRoutePatternInst = 2000
+)
+
+// route is an entry of the routes section of the config file. It covers the
+// objects of Bucket whose names start with Prefix and, if Pattern is set,
+// match it:
+//
+//	{"routes": [{"bucket": "assets", "prefix": "public/", "pattern": "\\.(css|js)$"}]}
+//
+// With -strict only objects covered by a route are served. Routes may also
+// carry settings for the objects they cover.
+type route struct {
+	Bucket  string `json:"bucket"`
+	Prefix  string `json:"prefix,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	// Preload lists resources announced in Link headers, see preloadLinks.
+	Preload []string `json:"preload,omitempty"`
+	// Secure is "true" if the objects may only be served over TLS, or the
+	// minimum TLS version ("1.2").
+	Secure string `json:"secure,omitempty"`
+	// Fallback is served in place of objects that don't exist, see
+	// fallbackObject.
+	Fallback string `json:"fallback,omitempty"`
+	// Index is served for directory-style paths, see indexDocument.
+	Index string `json:"index,omitempty"`
+	// Autoindex enables or disables directory listings, see
+	// autoindexEnabled.
+	Autoindex *bool `json:"autoindex,omitempty"`
+	// Listing enables or disables ?list, see listingEnabled.
+	Listing *bool `json:"listing,omitempty"`
+	// NotFound is served as the body of 404 responses, see notFoundPage.
+	NotFound string `json:"notFound,omitempty"`
+	// ColdStorage sets how objects in cold storage classes are answered,
+	// see coldStorageMode.
+	ColdStorage string `json:"coldStorage,omitempty"`
+	// RedirectMinSize is the size from which objects are redirected to
+	// signed URLs, or -1 for never, see redirectMinSizeFor.
+	RedirectMinSize *int64 `json:"redirectMinSize,omitempty"`
+	// Claims must be present in the request's bearer token with these
+	// values, or contain them if they are lists, see checkClaims.
+	Claims map[string]string `json:"claims,omitempty"`
+	// OwnerPrefix, such as "users/{uid}/", is the prefix objects must have
+	// once the {name} placeholders are replaced by the claims of the
+	// request's token, see expandClaims.
+	OwnerPrefix string `json:"ownerPrefix,omitempty"`
+	// Precompressed lists the content codings of pre-compressed siblings
+	// to serve in place of objects, see precompressedEncodings.
+	Precompressed []string `json:"precompressed,omitempty"`
+	// ResponseBandwidth caps each response, in bytes per second such as
+	// "2M", see responseBandwidth.
+	ResponseBandwidth string `json:"responseBandwidth,omitempty"`
+	// FallbackBucket is tried when objects are missing or can't be read,
+	// see fallbackBucketFor.
+	FallbackBucket string `json:"fallbackBucket,omitempty"`
+	// Backend names the entry of the backends section the objects are
+	// read from instead of GCS, see backend.
+	Backend string `json:"backend,omitempty"`
+	// Upload allows POST uploads of the objects, see upload.
+	Upload *uploadConfig `json:"upload,omitempty"`
+	// Delete allows DELETE requests for the objects, see deleteObject.
+	Delete bool `json:"delete,omitempty"`
+
+	re           *regexp.Regexp
+	minTLS       uint16
+	responseRate float64
+	store        objectStore
+}
+
+// compileRoutes validates routes and compiles their patterns.
+func (s *server) compileRoutes(routes []route) error {
+	for i := range routes {
+		rt := &routes[i]
+		if rt.Bucket == "" {
+			return fmt.Errorf("route %d: bucket is required", i)
+		}
+		minTLS, err := parseSecureRequirement(rt.Secure)
+		if err != nil {
+			return fmt.Errorf("route %d: %v", i, err)
+		}
+		rt.minTLS = minTLS
+		if err := s.parseColdStorageMode(rt.ColdStorage); err != nil {
+			return fmt.Errorf("route %d: %v", i, err)
+		}
+		if err := parsePrecompressed(rt.Precompressed); err != nil {
+			return fmt.Errorf("route %d: %v", i, err)
+		}
+		if rt.responseRate, err = parseRate(rt.ResponseBandwidth); err != nil {
+			return fmt.Errorf("route %d: %v", i, err)
+		}
+		if rt.Upload != nil {
+			if err := rt.Upload.compile(); err != nil {
+				return fmt.Errorf("route %d: %v", i, err)
+			}
+		}
+		if rt.Pattern == "" {
+			continue
+		}
+		re, err := compileRoutePattern(rt.Pattern)
+		if err != nil {
+			return fmt.Errorf("route %d: %v", i, err)
+		}
+		rt.re = re
+	}
+	return nil
+}
+
+// compileRoutePattern compiles a route pattern, rejecting ones whose program
+// would make every request pay for an expensive match.
+func compileRoutePattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > maxRoutePatternLen {
+		return nil, fmt.Errorf("pattern is longer than %d bytes", maxRoutePatternLen)
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	if len(prog.Inst) > maxRoutePatternInst {
+		return nil, fmt.Errorf("pattern is too complex (%d instructions, at most %d allowed)", len(prog.Inst), maxRoutePatternInst)
+	}
+	return regexp.Compile(pattern)
+}
+
+// errRouteBudget is returned by matchRoute when route patterns took longer
+// than -route-match-budget to match.
+var errRouteBudget = errors.New("route matching exceeded -route-match-budget")
+
+// matchRoute returns the route with the longest prefix covering the object,
+// or nil if there is none. Once pattern matching for a request has taken
+// -route-match-budget, it gives up with errRouteBudget rather than settle
+// for a less specific route, whose settings may be laxer.
+func (s *server) matchRoute(rules *rules, bucket, object string) (*route, error) {
+	var match *route
+	var spent time.Duration
+	for i, rt := range rules.routes {
+		if rt.Bucket != bucket || !strings.HasPrefix(object, rt.Prefix) {
+			continue
+		}
+		if match != nil && len(rt.Prefix) <= len(match.Prefix) {
+			continue
+		}
+		if rt.re != nil {
+			if s.routeMatchBudget > 0 && spent >= s.routeMatchBudget {
+				s.routeStats.Add("budget_exceeded", 1)
+				return nil, errRouteBudget
+			}
+			start := time.Now()
+			ok := rt.re.MatchString(object)
+			d := time.Since(start)
+			spent += d
+			s.routeStats.Add("pattern_evaluations", 1)
+			s.routeStats.Add("pattern_nanoseconds", int64(d))
+			if !ok {
+				continue
+			}
+		}
+		match = &rules.routes[i]
+	}
+	if match != nil {
+		s.routeStats.Add("matched", 1)
+	} else {
+		s.routeStats.Add("unmatched", 1)
+	}
+	return match, nil
+}
+
+// checkRoute returns the object's route, answering with a 503 and
+// returning false if route matching exceeded its budget.
+func (s *server) checkRoute(w http.ResponseWriter, rules *rules, bucket, object string) (*route, bool) {
+	rt, err := s.matchRoute(rules, bucket, object)
+	if err != nil {
+		s.warnf("route-budget", "Failed to match routes for %s/%s: %v", bucket, object, err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return rt, true
+}
@@ -0,0 +1,90 @@
+package gcsproxy
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// reapZombies waits for any child processes that exit, as an init process
+// must: as PID 1 in a container, the proxy inherits orphans of processes
+// started by e.g. health checks run through docker exec.
+func reapZombies() {
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	for range sigchld {
+		for {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if pid <= 0 || err != nil {
+				break
+			}
+		}
+	}
+}
+
+// parseUmask parses an octal umask such as 027.
+func parseUmask(s string) (int, error) {
+	mask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("invalid umask %q, expected octal digits such as 027", s)
+	}
+	return int(mask), nil
+}
+
+// lookupUser resolves -user, a user name or uid, optionally followed by a
+// group name or gid (example: nobody:nogroup or 65534:65534). Without a
+// group, the user's primary group is used.
+func lookupUser(s string) (uid, gid int, err error) {
+	name, group, hasGroup := strings.Cut(s, ":")
+	if uid, err = strconv.Atoi(name); err != nil {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		if !hasGroup {
+			gid, _ = strconv.Atoi(u.Gid)
+			return uid, gid, nil
+		}
+	} else if !hasGroup {
+		if u, err := user.LookupId(name); err == nil {
+			gid, _ = strconv.Atoi(u.Gid)
+			return uid, gid, nil
+		}
+		return uid, uid, nil
+	}
+	if gid, err = strconv.Atoi(group); err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// dropPrivileges switches to the user and group of -user. It is called once
+// the listening socket is bound, so that the proxy can bind ports below 1024
+// without running as root afterwards.
+func (s *server) dropPrivileges(spec string) error {
+	uid, gid, err := lookupUser(spec)
+	if err != nil {
+		return fmt.Errorf("user %s: %v", spec, err)
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("dropping supplementary groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid %d: %v", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid %d: %v", uid, err)
+	}
+	s.logger.Printf("[service] running as uid %d, gid %d", uid, gid)
+	return nil
+}
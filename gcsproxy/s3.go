@@ -0,0 +1,184 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// s3Store reads objects from an S3-compatible bucket (AWS, MinIO, ...) with
+// path-style requests, signed with AWS Signature Version 4 when the backend
+// has keys.
+type s3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+}
+
+func compileS3(b *backend) error {
+	if b.Region == "" {
+		b.Region = "us-east-1"
+	}
+	endpoint := b.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + b.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if (b.AccessKey == "") != (b.SecretKey == "") {
+		return fmt.Errorf("accessKey and secretKey must be given together")
+	}
+	secret, err := readBackendSecret(b.SecretKey)
+	if err != nil {
+		return fmt.Errorf("secretKey: %v", err)
+	}
+	b.open = func(bucket string) objectStore {
+		if b.Bucket != "" {
+			bucket = b.Bucket
+		}
+		return &s3Store{endpoint: u, region: b.Region, bucket: bucket, accessKey: b.AccessKey, secretKey: secret}
+	}
+	return nil
+}
+
+func (s *s3Store) Attrs(ctx context.Context, object string) (*storage.ObjectAttrs, error) {
+	resp, err := s.do(ctx, "HEAD", object)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	h := resp.Header
+	attr := &storage.ObjectAttrs{
+		Name:               object,
+		ContentType:        h.Get("Content-Type"),
+		ContentLanguage:    h.Get("Content-Language"),
+		CacheControl:       h.Get("Cache-Control"),
+		ContentEncoding:    h.Get("Content-Encoding"),
+		ContentDisposition: h.Get("Content-Disposition"),
+		Etag:               h.Get("ETag"),
+		StorageClass:       h.Get("X-Amz-Storage-Class"),
+		Metadata:           prefixedHeaders(h, "X-Amz-Meta-"),
+	}
+	attr.Size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	attr.Updated, _ = http.ParseTime(h.Get("Last-Modified"))
+	return attr, nil
+}
+
+func (s *s3Store) Open(ctx context.Context, object string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, "GET", object)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// do sends a request for the object, mapping 404s to
+// storage.ErrObjectNotExist and other failures to errors.
+func (s *s3Store) do(ctx context.Context, method, object string) (*http.Response, error) {
+	u := *s.endpoint
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + escapeObject(s.bucket) + "/" + escapeObject(object)
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.accessKey != "" {
+		s.sign(req, time.Now().UTC())
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, storage.ErrObjectNotExist
+	}
+	return nil, fmt.Errorf("s3: %s %s/%s: %s", method, s.bucket, object, resp.Status)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, which
+// has no body.
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payload,
+		"x-amz-date:" + stamp,
+		"",
+		signed,
+		payload,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// escapeObject escapes an object name for the S3 and Azure backends: all but
+// unreserved characters and slashes are percent-encoded, as SigV4 expects.
+func escapeObject(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// prefixedHeaders returns the headers starting with prefix, without it and
+// with lower-cased names, as S3 and Azure return user metadata.
+func prefixedHeaders(h http.Header, prefix string) map[string]string {
+	var m map[string]string
+	for k, v := range h {
+		if len(v) == 0 || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if m == nil {
+			m = make(map[string]string)
+		}
+		m[strings.ToLower(strings.TrimPrefix(k, prefix))] = v[0]
+	}
+	return m
+}
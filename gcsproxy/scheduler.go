@@ -0,0 +1,378 @@
+package gcsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// jobConfig is an entry of the jobs section of the config file:
+//
+//	{"name": "nightly-index", "kind": "refresh-index", "schedule": "30 2 * * *"}
+//
+// The schedule is either a five-field cron expression (minute, hour, day of
+// month, month, day of week) or one of @every <duration>, @hourly and @daily.
+type jobConfig struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`
+	Schedule string   `json:"schedule"`
+	Targets  []string `json:"targets,omitempty"`
+}
+
+// jobKinds builds the function run by a job of each kind for the proxy.
+var jobKinds = map[string]func(s *server, cfg jobConfig) (func(ctx context.Context) error, error){
+	// Rebuilds the search index (see -index).
+	"refresh-index": func(s *server, cfg jobConfig) (func(ctx context.Context) error, error) {
+		roots := parseIndexRoots(s.indexRoots)
+		if len(roots) == 0 {
+			return nil, fmt.Errorf("refresh-index needs -index")
+		}
+		return func(ctx context.Context) error {
+			return s.objectIndex.refresh(ctx, s.storageClient(), roots)
+		}, nil
+	},
+	// Drops expired ext_authz decisions, version listings, warning
+	// counters, one-time links, group memberships and idle rate limits.
+	"sweep-caches": func(s *server, cfg jobConfig) (func(ctx context.Context) error, error) {
+		return func(ctx context.Context) error {
+			n := s.extAuthzCache.sweep() + s.versionCache.sweep() + s.warnings.sweep() + s.usedLinks.sweep() + s.groupCache.sweep() + s.clientLimits.sweep()
+			if s.verbose {
+				s.logger.Printf("[jobs] %s: swept %d cache entries", cfg.Name, n)
+			}
+			return nil
+		}, nil
+	},
+	// Writes the access counts per prefix since the last export to the
+	// target (<bucket>/<prefix>), for tuning lifecycle rules.
+	"export-access": func(s *server, cfg jobConfig) (func(ctx context.Context) error, error) {
+		if s.accessStatsDepth <= 0 {
+			return nil, fmt.Errorf("export-access needs -access-stats-depth")
+		}
+		if len(cfg.Targets) != 1 {
+			return nil, fmt.Errorf("export-access needs one target, <bucket>/<prefix>")
+		}
+		parts := strings.SplitN(cfg.Targets[0], "/", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid target %q, expected <bucket>/<prefix>", cfg.Targets[0])
+		}
+		parts = append(parts, "")
+		return func(ctx context.Context) error {
+			return s.exportAccess(ctx, parts[0], parts[1])
+		}, nil
+	},
+	// Loads the version listings of the target objects (<bucket>/<object>)
+	// so that ?asof= reads of them don't have to list versions first.
+	"warm-versions": func(s *server, cfg jobConfig) (func(ctx context.Context) error, error) {
+		if s.asofCacheTTL <= 0 {
+			return nil, fmt.Errorf("warm-versions needs -asof-cache-ttl")
+		}
+		var targets [][2]string
+		for _, t := range cfg.Targets {
+			parts := strings.SplitN(t, "/", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("invalid target %q, expected <bucket>/<object>", t)
+			}
+			targets = append(targets, [2]string{parts[0], parts[1]})
+		}
+		return func(ctx context.Context) error {
+			for _, t := range targets {
+				s.versionCache.drop(t[0] + "/" + t[1])
+				if _, err := s.listVersions(ctx, t[0], t[1]); err != nil {
+					return fmt.Errorf("%s/%s: %v", t[0], t[1], err)
+				}
+			}
+			return nil
+		}, nil
+	},
+}
+
+type job struct {
+	cfg   jobConfig
+	sched schedule
+	run   func(ctx context.Context) error
+	// logger receives the job's failures.
+	logger Logger
+
+	mu     sync.Mutex
+	status jobStatus
+}
+
+type jobStatus struct {
+	Name         string    `json:"name"`
+	Kind         string    `json:"kind"`
+	Schedule     string    `json:"schedule"`
+	Running      bool      `json:"running"`
+	Runs         int       `json:"runs"`
+	Failures     int       `json:"failures"`
+	LastRun      time.Time `json:"lastRun,omitempty"`
+	LastDuration float64   `json:"lastDurationSeconds"`
+	LastError    string    `json:"lastError,omitempty"`
+	NextRun      time.Time `json:"nextRun"`
+}
+
+// newJobs validates the job configuration.
+func (s *server) newJobs(cfgs []jobConfig) ([]*job, error) {
+	var jobs []*job
+	names := make(map[string]bool)
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || names[cfg.Name] {
+			return nil, fmt.Errorf("job names must be unique and not empty: %q", cfg.Name)
+		}
+		names[cfg.Name] = true
+		kind, ok := jobKinds[cfg.Kind]
+		if !ok {
+			return nil, fmt.Errorf("job %s: unknown kind %q", cfg.Name, cfg.Kind)
+		}
+		sched, err := parseSchedule(cfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %v", cfg.Name, err)
+		}
+		run, err := kind(s, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %v", cfg.Name, err)
+		}
+		jobs = append(jobs, &job{
+			cfg:    cfg,
+			sched:  sched,
+			run:    run,
+			logger: s.logger,
+			status: jobStatus{Name: cfg.Name, Kind: cfg.Kind, Schedule: cfg.Schedule},
+		})
+	}
+	return jobs, nil
+}
+
+// startJobs validates the job configuration and schedules the jobs.
+func (s *server) startJobs(ctx context.Context, cfgs []jobConfig) error {
+	var err error
+	if s.jobs, err = s.newJobs(cfgs); err != nil {
+		return err
+	}
+	for _, j := range s.jobs {
+		go j.loop(ctx)
+	}
+	return nil
+}
+
+func (j *job) loop(ctx context.Context) {
+	for {
+		next := j.sched.next(time.Now())
+		j.mu.Lock()
+		j.status.NextRun = next
+		j.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		j.runOnce(ctx)
+	}
+}
+
+// runOnce runs the job unless it is still running. It returns false if the
+// run was skipped.
+func (j *job) runOnce(ctx context.Context) bool {
+	j.mu.Lock()
+	if j.status.Running {
+		j.mu.Unlock()
+		return false
+	}
+	j.status.Running = true
+	j.mu.Unlock()
+
+	start := time.Now()
+	err := j.run(ctx)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastRun = start
+	j.status.LastDuration = time.Since(start).Seconds()
+	j.status.LastError = ""
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+		j.logger.Printf("[jobs] %s failed: %v", j.cfg.Name, err)
+	}
+	return true
+}
+
+func (j *job) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// listJobs returns the status of all scheduled jobs.
+func (s *server) listJobs(w http.ResponseWriter, r *http.Request) {
+	statuses := []jobStatus{}
+	for _, j := range s.jobs {
+		statuses = append(statuses, j.snapshot())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// runJob runs a job immediately, in the background.
+func (s *server) runJob(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	for _, j := range s.jobs {
+		if j.cfg.Name != name {
+			continue
+		}
+		if j.snapshot().Running {
+			http.Error(w, "job is already running", http.StatusConflict)
+			return
+		}
+		go j.runOnce(ctx)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	http.Error(w, "no such job", http.StatusNotFound)
+}
+
+type schedule interface {
+	// next returns the first activation time after t.
+	next(t time.Time) time.Time
+}
+
+type everySchedule time.Duration
+
+func (s everySchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// cronSchedule holds the allowed values of each cron field as bit sets.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar record unrestricted day fields. If both day fields
+	// are restricted, a day matches if either of them does, as in cron(8).
+	domStar, dowStar bool
+}
+
+func parseSchedule(s string) (schedule, error) {
+	switch {
+	case strings.HasPrefix(s, "@every "):
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(s, "@every ")))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid schedule %q", s)
+		}
+		return everySchedule(d), nil
+	case s == "@hourly":
+		s = "0 * * * *"
+	case s == "@daily":
+		s = "0 0 * * *"
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected five fields", s)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", s, err)
+		}
+		sets[i] = set
+	}
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a comma-separated list of *, n, n-m, each optionally
+// followed by /step.
+func parseCronField(f string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng = part[:i]
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range in %q", part)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domStar && s.dowStar:
+		return true
+	case s.domStar:
+		return dow
+	case s.dowStar:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every valid expression matches at least once within a few years.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return limit
+}
@@ -0,0 +1,121 @@
+package gcsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	tests := []struct {
+		schedule string
+		from     string
+		want     string
+	}{
+		{"30 2 * * *", "2022-09-01 01:00", "2022-09-01 02:30"},
+		{"30 2 * * *", "2022-09-01 02:30", "2022-09-02 02:30"},
+		{"*/15 * * * *", "2022-09-01 10:07", "2022-09-01 10:15"},
+		{"0 9-17/4 * * *", "2022-09-01 14:00", "2022-09-01 17:00"},
+		{"0 0 1,15 * *", "2022-09-02 00:00", "2022-09-15 00:00"},
+		{"0 0 * * 0", "2022-09-01 00:00", "2022-09-04 00:00"}, // Sunday
+		{"0 0 31 * *", "2022-09-01 00:00", "2022-10-31 00:00"},
+		{"0 0 29 2 *", "2022-03-01 00:00", "2024-02-29 00:00"},
+		// With both day fields restricted, either matches.
+		{"0 0 13 * 5", "2022-09-01 00:00", "2022-09-02 00:00"},
+		{"@hourly", "2022-09-01 10:07", "2022-09-01 11:00"},
+		{"@daily", "2022-09-01 10:07", "2022-09-02 00:00"},
+		{"@every 1h30m", "2022-09-01 10:07", "2022-09-01 11:37"},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.schedule)
+		if err != nil {
+			t.Errorf("%q: %v", tt.schedule, err)
+			continue
+		}
+		want := at(tt.want)
+		if got := s.next(at(tt.from)); !got.Equal(want) {
+			t.Errorf("%q after %s = %s, want %s", tt.schedule, tt.from, got, want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, schedule := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 7",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1- * * * *",
+		"@every",
+		"@every -1m",
+		"@weekly",
+	} {
+		if _, err := parseSchedule(schedule); err == nil {
+			t.Errorf("%q was accepted", schedule)
+		}
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	ran := make(chan struct{})
+	s := newServer()
+	s.jobs = []*job{{
+		cfg:    jobConfig{Name: "sweep", Kind: "sweep-caches", Schedule: "@daily"},
+		sched:  everySchedule(24 * time.Hour),
+		run:    func(ctx context.Context) error { close(ran); return nil },
+		status: jobStatus{Name: "sweep", Kind: "sweep-caches", Schedule: "@daily"},
+	}}
+	r := mux.NewRouter()
+	r.HandleFunc("/-/jobs", s.listJobs).Methods("GET")
+	r.HandleFunc("/-/jobs/{name}/run", s.runJob).Methods("POST")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/-/jobs/sweep/run", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("run: status %d", w.Code)
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job didn't run")
+	}
+	// The status is updated once the run returns.
+	for deadline := time.Now().Add(5 * time.Second); s.jobs[0].snapshot().Runs == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/-/jobs", nil))
+	var statuses []jobStatus
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Name != "sweep" || statuses[0].Runs != 1 || statuses[0].LastError != "" {
+		t.Errorf("statuses = %+v", statuses)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/-/jobs/missing/run", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d", w.Code)
+	}
+}
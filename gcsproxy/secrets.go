@@ -0,0 +1,76 @@
+package gcsproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	secretManagerPrefix = "sm://"
+	secretManagerAPI    = "https://secretmanager.googleapis.com/v1/"
+	cloudPlatformScope  = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+var (
+	secretManagerOnce   sync.Once
+	secretManagerClient *http.Client
+	secretManagerErr    error
+)
+
+// isSecretRef reports whether ref names a Secret Manager secret rather than
+// a file.
+func isSecretRef(ref string) bool {
+	return strings.HasPrefix(ref, secretManagerPrefix)
+}
+
+// readSecret reads a file or, for references such as
+// sm://projects/<project>/secrets/<name>[/versions/<version>], a Secret
+// Manager secret version, by default the latest one.
+func readSecret(ctx context.Context, ref string) ([]byte, error) {
+	name := strings.TrimPrefix(ref, secretManagerPrefix)
+	if name == ref {
+		return os.ReadFile(ref)
+	}
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	secretManagerOnce.Do(func() {
+		secretManagerClient, secretManagerErr = google.DefaultClient(context.Background(), cloudPlatformScope)
+	})
+	if secretManagerErr != nil {
+		return nil, secretManagerErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", secretManagerAPI+name+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := secretManagerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", ref, resp.Status)
+	}
+	var version struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&version); err != nil {
+		return nil, fmt.Errorf("%s: %v", ref, err)
+	}
+	return base64.StdEncoding.DecodeString(version.Payload.Data)
+}
@@ -0,0 +1,110 @@
+package gcsproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// secureMetadataKey marks objects that must only be served over TLS. Its
+// value is "true" for any TLS version, or the minimum version ("1.2").
+const secureMetadataKey = "secure"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses versions written as 1.2, TLSv1.2 or TLS1.2.
+func parseTLSVersion(s string) (uint16, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "tls"), "v")
+	v, ok := tlsVersions[s]
+	return v, ok
+}
+
+// parseSecureRequirement parses the value of a route's secure setting or of
+// the secure metadata key into the minimum TLS version, 0 meaning plain
+// HTTP is fine.
+func parseSecureRequirement(s string) (uint16, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "false":
+		return 0, nil
+	case "true":
+		return tls.VersionTLS10, nil
+	}
+	if v, ok := parseTLSVersion(s); ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("invalid secure setting %q: want true, false or a TLS version", s)
+}
+
+// requestTLSVersion returns the TLS version the client connected with, or 0
+// for plain HTTP. Behind a trusted proxy that terminates TLS, the request
+// counts as secure if the proxy sets X-Forwarded-Proto: https, and the
+// version is taken from -tls-version-header; without that header the
+// version is assumed to be the oldest one.
+func (s *server) requestTLSVersion(r *http.Request) uint16 {
+	if r.TLS != nil {
+		return r.TLS.Version
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !s.isTrustedProxy(ip) || !strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		return 0
+	}
+	if s.tlsVersionHeader != "" {
+		if v, ok := parseTLSVersion(r.Header.Get(s.tlsVersionHeader)); ok {
+			return v
+		}
+	}
+	return tls.VersionTLS10
+}
+
+// objectMinTLS returns the minimum TLS version the object's metadata
+// requires. Objects with an invalid setting are treated as requiring the
+// newest version rather than none.
+func (s *server) objectMinTLS(attr *storage.ObjectAttrs) uint16 {
+	v, err := parseSecureRequirement(attr.Metadata[secureMetadataKey])
+	if err != nil {
+		s.warnf("secure:"+attr.Bucket+"/"+attr.Name, "Object %s/%s: %v", attr.Bucket, attr.Name, err)
+		return tls.VersionTLS13
+	}
+	return v
+}
+
+// checkTransport refuses the request with a 403 if it didn't arrive over
+// TLS of at least version min.
+func (s *server) checkTransport(w http.ResponseWriter, r *http.Request, min uint16) bool {
+	if min == 0 {
+		return true
+	}
+	v := s.requestTLSVersion(r)
+	if v == 0 {
+		http.Error(w, "HTTPS required", http.StatusForbidden)
+		return false
+	}
+	if v < min {
+		http.Error(w, fmt.Sprintf("TLS %s or later required", tlsVersionName(min)), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func tlsVersionName(v uint16) string {
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
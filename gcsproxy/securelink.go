@@ -0,0 +1,247 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// loadSecureLinkKey reads the secret signing links. Surrounding whitespace
+// is ignored, so the file may end in a newline.
+func loadSecureLinkKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) < 16 {
+		return nil, fmt.Errorf("%s: the secret must be at least 16 bytes", path)
+	}
+	return key, nil
+}
+
+// signLink returns the signature of a link to path valid until expires, in
+// virtual-host mode for the given host (as returned by requestHost). query
+// is the link's canonical query, see linkQuery; it is signed after the path
+// unless it is empty, so links without one sign just the path.
+func (s *server) signLink(key []byte, host, path, query string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d\n", expires)
+	if s.virtualHosts {
+		fmt.Fprintf(mac, "%s\n", host)
+	}
+	mac.Write([]byte(path))
+	if query != "" {
+		fmt.Fprintf(mac, "?%s", query)
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// linkQuery returns the canonical form of the query parameters a link
+// signs: all of them but expires, signature and the -api-key-param key,
+// sorted by name. Parameters such as ?generation= or ?list change what is
+// served, so a link can't be extended with them.
+func (s *server) linkQuery(q url.Values) string {
+	signed := make(url.Values, len(q))
+	for name, values := range q {
+		if name != "expires" && name != "signature" && (s.apiKeyParam == "" || name != s.apiKeyParam) {
+			signed[name] = values
+		}
+	}
+	return signed.Encode()
+}
+
+// secureLinkQuery returns the query string of a link to path valid until
+// expires.
+func (s *server) secureLinkQuery(host, path string, expires time.Time) string {
+	return fmt.Sprintf("?expires=%d&signature=%s", expires.Unix(), s.signLink(s.secureLinkKey, host, path, "", expires.Unix()))
+}
+
+// checkSecureLink requires requests to carry a valid, unexpired signature in
+// the expires and signature query parameters when -secure-link-key is set,
+// in the manner of nginx's secure_link module. Invalid signatures get a 403,
+// expired (and, with -secure-link-once, used) links a 410.
+func (s *server) checkSecureLink(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.secureLinkKey == nil {
+			fn(w, r)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("signature") == "" && s.secureLinkCookie != "" {
+			switch valid, expired := s.checkLinkCookie(r); {
+			case valid && expired:
+				s.secureLinkStats.Add("expiredCookie", 1)
+				http.Error(w, "access expired", http.StatusGone)
+				return
+			case valid && cookieQueryProblem(q) != "":
+				s.secureLinkStats.Add("invalid", 1)
+				http.Error(w, cookieQueryProblem(q), http.StatusForbidden)
+				return
+			case valid:
+				s.secureLinkStats.Add("acceptedCookie", 1)
+				fn(w, r)
+				return
+			}
+		}
+		expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+		sig := q.Get("signature")
+		want := s.signLink(s.secureLinkKey, requestHost(r), r.URL.EscapedPath(), s.linkQuery(q), expires)
+		if err != nil || !hmac.Equal([]byte(sig), []byte(want)) {
+			s.secureLinkStats.Add("invalid", 1)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if time.Now().Unix() >= expires {
+			s.secureLinkStats.Add("expired", 1)
+			http.Error(w, "link expired", http.StatusGone)
+			return
+		}
+		if s.secureLinkOnce {
+			first, err := s.claimLink(r.Context(), sig, time.Unix(expires, 0))
+			if err != nil {
+				s.warnf("secure-link-store", "Failed to record use of a one-time link: %v", err)
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			if !first {
+				s.secureLinkStats.Add("reused", 1)
+				s.noticef("secure-link-reuse:"+r.URL.EscapedPath(), "One-time link for %s used again by %s", r.URL.EscapedPath(), s.clientIP(r))
+				http.Error(w, "link already used", http.StatusGone)
+				return
+			}
+		}
+		s.secureLinkStats.Add("accepted", 1)
+		fn(w, r)
+	}
+}
+
+// cookieQueryProblem returns why a request authorized by a signed cookie
+// can't have its query, or "". Cookies grant the objects under a prefix as
+// they are, not their past generations or listings.
+func cookieQueryProblem(q url.Values) string {
+	for _, name := range []string{"asof", "generation", "versions", "list"} {
+		if _, ok := q[name]; ok {
+			return fmt.Sprintf("?%s isn't available with a signed cookie", name)
+		}
+	}
+	return ""
+}
+
+// signLinkCookie returns the signature of a cookie granting access to the
+// paths starting with prefix until expires. The message starts with
+// "cookie" so that link signatures can't be passed off as cookies.
+func (s *server) signLinkCookie(key []byte, host, prefix string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "cookie\n%d\n", expires)
+	if s.virtualHosts {
+		fmt.Fprintf(mac, "%s\n", host)
+	}
+	mac.Write([]byte(prefix))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkLinkCookie checks the -secure-link-cookie cookie, whose value is
+// <expires>:<signature>:<prefix>, in the manner of CloudFront's signed
+// cookies: it grants access to all paths starting with the prefix, as they
+// appear in the URL. It reports whether the cookie is validly signed for the
+// request's path and whether it has expired.
+func (s *server) checkLinkCookie(r *http.Request) (valid, expired bool) {
+	cookie, err := r.Cookie(s.secureLinkCookie)
+	if err != nil {
+		return false, false
+	}
+	parts := strings.SplitN(cookie.Value, ":", 3)
+	if len(parts) != 3 {
+		return false, false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	prefix := parts[2]
+	want := s.signLinkCookie(s.secureLinkKey, requestHost(r), prefix, expires)
+	if err != nil || !hmac.Equal([]byte(parts[1]), []byte(want)) || !strings.HasPrefix(r.URL.EscapedPath(), prefix) {
+		return false, false
+	}
+	return true, time.Now().Unix() >= expires
+}
+
+// claimLink records the use of the one-time link with the given signature.
+// It returns false if the link was used before.
+func (s *server) claimLink(ctx context.Context, sig string, expires time.Time) (bool, error) {
+	sum := sha256.Sum256([]byte(sig))
+	id := hex.EncodeToString(sum[:])
+	if s.secureLinkStore == "" {
+		return s.usedLinks.claim(id, expires)
+	}
+	bucket, prefix, _ := strings.Cut(s.secureLinkStore, "/")
+	// The precondition makes GCS the arbiter between instances.
+	ow := s.storageClient().Bucket(bucket).Object(prefix + id).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	ow.Metadata = map[string]string{"expires": expires.UTC().Format(time.RFC3339)}
+	err := ow.Close()
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// errLinkSetFull is returned when more one-time links are in use than are
+// kept in memory; -secure-link-store has no such limit.
+var errLinkSetFull = errors.New("too many one-time links in use")
+
+// linkSet keeps the one-time links used until they expire.
+type linkSet struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func (s *linkSet) claim(id string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.used[id]; ok {
+		return false, nil
+	}
+	if len(s.used) >= maxCachedDecisions {
+		s.sweepLocked()
+		if len(s.used) >= maxCachedDecisions {
+			// Forgetting a link that hasn't expired would let it be used
+			// again, so no more links are accepted until some expire.
+			return false, errLinkSetFull
+		}
+	}
+	s.used[id] = expires
+	return true, nil
+}
+
+// sweep drops expired links, which can't be used anyway, and returns how
+// many were removed.
+func (s *linkSet) sweep() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sweepLocked()
+}
+
+func (s *linkSet) sweepLocked() int {
+	now := time.Now()
+	n := 0
+	for id, expires := range s.used {
+		if now.After(expires) {
+			delete(s.used, id)
+			n++
+		}
+	}
+	return n
+}
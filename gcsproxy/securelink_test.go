@@ -0,0 +1,120 @@
+package gcsproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLink returns path with the expires and signature parameters of a link
+// signed with key.
+func testLink(key, path string, expires time.Time) string {
+	e := fmt.Sprint(expires.Unix())
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(e + "\n" + path))
+	return path + "?expires=" + e + "&signature=" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func serveOK(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok")
+}
+
+func serveRequest(h http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+func TestSecureLinks(t *testing.T) {
+	const key = "a-secret-of-32-bytes-or-so-12345"
+	s := newServer()
+	s.secureLinkKey = []byte(key)
+	h := s.checkSecureLink(serveOK)
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"valid", testLink(key, "/assets/reports/q3.pdf", time.Now().Add(time.Hour)), http.StatusOK},
+		{"unsigned", "/assets/reports/q3.pdf", http.StatusForbidden},
+		{"expired", testLink(key, "/assets/reports/q3.pdf", time.Now().Add(-time.Minute)), http.StatusGone},
+		{"wrong key", testLink("guess", "/assets/reports/q3.pdf", time.Now().Add(time.Hour)), http.StatusForbidden},
+		{"other path", strings.Replace(testLink(key, "/assets/reports/q4.pdf", time.Now().Add(time.Hour)), "q4", "q3", 1), http.StatusForbidden},
+		{"extended", strings.Replace(testLink(key, "/assets/reports/q3.pdf", time.Now().Add(time.Hour)), "expires=", "expires=1", 1), http.StatusForbidden},
+		{"other generation", testLink(key, "/assets/reports/q3.pdf", time.Now().Add(time.Hour)) + "&generation=1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := serveRequest(h, tt.target); w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	// Without a key, links aren't checked.
+	s.secureLinkKey = nil
+	if w := serveRequest(h, "/assets/reports/q3.pdf"); w.Code != http.StatusOK {
+		t.Errorf("without -secure-link-key: status = %d", w.Code)
+	}
+}
+
+func TestLoadSecureLinkKey(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := dir + "/" + name
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	key, err := loadSecureLinkKey(write("key.txt", "a-secret-of-32-bytes-or-so-12345\n"))
+	if err != nil || string(key) != "a-secret-of-32-bytes-or-so-12345" {
+		t.Errorf("key = %q, %v", key, err)
+	}
+	if _, err := loadSecureLinkKey(write("short.txt", "secret\n")); err == nil {
+		t.Error("short key was accepted")
+	}
+}
+
+func TestOneTimeLinks(t *testing.T) {
+	const key = "a-secret-of-32-bytes-or-so-12345"
+	s := newServer()
+	s.secureLinkKey, s.secureLinkOnce = []byte(key), true
+	h := s.checkSecureLink(serveOK)
+
+	reused := func() int64 {
+		if v, ok := s.secureLinkStats.Get("reused").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := reused()
+	link := testLink(key, "/assets/reports/q3.pdf", time.Now().Add(time.Hour))
+	if w := serveRequest(h, link); w.Code != http.StatusOK {
+		t.Fatalf("first use: status = %d", w.Code)
+	}
+	if w := serveRequest(h, link); w.Code != http.StatusGone {
+		t.Errorf("second use: status = %d, want %d", w.Code, http.StatusGone)
+	}
+	if got := reused() - before; got != 1 {
+		t.Errorf("%d reuses counted, want 1", got)
+	}
+	// Other links are unaffected.
+	if w := serveRequest(h, testLink(key, "/assets/reports/q4.pdf", time.Now().Add(time.Hour))); w.Code != http.StatusOK {
+		t.Errorf("other link: status = %d", w.Code)
+	}
+
+	// Expired links are swept.
+	s.usedLinks.claim("old", time.Now().Add(-time.Second))
+	if n := s.usedLinks.sweep(); n != 1 {
+		t.Errorf("swept %d links, want 1", n)
+	}
+}
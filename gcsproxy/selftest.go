@@ -0,0 +1,183 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// selfTestTimeout bounds each request the self-test makes.
+const selfTestTimeout = 30 * time.Second
+
+// runSelfTest serves r on l and checks end to end that the proxy works: that
+// it accepts connections, completes a TLS handshake if it serves HTTPS,
+// serves the -canary object with the content stored in GCS and, if enabled,
+// answers on the admin endpoints. It reports like
+// "gcsproxy check" and returns the number of problems found.
+func (s *server) runSelfTest(l net.Listener, r *mux.Router) int {
+	problems := 0
+	report := func(what string, err error) {
+		if err != nil {
+			problems++
+			fmt.Printf("FAIL %s: %v\n", what, err)
+		} else {
+			fmt.Printf("ok   %s\n", what)
+		}
+	}
+	report("bind "+l.Addr().String(), nil)
+	go http.Serve(l, r)
+
+	c := s.selfTestClient(l.Addr().String())
+	base := "http://" + l.Addr().String()
+	if s.tlsCertDir != "" {
+		name := s.selfTestServerName()
+		c.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+			ServerName: name,
+			// This checks the proxy's handshake, not the certificate chain.
+			InsecureSkipVerify: true,
+		}
+		base = "https://" + l.Addr().String()
+		report("TLS handshake for "+name, selfTestHandshake(c, base))
+	}
+	if s.canary != "" {
+		report("read "+s.canary+" through the proxy", s.selfTestCanary(c, base))
+	} else {
+		fmt.Println("skip read through the proxy: no -canary object")
+	}
+	if s.adminToken != "" {
+		report("admin endpoints", s.selfTestAdmin(c, base))
+	}
+	if problems > 0 {
+		fmt.Printf("%d problem(s) found\n", problems)
+	}
+	return problems
+}
+
+// selfTestClient returns a client that connects to addr, sending a PROXY
+// protocol header first if the listener expects one.
+func (s *server) selfTestClient(addr string) *http.Client {
+	dialer := &net.Dialer{Timeout: selfTestTimeout}
+	return &http.Client{
+		Timeout: selfTestTimeout,
+		Transport: &http.Transport{
+			DisableCompression: true,
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil || !s.proxyProtocol {
+					return conn, err
+				}
+				if _, err := io.WriteString(conn, "PROXY UNKNOWN\r\n"); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return conn, nil
+			},
+		},
+	}
+}
+
+// selfTestServerName returns the server name the self-test sends in the TLS
+// handshake: -self-test-host, the host serving the canary in -vhost mode, or
+// localhost.
+func (s *server) selfTestServerName() string {
+	if s.selfTestHost != "" {
+		return s.selfTestHost
+	}
+	if parts := strings.SplitN(s.canary, "/", 2); s.virtualHosts && len(parts) == 2 {
+		if host, _, ok := s.activeRules().hosts.reverse(parts[0], parts[1]); ok {
+			return host
+		}
+	}
+	return "localhost"
+}
+
+func selfTestHandshake(c *http.Client, base string) error {
+	resp, err := c.Get(base + "/")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// selfTestCanary fetches the canary object through the proxy and compares
+// it with the object's attributes in GCS.
+func (s *server) selfTestCanary(c *http.Client, base string) error {
+	parts := strings.SplitN(s.canary, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("-canary must be <bucket>/<object>")
+	}
+	bucket, object := parts[0], parts[1]
+	attr, err := s.storageClient().Bucket(bucket).Object(object).Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("reading from GCS: %v", err)
+	}
+
+	path, host := "/"+bucket+"/"+object, ""
+	switch {
+	case s.singleBucket != "":
+		path = "/" + object
+	case s.virtualHosts:
+		var ok bool
+		if host, path, ok = s.activeRules().hosts.reverse(bucket, object); !ok {
+			return fmt.Errorf("no host in the hosts section serves %s", s.canary)
+		}
+		path = "/" + path
+	}
+	u := base + (&url.URL{Path: path}).EscapedPath()
+	if s.secureLinkKey != nil {
+		u += s.secureLinkQuery(host, (&url.URL{Path: path}).EscapedPath(), time.Now().Add(time.Minute))
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if host != "" {
+		req.Host = host
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got %s", resp.Status)
+	}
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	n, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return err
+	}
+	// Compressed objects may be transcoded, so only plain ones can be
+	// compared byte for byte.
+	if attr.ContentEncoding == "" && (n != attr.Size || h.Sum32() != attr.CRC32C) {
+		return fmt.Errorf("content differs from GCS (%d bytes, crc32c %08x; want %d bytes, crc32c %08x)", n, h.Sum32(), attr.Size, attr.CRC32C)
+	}
+	return nil
+}
+
+func (s *server) selfTestAdmin(c *http.Client, base string) error {
+	req, err := http.NewRequest("GET", base+adminPrefix+"version", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.adminToken)
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"expvar"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// server is one proxy: its options, the state derived from them, and its
+// caches and metrics. Main and each call to New create their own.
+type server struct {
+	*options
+
+	// ctx is done when the proxy is closed, which stops its background
+	// work; cancel closes it.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// reloadOnHUP has the config file, credentials, htpasswd file and API
+	// keys reloaded on SIGHUP.
+	reloadOnHUP bool
+
+	accessLogFormat []logSegment
+	// accessLogger receives the access log lines, see setupAccessLog.
+	accessLogger Logger
+
+	// accessStats counts the requests for objects since the last export.
+	accessStats *accessCounter
+
+	// apiKeys holds the keys of -api-keys by the SHA-256 of the key, as
+	// map[[sha256.Size]byte]*apiKey, or nil.
+	apiKeys atomic.Value
+
+	versionCache *versionListCache
+
+	// htpasswdUsers holds the users of -htpasswd, as map[string]string from
+	// user name to password hash, or nil.
+	htpasswdUsers atomic.Value
+
+	// breakerStats reports whether GCS is considered unavailable ("open" is 1
+	// while the breaker is open), how often the breaker tripped and how many
+	// requests it turned away, under /-/metrics.
+	breakerStats *expvar.Map
+	gcsBreaker   *circuitBreaker
+
+	// allowedBuckets and deniedBuckets are the patterns of -allow-buckets and
+	// -deny-buckets.
+	allowedBuckets, deniedBuckets   []string
+	allowedPrefixes, deniedPrefixes []prefixRule
+
+	canaryStatus *canaryMonitor
+
+	// trustedProxies holds the networks whose X-Forwarded-For entries are
+	// believed, parsed from -trusted-proxies.
+	trustedProxies []*net.IPNet
+
+	// restores tracks the copies to -restore-bucket in progress, so that
+	// repeated requests don't start more.
+	restores *restoreSet
+
+	// concurrencyStats reports the requests being served and waiting under
+	// /-/metrics, and counts those turned away.
+	concurrencyStats *expvar.Map
+	// readSlots has a slot for each request that may be served at once,
+	// or is nil without -max-concurrent.
+	readSlots chan struct{}
+	// queued is the number of requests waiting for a slot.
+	queued int64
+
+	currentRules atomic.Value
+	// pinnedFlags were set on the command line or through the environment and
+	// can't be changed by the config file.
+	pinnedFlags map[string]bool
+
+	currentClient atomic.Value
+
+	// bucketKeys are the customer-supplied encryption keys of -csek-keys by
+	// bucket.
+	bucketKeys map[string][]byte
+
+	dlpStats *expvar.Map
+
+	// egressStats counts the bytes served per bucket, and the requests refused
+	// for exceeding a quota, under /-/metrics.
+	egressStats *expvar.Map
+	// egress counts the bytes served per bucket in the current UTC day and
+	// month.
+	egress *egressCounter
+
+	// nameStats counts requests rejected because of their object name under
+	// /-/metrics.
+	nameStats *expvar.Map
+
+	// recipientKeys are the keys of -encryption-keys, by recipient.
+	recipientKeys map[string][]byte
+
+	extAuthzCache *decisionCache
+	// extAuthzForward are the headers forwarded to the authorization
+	// service and extAuthzInjected those copied from its responses, see
+	// extAuthzHeaderNames and -ext-authz-inject.
+	extAuthzForward  []string
+	extAuthzInjected []string
+
+	// extAuthzConn is the connection to a gRPC authorization service, set when
+	// -ext-authz is a grpc:// or grpcs:// URL.
+	extAuthzConn *grpc.ClientConn
+
+	// fallbackStats counts the objects served from fallback buckets, by the
+	// bucket they were requested from, under /-/metrics.
+	fallbackStats *expvar.Map
+
+	frozenBuckets *freezeTable
+
+	logger Logger
+	// metrics are the variables served under /-/metrics, in the order they
+	// were published.
+	metrics []metric
+
+	// headerNames maps canonical header keys to the exact spelling written on
+	// the wire, parsed from -header-names.
+	headerNames map[string]string
+
+	// hooks are those of the Config given to New.
+	hooks Hooks
+
+	// googleVerifier verifies Google ID tokens when -google-audience is set,
+	// iapVerifier IAP assertions when -iap-audience is.
+	googleVerifier *jwtVerifier
+	iapVerifier    *jwtVerifier
+	groupCache     *decisionCache
+	groupLookup    *groupNames
+	// allowedDomainList and allowedGroupList are -allowed-domains and
+	// -allowed-groups.
+	allowedDomainList []string
+	allowedGroupList  []string
+
+	objectIndex *searchIndex
+
+	// bearerVerifier verifies the -jwt-jwks tokens, or is nil.
+	bearerVerifier *jwtVerifier
+
+	// defaultPrecompressed is -precompressed.
+	defaultPrecompressed []string
+
+	// rateLimitStats counts the requests turned away by -rate-limit under
+	// /-/metrics.
+	rateLimitStats *expvar.Map
+	// clientLimits holds the -rate-limit bucket of each client.
+	clientLimits *clientLimiter
+
+	warnings *logLimiter
+
+	// readAheadSize is -read-ahead.
+	readAheadSize int64
+
+	// receiptKey signs delivery receipts when -receipt-key is set.
+	receiptKey ed25519.PrivateKey
+
+	// replicaStats counts failovers between replicas, and publishes the health
+	// of each replica under /-/metrics.
+	replicaStats  *expvar.Map
+	replicaHealth *healthTracker
+
+	// retryStats counts the GCS calls retried, and those that failed after
+	// -gcs-max-attempts, under /-/metrics.
+	retryStats *expvar.Map
+	// retryCodes are the HTTP statuses of GCS errors that are retried, from
+	// -gcs-retry-codes.
+	retryCodes map[int]bool
+
+	// routeStats reports the cost of route matching under /-/metrics.
+	routeStats *expvar.Map
+
+	// jobs are the scheduled jobs, in config order.
+	jobs []*job
+
+	// secureLinkKey is the secret of -secure-link-key, or nil.
+	secureLinkKey []byte
+	// secureLinkStats counts the outcomes of signed link checks under
+	// /-/metrics.
+	secureLinkStats *expvar.Map
+	// usedLinks records the one-time links that were used, when they aren't
+	// recorded in -secure-link-store.
+	usedLinks *linkSet
+
+	// redirectStats counts the responses proxied and redirected, and their
+	// bytes, while -signed-redirect is set.
+	redirectStats *expvar.Map
+
+	// parallelThreshold and sliceSize are -parallel-threshold and
+	// -parallel-slice-size.
+	parallelThreshold, sliceSize int64
+
+	// copyBufferSize is -copy-buffer, and copyBuffers holds buffers of that
+	// size for copyBody.
+	copyBufferSize int
+	copyBuffers    sync.Pool
+
+	// globalBandwidth is the -bandwidth cap shared by responses no bandwidth
+	// window applies to, or nil.
+	globalBandwidth *tokenBucket
+	// responseRate is the -response-bandwidth cap of each response, in bytes
+	// per second, or 0.
+	responseRate float64
+
+	// federatedSigner is the service account that signs URLs when the proxy's
+	// credentials are a federation configuration that impersonates one.
+	federatedSigner string
+}
+
+// newServer returns a proxy with the default options, which are set from
+// the command line by Main and from Config by New before setup.
+func newServer() *server {
+	s := &server{options: newOptions()}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.accessStats = newAccessCounter()
+	s.versionCache = &versionListCache{entries: make(map[string]*versionList)}
+	s.breakerStats = s.newStatsMap("gcsUnavailable")
+	s.gcsBreaker = &circuitBreaker{}
+	s.canaryStatus = &canaryMonitor{}
+	s.restores = &restoreSet{pending: make(map[string]bool)}
+	s.concurrencyStats = s.newStatsMap("concurrency")
+	s.dlpStats = s.newStatsMap("dlp")
+	s.egressStats = s.newStatsMap("egress")
+	s.egress = &egressCounter{buckets: make(map[string]*bucketEgress)}
+	s.nameStats = s.newStatsMap("objectNames")
+	s.extAuthzCache = &decisionCache{entries: make(map[string]*decision)}
+	s.fallbackStats = s.newStatsMap("fallbackBucket")
+	s.frozenBuckets = &freezeTable{modes: make(map[string]string)}
+	s.logger = log.Default()
+	s.groupCache = &decisionCache{entries: make(map[string]*decision)}
+	s.groupLookup = &groupNames{names: make(map[string]string)}
+	s.objectIndex = &searchIndex{}
+	s.rateLimitStats = s.newStatsMap("rateLimit")
+	s.clientLimits = &clientLimiter{buckets: make(map[string]*tokenBucket)}
+	s.warnings = &logLimiter{entries: make(map[string]*logWindow)}
+	s.replicaStats = s.newStatsMap("replicas")
+	s.replicaHealth = &healthTracker{buckets: make(map[string]*bucketHealth)}
+	s.retryStats = s.newStatsMap("gcsRetries")
+	s.routeStats = s.newStatsMap("routes")
+	s.secureLinkStats = s.newStatsMap("secureLink")
+	s.usedLinks = &linkSet{used: make(map[string]time.Time)}
+	s.redirectStats = s.newStatsMap("signedRedirect")
+	s.publishMetric("canary", expvar.Func(func() interface{} {
+		return s.canaryStatus.snapshot(s.canaryMaxLatency, s.canaryMaxAge)
+	}))
+	s.replicaStats.Set("health", expvar.Func(func() interface{} { return s.replicaHealth.snapshot() }))
+	return s
+}
+
+// hangups returns a channel receiving SIGHUP if the proxy reloads on it, or
+// else nil. It is called before starting the watcher that reads it, so that
+// no signal sent after setup is missed; the watcher stops it with
+// signal.Stop.
+func (s *server) hangups() chan os.Signal {
+	if !s.reloadOnHUP {
+		return nil
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	return hup
+}
+
+// ticks returns a channel receiving every interval if it is positive, or a
+// nil channel, and the function that stops the ticker.
+func ticks(interval time.Duration) (<-chan time.Time, func()) {
+	if interval <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(interval)
+	return t.C, t.Stop
+}
@@ -0,0 +1,128 @@
+package gcsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// maxSignedURLTTL is the longest lifetime GCS accepts for V4 signed URLs.
+const maxSignedURLTTL = 7 * 24 * time.Hour
+
+// signRequest is the body of POST /-/sign.
+type signRequest struct {
+	Bucket string `json:"bucket"`
+	Object string `json:"object"`
+	// Method is GET (the default), HEAD or PUT.
+	Method string `json:"method,omitempty"`
+	// TTL is how long the URL is valid, as a duration such as "15m".
+	TTL string `json:"ttl,omitempty"`
+	// ContentType, MD5 and MaxSize constrain uploads: the client must send
+	// this Content-Type and Content-MD5 (base64), and no more than MaxSize
+	// bytes.
+	ContentType string `json:"contentType,omitempty"`
+	MD5         string `json:"md5,omitempty"`
+	MaxSize     int64  `json:"maxSize,omitempty"`
+}
+
+type signResponse struct {
+	URL     string    `json:"url"`
+	Method  string    `json:"method"`
+	Expires time.Time `json:"expires"`
+	// Headers must be sent with the request as given.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// signURL returns a V4 signed URL for an object, so that backends can hand
+// out links without holding GCS credentials themselves. The bucket and
+// object must be ones the proxy serves.
+func (s *server) signURL(w http.ResponseWriter, r *http.Request) {
+	var req signRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Bucket == "" || req.Object == "" {
+		http.Error(w, "bucket and object are required", http.StatusBadRequest)
+		return
+	}
+	if !s.bucketAllowed(req.Bucket) || !s.objectAllowed(req.Bucket, req.Object) {
+		http.Error(w, "object isn't served by the proxy", http.StatusForbidden)
+		return
+	}
+	if req.Method == "" {
+		req.Method = http.MethodGet
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && req.Method != http.MethodPut {
+		http.Error(w, "method must be GET, HEAD or PUT", http.StatusBadRequest)
+		return
+	}
+	if req.Method != http.MethodPut && (req.ContentType != "" || req.MD5 != "" || req.MaxSize != 0) {
+		http.Error(w, "contentType, md5 and maxSize only apply to PUT", http.StatusBadRequest)
+		return
+	}
+	ttl := s.signDefaultTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl %q", req.TTL), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	if ttl > s.signMaxTTL || ttl > maxSignedURLTTL {
+		http.Error(w, fmt.Sprintf("ttl may be at most %v", minDuration(s.signMaxTTL, maxSignedURLTTL)), http.StatusBadRequest)
+		return
+	}
+	if !s.checkFrozen(w, req.Bucket, req.Method != http.MethodPut) {
+		return
+	}
+
+	resp := signResponse{Method: req.Method, Expires: time.Now().Add(ttl).UTC().Truncate(time.Second)}
+	opts := &storage.SignedURLOptions{
+		Method:      req.Method,
+		Expires:     resp.Expires,
+		Scheme:      storage.SigningSchemeV4,
+		ContentType: req.ContentType,
+		MD5:         req.MD5,
+		// Signed with the IAM API if set.
+		GoogleAccessID: s.signingAccount(req.Bucket, req.Object),
+	}
+	if req.ContentType != "" || req.MD5 != "" || req.MaxSize > 0 {
+		resp.Headers = make(map[string]string)
+		setMapValue(resp.Headers, "Content-Type", req.ContentType)
+		setMapValue(resp.Headers, "Content-MD5", req.MD5)
+	}
+	if req.MaxSize > 0 {
+		limit := "0," + strconv.FormatInt(req.MaxSize, 10)
+		opts.Headers = []string{"x-goog-content-length-range:" + limit}
+		resp.Headers["X-Goog-Content-Length-Range"] = limit
+	}
+	u, err := s.bucketHandle(req.Bucket, req.Object).SignedURL(req.Object, opts)
+	if err != nil {
+		s.warnf("signed-url", "Failed to sign URL for %s/%s: %v", req.Bucket, req.Object, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp.URL = u
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func setMapValue(m map[string]string, key, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
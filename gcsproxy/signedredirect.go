@@ -0,0 +1,70 @@
+package gcsproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// redirectMinSizeFor returns the size from which objects covered by rt are
+// redirected. A route's redirectMinSize takes precedence over
+// -signed-redirect-min-size.
+func (s *server) redirectMinSizeFor(rt *route) int64 {
+	if rt != nil && rt.RedirectMinSize != nil {
+		return *rt.RedirectMinSize
+	}
+	return s.redirectMinSize
+}
+
+// redirectable reports whether a response for the object may be replaced by
+// a redirect to a signed URL with -signed-redirect. Responses the proxy
+// transforms or signs itself must still go through it.
+func (s *server) redirectable(rules *rules, rt *route, ew *encryptingWriter, attr *storage.ObjectAttrs) bool {
+	if s.signedRedirect <= 0 {
+		return false
+	}
+	ok := true
+	switch threshold := s.redirectMinSizeFor(rt); {
+	case threshold < 0 || attr.Size < threshold:
+		ok = false
+	case ew != nil || s.receiptKey != nil || attr.CustomerKeySHA256 != "":
+		ok = false
+	case len(rules.dlp) > 0 && inspectable(attr.ContentType, attr.ContentEncoding):
+		ok = false
+	}
+	if ok {
+		s.redirectStats.Add("redirected", 1)
+		s.redirectStats.Add("redirectedBytes", attr.Size)
+	} else {
+		s.redirectStats.Add("proxied", 1)
+		s.redirectStats.Add("proxiedBytes", attr.Size)
+	}
+	return ok
+}
+
+// redirectSigned redirects the client to a V4 signed URL for the generation
+// of the object that was checked, so the body flows directly from GCS.
+func (s *server) redirectSigned(w http.ResponseWriter, r *http.Request, obj *storage.ObjectHandle, attr *storage.ObjectAttrs) {
+	opts := &storage.SignedURLOptions{
+		Method:  r.Method,
+		Expires: time.Now().Add(s.signedRedirect),
+		Scheme:  storage.SigningSchemeV4,
+		// Signed with the IAM API if set.
+		GoogleAccessID: s.signingAccount(obj.BucketName(), obj.ObjectName()),
+	}
+	// A restored copy (see serveCold) has generations of its own.
+	if obj.BucketName() == attr.Bucket && obj.ObjectName() == attr.Name {
+		opts.QueryParameters = url.Values{"generation": {strconv.FormatInt(attr.Generation, 10)}}
+	}
+	u, err := s.bucketHandle(obj.BucketName(), obj.ObjectName()).SignedURL(obj.ObjectName(), opts)
+	if err != nil {
+		s.warnf("signed-url", "Failed to sign URL for %s/%s: %v", obj.BucketName(), obj.ObjectName(), err)
+		s.handleError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u, http.StatusFound)
+}
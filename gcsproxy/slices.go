@@ -0,0 +1,150 @@
+package gcsproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+// parseReadFlags parses the sizes of parallel reads, -read-ahead and
+// -copy-buffer.
+func (s *server) parseReadFlags() error {
+	threshold, err := parseSize(s.parallelThresholdFlag)
+	if err != nil {
+		return err
+	}
+	size, err := parseSize(s.sliceSizeFlag)
+	if err != nil {
+		return err
+	}
+	if threshold > 0 && (size < 1<<20 || s.parallelSlices < 1) {
+		return errors.New("-parallel-slice-size must be at least 1M and -parallel-slices at least 1")
+	}
+	ahead, err := parseSize(s.readAheadFlag)
+	if err != nil {
+		return err
+	}
+	buf, err := parseSize(s.copyBufferFlag)
+	if err != nil {
+		return err
+	}
+	if buf < 1 {
+		return errors.New("-copy-buffer must be at least 1 byte")
+	}
+	s.copyBufferSize = int(buf)
+	s.parallelThreshold, s.sliceSize, s.readAheadSize = int64(threshold), int64(size), int64(ahead)
+	return nil
+}
+
+// openBody opens the object's content. Objects of at least
+// -parallel-threshold are read as slices of -parallel-slice-size, up to
+// -parallel-slices of them at a time, and stitched together in order.
+// Objects GCS transcodes can't be read in ranges and are read as a whole,
+// as are objects whose attributes aren't known yet (attr is nil).
+func (s *server) openBody(ctx context.Context, obj *storage.ObjectHandle, attr *storage.ObjectAttrs) (*storage.Reader, io.Reader, error) {
+	if attr == nil || s.parallelThreshold <= 0 || attr.Size < s.parallelThreshold || attr.ContentEncoding != "" {
+		objr, err := s.newReader(ctx, obj)
+		return objr, objr, err
+	}
+	objr, err := s.newRangeReader(ctx, obj, 0, s.sliceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Later slices must come from the same generation as the first.
+	obj = obj.Generation(objr.Attrs.Generation)
+	return objr, s.newSlicedReader(ctx, obj, objr, objr.Attrs.Size), nil
+}
+
+// newRangeReader opens part of the object, retrying transient errors.
+func (s *server) newRangeReader(ctx context.Context, obj *storage.ObjectHandle, offset, length int64) (objr *storage.Reader, err error) {
+	err = s.withRetries(ctx, func() error {
+		objr, err = obj.NewRangeReader(ctx, offset, length)
+		return err
+	})
+	return objr, err
+}
+
+// slice is the content of a slice, or the error reading it.
+type slice struct {
+	data []byte
+	err  error
+}
+
+// slicedReader reads the first slice from its reader and the others, which
+// are fetched in the background, from memory.
+type slicedReader struct {
+	cur     io.Reader
+	pending chan chan slice
+	err     error
+}
+
+func (s *server) newSlicedReader(ctx context.Context, obj *storage.ObjectHandle, first io.Reader, size int64) *slicedReader {
+	sr := &slicedReader{cur: first, pending: make(chan chan slice, s.parallelSlices-1)}
+	go s.fetchSlices(ctx, sr, obj, size)
+	return sr
+}
+
+// fetchSlices starts reading the slices after the first, stopping when as
+// many as -parallel-slices are waiting to be read or the context is done.
+func (s *server) fetchSlices(ctx context.Context, sr *slicedReader, obj *storage.ObjectHandle, size int64) {
+	defer close(sr.pending)
+	for off := s.sliceSize; off < size; off += s.sliceSize {
+		n := s.sliceSize
+		if size-off < n {
+			n = size - off
+		}
+		ch := make(chan slice, 1)
+		select {
+		case sr.pending <- ch:
+		case <-ctx.Done():
+			return
+		}
+		go func(off, n int64) {
+			data, err := s.readSlice(ctx, obj, off, n)
+			ch <- slice{data: data, err: err}
+		}(off, n)
+	}
+}
+
+// readSlice reads a slice of the object, retrying it as a whole if the read
+// fails.
+func (s *server) readSlice(ctx context.Context, obj *storage.ObjectHandle, offset, length int64) (data []byte, err error) {
+	err = s.withRetries(ctx, func() error {
+		r, err := obj.NewRangeReader(ctx, offset, length)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data = make([]byte, length)
+		_, err = io.ReadFull(r, data)
+		return err
+	})
+	return data, err
+}
+
+func (s *slicedReader) Read(p []byte) (int, error) {
+	for s.err == nil {
+		n, err := s.cur.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		ch, ok := <-s.pending
+		if !ok {
+			s.err = io.EOF
+			break
+		}
+		next := <-ch
+		if next.err != nil {
+			s.err = next.err
+			break
+		}
+		s.cur = bytes.NewReader(next.data)
+	}
+	return 0, s.err
+}
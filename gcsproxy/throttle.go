@@ -0,0 +1,334 @@
+package gcsproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the most a throttled reader reads at once, so that
+// responses sharing a cap take turns in small steps.
+const throttleChunk = 32 << 10
+
+// bandwidthWindow is an entry of the bandwidth section of the config file.
+// During the window, responses for objects under Prefix (<bucket>/<prefix>,
+// the bucket may contain wildcards) share a cap of Rate bytes per second:
+//
+//	{"bandwidth": [
+//	  {"name": "bulk-office-hours", "prefix": "downloads/bulk/", "days": "mon-fri", "from": "09:00", "to": "18:00", "rate": "5M"}
+//	]}
+//
+// Days is a comma-separated list of days or ranges of days (default every
+// day). From and To are local times; a window ending before it starts runs
+// over midnight, and one without either runs all day. Without Prefix, the
+// window applies to every object, and without Rate, its responses aren't
+// capped at all.
+type bandwidthWindow struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix,omitempty"`
+	Days   string `json:"days,omitempty"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Rate   string `json:"rate,omitempty"`
+
+	prefix   *prefixRule
+	days     [7]bool
+	from, to int // minutes after midnight
+	limit    *tokenBucket
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compileBandwidthWindows validates windows and creates their caps.
+func compileBandwidthWindows(windows []bandwidthWindow) error {
+	for i := range windows {
+		bw := &windows[i]
+		if bw.Name == "" {
+			bw.Name = strconv.Itoa(i)
+		}
+		if err := bw.compile(); err != nil {
+			return fmt.Errorf("bandwidth window %s: %v", bw.Name, err)
+		}
+	}
+	return nil
+}
+
+func (bw *bandwidthWindow) compile() error {
+	rate, err := parseRate(bw.Rate)
+	if err != nil {
+		return err
+	}
+	if rate > 0 {
+		bw.limit = newTokenBucket(rate)
+	}
+	if bw.Prefix != "" {
+		rules, err := parsePrefixRules(bw.Prefix)
+		if err != nil {
+			return err
+		}
+		bw.prefix = &rules[0]
+	}
+	if bw.days, err = parseDays(bw.Days); err != nil {
+		return err
+	}
+	if (bw.From == "") != (bw.To == "") {
+		return fmt.Errorf("from and to must be given together")
+	}
+	if bw.From != "" {
+		if bw.from, err = parseClock(bw.From); err != nil {
+			return err
+		}
+		if bw.to, err = parseClock(bw.To); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDays parses a list such as "mon-fri,sun".
+func parseDays(s string) (days [7]bool, err error) {
+	if s == "" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, item := range splitList(strings.ToLower(s)) {
+		first, last, _ := strings.Cut(item, "-")
+		if last == "" {
+			last = first
+		}
+		from, ok1 := weekdays[first]
+		to, ok2 := weekdays[last]
+		if !ok1 || !ok2 {
+			return days, fmt.Errorf("invalid days %q", item)
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses a time of day such as "09:30" into minutes after
+// midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseRate parses a number of bytes per second, which may end in K, M or
+// G for powers of 1024 (example: 5M). An empty rate is 0, for no limit.
+func parseRate(s string) (float64, error) {
+	n, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q, expected bytes per second such as 500K or 10M", s)
+	}
+	return n, nil
+}
+
+// parseSize parses a number of bytes, which may end in K, M, G or T for
+// powers of 1024 (example: 100G). An empty size is 0.
+func parseSize(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num, unit := s, float64(1)
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		unit = 1 << 10
+	case 'M', 'm':
+		unit = 1 << 20
+	case 'G', 'g':
+		unit = 1 << 30
+	case 'T', 't':
+		unit = 1 << 40
+	}
+	if unit > 1 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid size %q, expected bytes such as 500M or 100G", s)
+	}
+	return n * unit, nil
+}
+
+// active reports whether the window is in effect at t.
+func (bw *bandwidthWindow) active(t time.Time) bool {
+	if bw.From == "" {
+		return bw.days[t.Weekday()]
+	}
+	m := t.Hour()*60 + t.Minute()
+	if bw.from <= bw.to {
+		return bw.days[t.Weekday()] && m >= bw.from && m < bw.to
+	}
+	// Past midnight, the window started the day before.
+	if m >= bw.from {
+		return bw.days[t.Weekday()]
+	}
+	return m < bw.to && bw.days[(t.Weekday()+6)%7]
+}
+
+func (bw *bandwidthWindow) matches(bucket, object string) bool {
+	if bw.prefix == nil {
+		return true
+	}
+	return bw.prefix.matches(bucket) && strings.HasPrefix(object, bw.prefix.prefix)
+}
+
+// bandwidthLimit returns the cap for a response for the object at t: that of
+// the first window in effect matching it, or -bandwidth. It is nil for no
+// cap.
+func (s *server) bandwidthLimit(rules *rules, bucket, object string, t time.Time) *tokenBucket {
+	for i := range rules.bandwidth {
+		bw := &rules.bandwidth[i]
+		if bw.active(t) && bw.matches(bucket, object) {
+			return bw.limit
+		}
+	}
+	return s.globalBandwidth
+}
+
+// responseBandwidth returns the cap of each single response for objects of
+// the route in bytes per second, or 0 for none. A route's
+// responseBandwidth takes precedence over -response-bandwidth.
+func (s *server) responseBandwidth(rt *route) float64 {
+	if rt != nil && rt.responseRate != 0 {
+		return rt.responseRate
+	}
+	return s.responseRate
+}
+
+// throttle limits reading body to the response's own cap and the shared
+// bandwidth cap in effect. The shared cap is looked up again as the
+// response goes on, so long downloads follow the schedule.
+func (s *server) throttle(ctx context.Context, rules *rules, rt *route, bucket, object string, body io.Reader) io.Reader {
+	var own *tokenBucket
+	if rate := s.responseBandwidth(rt); rate > 0 {
+		own = newTokenBucket(rate)
+	}
+	if own == nil && len(rules.bandwidth) == 0 && s.globalBandwidth == nil {
+		return body
+	}
+	return &throttledReader{ctx: ctx, r: body, own: own, limit: func() *tokenBucket {
+		return s.bandwidthLimit(rules, bucket, object, time.Now())
+	}}
+}
+
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	own   *tokenBucket
+	limit func() *tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 && t.own != nil {
+		if werr := t.own.wait(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	if n > 0 {
+		if limit := t.limit(); limit != nil {
+			if werr := limit.wait(t.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+// tokenBucket allows rate bytes per second, with bursts of up to a second's
+// worth.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket refilled at rate tokens per second, which
+// holds a second's worth.
+func newTokenBucket(rate float64) *tokenBucket {
+	return newBurstBucket(rate, rate)
+}
+
+// newBurstBucket returns a bucket refilled at rate tokens per second, which
+// holds up to burst tokens.
+func newBurstBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill adds the tokens accrued since the last call. b.mu must be held.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take takes a token if there is one. Otherwise it returns false and how
+// long until there will be one.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely, so that it is
+// no different from a new one.
+func (b *tokenBucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	return b.tokens >= b.burst
+}
+
+// reserve takes n tokens and returns how long to wait before they may be
+// used. Tokens may be taken ahead, so concurrent readers queue up.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// wait blocks until n bytes may be sent, or ctx is done.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	d := b.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,93 @@
+package gcsproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certStore serves certificates from -tls-cert-dir, chosen by the server
+// name the client asks for: <host>.crt and <host>.key, or
+// _wildcard.<parent>.crt and .key for a wildcard certificate. Files are
+// reloaded when they change, so an ACME client writing renewed or new
+// certificates into the directory needs no restart.
+type certStore struct {
+	dir string
+	// known reports whether a certificate may be served for the host.
+	known func(host string) bool
+
+	mu    sync.Mutex
+	certs map[string]*cachedCert
+}
+
+type cachedCert struct {
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertStore returns a store of the certificates in dir. In -vhost mode
+// with a hosts section, only the hosts listed there get a certificate.
+func (s *server) newCertStore(dir string) *certStore {
+	known := func(host string) bool {
+		rules := s.activeRules()
+		if !s.virtualHosts || rules.hosts.empty() {
+			return true
+		}
+		_, ok := rules.hosts.lookup(host)
+		return ok
+	}
+	return &certStore{dir: dir, known: known, certs: make(map[string]*cachedCert)}
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if host == "" || strings.ContainsAny(host, `/\`) {
+		return nil, fmt.Errorf("tls: missing or invalid server name %q", hello.ServerName)
+	}
+	if !s.known(host) {
+		return nil, fmt.Errorf("tls: unknown host %q", host)
+	}
+	names := []string{host}
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		names = append(names, "_wildcard"+host[i:])
+	}
+	for _, name := range names {
+		cert, err := s.load(name)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			return cert, nil
+		}
+	}
+	return nil, fmt.Errorf("tls: no certificate for %q", host)
+}
+
+// load returns the certificate stored under name, or nil if there is none.
+func (s *certStore) load(name string) (*tls.Certificate, error) {
+	certFile := filepath.Join(s.dir, name+".crt")
+	fi, err := os.Stat(certFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.certs[name]; ok && c.modTime.Equal(fi.ModTime()) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, filepath.Join(s.dir, name+".key"))
+	if err != nil {
+		return nil, err
+	}
+	s.certs[name] = &cachedCert{cert: &cert, modTime: fi.ModTime()}
+	return &cert, nil
+}
@@ -0,0 +1,74 @@
+package gcsproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// transportTuned reports whether any of the -gcs-* transport flags is set.
+func (s *server) transportTuned() bool {
+	return s.gcsMaxIdleConnsPerHost > 0 || s.gcsMaxConnsPerHost > 0 || s.gcsIdleConnTimeout > 0 ||
+		s.gcsDialTimeout > 0 || s.gcsKeepAlive != 0 || s.gcsTLSHandshakeTimeout > 0 || s.gcsTLSSessionCache > 0
+}
+
+// gcsTransport returns the HTTP transport for GCS requests, the storage
+// library's default with the -gcs-* transport flags applied.
+func (s *server) gcsTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if s.gcsDialTimeout > 0 {
+		dialer.Timeout = s.gcsDialTimeout
+	}
+	if s.gcsKeepAlive != 0 {
+		// Negative values disable keep-alive probes.
+		dialer.KeepAlive = s.gcsKeepAlive
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if s.gcsMaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = s.gcsMaxIdleConnsPerHost
+		if t.MaxIdleConns < t.MaxIdleConnsPerHost {
+			t.MaxIdleConns = t.MaxIdleConnsPerHost
+		}
+	}
+	t.MaxConnsPerHost = s.gcsMaxConnsPerHost
+	if s.gcsIdleConnTimeout > 0 {
+		t.IdleConnTimeout = s.gcsIdleConnTimeout
+	}
+	if s.gcsTLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = s.gcsTLSHandshakeTimeout
+	}
+	if s.gcsTLSSessionCache > 0 {
+		t.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(s.gcsTLSSessionCache)}
+	}
+	return t
+}
+
+// transportOptions adds a client with the tuned transport to the client
+// options opts, which carry the credentials, if the transport flags are set.
+// gRPC clients don't use it.
+func (s *server) transportOptions(ctx context.Context, opts []option.ClientOption) ([]option.ClientOption, error) {
+	if !s.transportTuned() || s.useGRPC {
+		return opts, nil
+	}
+	scoped := append([]option.ClientOption{option.WithScopes(storage.ScopeFullControl, cloudPlatformScope)}, opts...)
+	rt, err := htransport.NewTransport(ctx, s.gcsTransport(), scoped...)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, option.WithHTTPClient(&http.Client{Transport: rt})), nil
+}
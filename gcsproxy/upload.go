@@ -0,0 +1,356 @@
+package gcsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// defaultUploadMaxSize is the largest file a route accepts if it
+	// doesn't set maxSize.
+	defaultUploadMaxSize = 10 << 20
+	// maxUploadFiles is the largest number of files one form may post.
+	maxUploadFiles = 20
+	// uploadMemory is how much of a form is kept in memory while it is
+	// checked; the rest is spooled to temporary files.
+	uploadMemory = 32 << 20
+)
+
+// uploadConfig is the upload setting of a route, which allows POST uploads
+// of the objects it covers:
+//
+//	{"bucket": "uploads", "prefix": "avatars/", "upload": {"maxSize": "2M", "contentTypes": ["image/*"]}}
+type uploadConfig struct {
+	// MaxSize is the largest file accepted, such as "2M".
+	MaxSize string `json:"maxSize,omitempty"`
+	// ContentTypes lists the accepted media types, which may end in /*
+	// for all subtypes. Any type is accepted if it is empty.
+	ContentTypes []string `json:"contentTypes,omitempty"`
+	// Overwrite allows uploads to replace existing objects.
+	Overwrite bool `json:"overwrite,omitempty"`
+
+	maxSize int64
+}
+
+func (u *uploadConfig) compile() error {
+	size, err := parseSize(u.MaxSize)
+	if err != nil {
+		return err
+	}
+	u.maxSize = int64(size)
+	if u.maxSize == 0 {
+		u.maxSize = defaultUploadMaxSize
+	}
+	for _, t := range u.ContentTypes {
+		if _, _, err := mime.ParseMediaType(t); err != nil {
+			return fmt.Errorf("invalid upload content type %q", t)
+		}
+	}
+	return nil
+}
+
+// allows reports whether files of the media type may be uploaded.
+func (u *uploadConfig) allows(mediaType string) bool {
+	if len(u.ContentTypes) == 0 {
+		return true
+	}
+	for _, t := range u.ContentTypes {
+		if strings.EqualFold(t, mediaType) ||
+			strings.HasSuffix(t, "/*") && strings.HasPrefix(strings.ToLower(mediaType), strings.ToLower(t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadBodyLimit is the largest form body accepted: as many of the largest
+// files any route accepts as a form may post, and room for the rest.
+func uploadBodyLimit(rules *rules) int64 {
+	var largest int64
+	for _, rt := range rules.routes {
+		if rt.Upload != nil && rt.Upload.maxSize > largest {
+			largest = rt.Upload.maxSize
+		}
+	}
+	return largest*maxUploadFiles + 1<<20
+}
+
+type uploadedObject struct {
+	Bucket      string `json:"bucket"`
+	Name        string `json:"name"`
+	Generation  int64  `json:"generation,string"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// pendingUpload is a posted file that passed the checks.
+type pendingUpload struct {
+	file        *multipart.FileHeader
+	object      string
+	contentType string
+	overwrite   bool
+}
+
+// storedUpload is a stored file and the generation it replaced, if any, so
+// that it can be rolled back.
+type storedUpload struct {
+	attr     *storage.ObjectAttrs
+	replaced int64
+}
+
+// upload stores the files of a multipart/form-data POST, as sent by HTML
+// forms. Posted to a directory, each file is stored under its file name in
+// that directory; posted to any other path, the single file is stored as
+// that object. Object names go through the rewrites as for reads. Every
+// file is checked before any is stored, and if storing one fails those
+// already stored are rolled back.
+func (s *server) upload(w http.ResponseWriter, r *http.Request) {
+	rules := s.activeRules()
+	bucket, object := s.target(rules, r)
+	if bucket == "" || !s.bucketAllowed(bucket) {
+		http.NotFound(w, r)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, uploadBodyLimit(rules))
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected a multipart/form-data body", http.StatusUnsupportedMediaType)
+		return
+	}
+	form, err := mr.ReadForm(uploadMemory)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "form is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("invalid multipart body: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer form.RemoveAll()
+
+	pending, ok := s.checkUploads(w, r, rules, bucket, object, form)
+	if !ok {
+		return
+	}
+	stored := make([]storedUpload, 0, len(pending))
+	for _, p := range pending {
+		u, err := s.storeUpload(r.Context(), r, bucket, p)
+		if err != nil {
+			s.rollbackUploads(bucket, stored)
+			var gerr *googleapi.Error
+			if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+				http.Error(w, fmt.Sprintf("object %s exists", p.object), http.StatusConflict)
+				return
+			}
+			s.handleError(w, err)
+			return
+		}
+		stored = append(stored, u)
+	}
+
+	result := struct {
+		Objects []uploadedObject `json:"objects"`
+	}{Objects: []uploadedObject{}}
+	for _, u := range stored {
+		s.logger.Printf("[upload] %s/%s (%d bytes, generation %d)", bucket, u.attr.Name, u.attr.Size, u.attr.Generation)
+		result.Objects = append(result.Objects, uploadedObject{
+			Bucket:      bucket,
+			Name:        u.attr.Name,
+			Generation:  u.attr.Generation,
+			Size:        u.attr.Size,
+			ContentType: u.attr.ContentType,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+// checkUploads checks every file of the form and returns those to store, or
+// false once the request has been answered.
+func (s *server) checkUploads(w http.ResponseWriter, r *http.Request, rules *rules, bucket, object string, form *multipart.Form) ([]pendingUpload, bool) {
+	fields := make([]string, 0, len(form.File))
+	for field := range form.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var files []*multipart.FileHeader
+	for _, field := range fields {
+		files = append(files, form.File[field]...)
+	}
+	dir := object == "" || isDirectory(object)
+	switch {
+	case len(files) == 0:
+		http.Error(w, "no files posted", http.StatusBadRequest)
+		return nil, false
+	case len(files) > maxUploadFiles:
+		http.Error(w, fmt.Sprintf("at most %d files can be posted at once", maxUploadFiles), http.StatusBadRequest)
+		return nil, false
+	case !dir && len(files) > 1:
+		http.Error(w, "only one file can be posted to an object", http.StatusBadRequest)
+		return nil, false
+	}
+	if _, err := s.requestKey(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	pending := make([]pendingUpload, 0, len(files))
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		name := object
+		if dir {
+			// Browsers send base names, but nothing stops other
+			// clients from sending paths.
+			if f.Filename == "" || f.Filename == "." || f.Filename == ".." || strings.ContainsAny(f.Filename, `/\`) {
+				http.Error(w, fmt.Sprintf("invalid file name %q", f.Filename), http.StatusBadRequest)
+				return nil, false
+			}
+			name = object + f.Filename
+		}
+		name, rt, ok := s.checkWrite(w, r, rules, bucket, name, func(rt *route) bool { return rt.Upload != nil })
+		if !ok {
+			return nil, false
+		}
+		if seen[name] {
+			http.Error(w, fmt.Sprintf("object %s is posted twice", name), http.StatusBadRequest)
+			return nil, false
+		}
+		seen[name] = true
+		if f.Size > rt.Upload.maxSize {
+			http.Error(w, fmt.Sprintf("file %s is larger than %d bytes", f.Filename, rt.Upload.maxSize), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		contentType := f.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !rt.Upload.allows(mediaType) {
+			http.Error(w, fmt.Sprintf("content type %q isn't accepted", contentType), http.StatusUnsupportedMediaType)
+			return nil, false
+		}
+		pending = append(pending, pendingUpload{file: f, object: name, contentType: contentType, overwrite: rt.Upload.Overwrite})
+	}
+	return pending, true
+}
+
+// uploadHandle returns a handle for writing the object with the request's
+// or the bucket's encryption key, if any.
+func (s *server) uploadHandle(r *http.Request, bucket, object string) *storage.ObjectHandle {
+	obj := s.bucketHandle(bucket, object).Object(object)
+	key, _ := s.requestKey(r)
+	if key == nil {
+		key = s.bucketKeys[bucket]
+	}
+	if key != nil {
+		obj = obj.Key(key)
+	}
+	return obj
+}
+
+// storeUpload stores a checked file. The write is conditional on the object
+// not existing or, if the route allows overwrites, on it still being the
+// generation found before, which is recorded for rollbacks.
+func (s *server) storeUpload(ctx context.Context, r *http.Request, bucket string, p pendingUpload) (storedUpload, error) {
+	var u storedUpload
+	obj := s.uploadHandle(r, bucket, p.object)
+	cond := storage.Conditions{DoesNotExist: true}
+	if p.overwrite {
+		attr, err := obj.Attrs(ctx)
+		switch {
+		case err == nil:
+			u.replaced = attr.Generation
+			cond = storage.Conditions{GenerationMatch: attr.Generation}
+		case err != storage.ErrObjectNotExist:
+			return u, err
+		}
+	}
+	f, err := p.file.Open()
+	if err != nil {
+		return u, err
+	}
+	defer f.Close()
+
+	// Cancelling the context before Close discards the upload.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ow := obj.If(cond).NewWriter(ctx)
+	ow.ContentType = p.contentType
+	if _, err := io.Copy(ow, f); err != nil {
+		cancel()
+		ow.Close()
+		return u, err
+	}
+	if err := ow.Close(); err != nil {
+		return u, err
+	}
+	u.attr = ow.Attrs()
+	return u, nil
+}
+
+// rollbackUploads undoes the stores of a form that couldn't be stored as a
+// whole: new objects are deleted, and replaced ones are restored from the
+// generation they replaced, which only versioned buckets keep. Objects
+// changed by someone else in the meantime are left alone.
+func (s *server) rollbackUploads(bucket string, stored []storedUpload) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, u := range stored {
+		obj := s.bucketHandle(bucket, u.attr.Name).Object(u.attr.Name)
+		current := obj.If(storage.Conditions{GenerationMatch: u.attr.Generation})
+		var err error
+		if u.replaced == 0 {
+			err = current.Delete(ctx)
+		} else {
+			_, err = current.CopierFrom(obj.Generation(u.replaced)).Run(ctx)
+		}
+		if err != nil {
+			s.warnf("upload-rollback", "Failed to roll back upload of %s/%s: %v", bucket, u.attr.Name, err)
+		}
+	}
+}
+
+// checkWrite maps the object path of a write through the rewrites, as for
+// reads, and reports whether the request may change the resulting object,
+// which needs a route for which enabled is true. It returns the object name
+// and its route; otherwise the request has been answered. Writes go through
+// the same access checks as reads.
+func (s *server) checkWrite(w http.ResponseWriter, r *http.Request, rules *rules, bucket, object string, enabled func(rt *route) bool) (string, *route, bool) {
+	object, status := rules.rewriteObject(bucket, object)
+	if status != 0 {
+		// Paths that redirect when read have no object to change.
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return "", nil, false
+	}
+	if !s.checkObjectName(w, object) {
+		return "", nil, false
+	}
+	rt, ok := s.checkRoute(w, rules, bucket, object)
+	if !ok {
+		return "", nil, false
+	}
+	if !s.objectAllowed(bucket, object) || rt == nil || !enabled(rt) || rt.store != nil {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return "", nil, false
+	}
+	if !checkClaims(w, r, rt, object) || !s.checkAPIKeyScope(w, r, bucket, object) || !s.checkACL(w, r, rules, bucket, object) || !s.checkTransport(w, r, rt.minTLS) {
+		return "", nil, false
+	}
+	return object, rt, true
+}
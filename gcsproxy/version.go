@@ -0,0 +1,38 @@
+package gcsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+)
+
+// Build information, set with -ldflags
+// "-X github.com/daichirata/gcsproxy/gcsproxy.version=...". The Makefile and
+// GoReleaser set these by default.
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"goVersion"`
+}
+
+func currentBuild() buildInfo {
+	return buildInfo{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("gcsproxy %s (commit %s, built %s, %s)", b.Version, b.Commit, b.Date, b.GoVersion)
+}
+
+// showVersion returns the build information.
+func showVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentBuild())
+}
@@ -0,0 +1,122 @@
+package gcsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// hostMapping is the value of an entry in the hosts section of the config
+// file: either just a bucket name or an object with the bucket and a prefix
+// prepended to object paths.
+//
+//	"hosts": {
+//	  "assets.example.com": "example-assets",
+//	  "*.sites.example.com": {"bucket": "example-sites", "prefix": "public/"}
+//	}
+//
+// Keys starting with "*." match any subdomain of the rest of the name.
+type hostMapping struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (m *hostMapping) UnmarshalJSON(data []byte) error {
+	var bucket string
+	if err := json.Unmarshal(data, &bucket); err == nil {
+		*m = hostMapping{Bucket: bucket}
+		return nil
+	}
+	type plain hostMapping
+	return json.Unmarshal(data, (*plain)(m))
+}
+
+type wildcardHost struct {
+	suffix  string // ".sites.example.com"
+	mapping hostMapping
+}
+
+// hostTable holds the compiled hosts section.
+type hostTable struct {
+	exact     map[string]hostMapping
+	wildcards []wildcardHost // longest suffix first
+}
+
+func newHostTable(hosts map[string]hostMapping) (*hostTable, error) {
+	t := &hostTable{exact: make(map[string]hostMapping)}
+	for host, m := range hosts {
+		if m.Bucket == "" {
+			return nil, fmt.Errorf("host %s: bucket is required", host)
+		}
+		host = strings.ToLower(host)
+		if strings.HasPrefix(host, "*.") {
+			t.wildcards = append(t.wildcards, wildcardHost{suffix: host[1:], mapping: m})
+		} else {
+			t.exact[host] = m
+		}
+	}
+	sort.Slice(t.wildcards, func(i, j int) bool {
+		return len(t.wildcards[i].suffix) > len(t.wildcards[j].suffix)
+	})
+	return t, nil
+}
+
+func (t *hostTable) empty() bool {
+	return len(t.exact) == 0 && len(t.wildcards) == 0
+}
+
+func (t *hostTable) lookup(host string) (hostMapping, bool) {
+	if m, ok := t.exact[host]; ok {
+		return m, true
+	}
+	for _, w := range t.wildcards {
+		if strings.HasSuffix(host, w.suffix) {
+			return w.mapping, true
+		}
+	}
+	return hostMapping{}, false
+}
+
+// reverse returns a host name and object path under which object of
+// bucket is served, if there is an exact mapping for it. Without mappings
+// the bucket name is the host name.
+func (t *hostTable) reverse(bucket, object string) (host, path string, ok bool) {
+	if t.empty() {
+		return bucket, object, true
+	}
+	for host, m := range t.exact {
+		if m.Bucket == bucket && strings.HasPrefix(object, m.Prefix) {
+			return host, strings.TrimPrefix(object, m.Prefix), true
+		}
+	}
+	return "", "", false
+}
+
+// requestHost returns the host name of the request, without port and in
+// lower case.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// hostTarget returns the bucket and object for a request in virtual-host
+// mode. The host name is looked up in the hosts section of the config file
+// or, if there are no mappings, used as the bucket name, as in GCS static
+// website hosting. The bucket is empty for unmapped hosts.
+func hostTarget(rules *rules, r *http.Request, path string) (bucket, object string) {
+	host := requestHost(r)
+	if rules.hosts.empty() {
+		return host, path
+	}
+	m, ok := rules.hosts.lookup(host)
+	if !ok {
+		return "", path
+	}
+	return m.Bucket, m.Prefix + path
+}
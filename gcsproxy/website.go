@@ -0,0 +1,127 @@
+package gcsproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// indexDocument returns the object name served for directory-style paths,
+// if any. A route's index takes precedence over -index-document.
+func (s *server) indexDocument(rt *route) string {
+	if rt != nil && rt.Index != "" {
+		return rt.Index
+	}
+	return s.indexDoc
+}
+
+// isDirectory reports whether object is a directory-style path, i.e. the
+// bucket root or a name ending in a slash.
+func isDirectory(object string) bool {
+	return object == "" || strings.HasSuffix(object, "/")
+}
+
+// cleanURLObject returns the object a clean URL such as about stands for
+// (about.html), if -clean-urls is set.
+func (s *server) cleanURLObject(object string) (string, bool) {
+	if !s.cleanURLs || isDirectory(object) || strings.HasSuffix(object, ".html") {
+		return "", false
+	}
+	return object + ".html", true
+}
+
+// cleanURLRedirect returns the clean URL to redirect a request for an .html
+// path to, if -clean-urls and -clean-urls-redirect are set: /about.html goes
+// to /about and /docs/index.html to /docs/ if index.html is the index
+// document.
+func (s *server) cleanURLRedirect(r *http.Request) (string, bool) {
+	if !s.cleanURLs || !s.cleanURLsRedirect {
+		return "", false
+	}
+	path := r.URL.EscapedPath()
+	if idx := s.indexDoc; idx != "" && strings.HasSuffix(path, "/"+idx) {
+		return strings.TrimSuffix(path, idx), true
+	}
+	if strings.HasSuffix(path, ".html") && !strings.HasSuffix(path, "/.html") {
+		return strings.TrimSuffix(path, ".html"), true
+	}
+	return "", false
+}
+
+// namesObject reports whether a folder path such as docs/ also names an
+// object the proxy may serve without the slash: docs, or docs.html with
+// -clean-urls.
+func (s *server) namesObject(ctx context.Context, bucket, dirName string) bool {
+	name := strings.TrimSuffix(dirName, "/")
+	if !s.objectAllowed(bucket, name) {
+		return false
+	}
+	if _, _, err := s.objectAttrs(ctx, bucket, name, false); err == nil {
+		return true
+	}
+	if clean, ok := s.cleanURLObject(name); ok {
+		_, _, err := s.objectAttrs(ctx, bucket, clean, false)
+		return err == nil
+	}
+	return false
+}
+
+// fallbackObject returns the object served in place of missing ones, if
+// any. A route's fallback takes precedence over -fallback.
+func (s *server) fallbackObject(rt *route) string {
+	if rt != nil && rt.Fallback != "" {
+		return rt.Fallback
+	}
+	return s.fallback
+}
+
+// objectAttrs returns a handle for the object and its attributes.
+func (s *server) objectAttrs(ctx context.Context, bucket, object string, gzipAcceptable bool) (*storage.ObjectHandle, *storage.ObjectAttrs, error) {
+	obj := s.objectHandle(bucket, object).ReadCompressed(gzipAcceptable)
+	var attr *storage.ObjectAttrs
+	err := s.withRetries(ctx, func() (err error) {
+		attr, err = obj.Attrs(ctx)
+		return err
+	})
+	return obj, attr, err
+}
+
+// notFoundPage returns the object served with 404 responses, if any. A
+// route's notFound page takes precedence over -not-found-page.
+func (s *server) notFoundPage(rt *route) string {
+	if rt != nil && rt.NotFound != "" {
+		return rt.NotFound
+	}
+	return s.notFoundObject
+}
+
+// notFound answers with a 404, with the bucket's not-found page as the body
+// if there is one.
+func (s *server) notFound(w http.ResponseWriter, r *http.Request, rt *route, bucket string) {
+	if page := s.notFoundPage(rt); page != "" && s.serveErrorObject(w, r, bucket, page, http.StatusNotFound) {
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// serveErrorObject serves an object with the given status. It returns false
+// if the object can't be read, leaving the response untouched.
+func (s *server) serveErrorObject(w http.ResponseWriter, r *http.Request, bucket, object string, status int) bool {
+	objr, err := s.bucketHandle(bucket, object).Object(object).NewReader(r.Context())
+	if err != nil {
+		s.warnf("error-page:"+bucket+"/"+object, "Error page %s/%s can't be read: %v", bucket, object, err)
+		return false
+	}
+	defer objr.Close()
+	keepErrorPage(w)
+	setStrHeader(w, "Content-Type", objr.Attrs.ContentType)
+	setStrHeader(w, "Content-Encoding", objr.Attrs.ContentEncoding)
+	setIntHeader(w, "Content-Length", objr.Attrs.Size)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	io.Copy(w, objr)
+	return true
+}
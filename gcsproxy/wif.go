@@ -0,0 +1,70 @@
+package gcsproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// credentialConfig is the part of a credentials file that tells service
+// account keys from workload identity federation configurations, which
+// let the proxy run outside GCP, for instance on AWS or with an OIDC
+// provider, without a long-lived key. Such configurations are created with
+// gcloud iam workload-identity-pools create-cred-config.
+type credentialConfig struct {
+	Type                           string `json:"type"`
+	Audience                       string `json:"audience"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+}
+
+// inspectCredentials logs whether the proxy's credentials, from -c or
+// GOOGLE_APPLICATION_CREDENTIALS, use workload identity federation, and
+// returns the service account they impersonate, if any.
+func (s *server) inspectCredentials() (string, error) {
+	path := s.credentials
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		return "", nil
+	}
+	data, err := readSecret(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	var cfg credentialConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	if cfg.Type != "external_account" {
+		return "", nil
+	}
+	// The URL ends in serviceAccounts/<email>:generateAccessToken.
+	email := cfg.ServiceAccountImpersonationURL
+	if i := strings.LastIndex(email, "/"); i >= 0 {
+		email = email[i+1:]
+	}
+	email, _, _ = strings.Cut(email, ":")
+	if email == "" {
+		s.logger.Printf("[credentials] using workload identity federation (%s)", cfg.Audience)
+	} else {
+		s.logger.Printf("[credentials] using workload identity federation (%s) as %s", cfg.Audience, email)
+	}
+	return email, nil
+}
+
+// signingAccount returns the service account that signs URLs for the
+// object, if the storage library can't tell from the credentials: the one
+// an account impersonates, -signing-account, or the one federated
+// credentials impersonate. Without one the library uses the credentials'
+// own service account.
+func (s *server) signingAccount(bucket, object string) string {
+	if a := s.accountFor(bucket, object); a != nil {
+		return a.Impersonate
+	}
+	if s.signingAccountFlag != "" {
+		return s.signingAccountFlag
+	}
+	return s.federatedSigner
+}
@@ -0,0 +1,109 @@
+#!/bin/sh
+# Integration tests: runs gcsproxy against fake-gcs-server, seeds objects
+# with metadata and checks the responses of the full handler.
+#
+# Usage: scripts/integration.sh
+#
+# fake-gcs-server is started with docker unless FAKE_GCS_HOST (host:port of
+# a running instance started with -scheme http) is set. Requires curl.
+set -eu
+
+cd "$(dirname "$0")/.."
+
+BUCKET=it-bucket
+PROXY_ADDR=127.0.0.1:${PROXY_PORT:-18080}
+FAKE_GCS_PORT=${FAKE_GCS_PORT:-14443}
+WORK=$(mktemp -d)
+PROXY_PID=
+CONTAINER=
+
+cleanup() {
+	[ -n "$PROXY_PID" ] && kill "$PROXY_PID" 2>/dev/null || true
+	[ -n "$CONTAINER" ] && docker rm -f "$CONTAINER" >/dev/null 2>&1 || true
+	rm -rf "$WORK"
+}
+trap cleanup EXIT INT TERM
+
+if [ -z "${FAKE_GCS_HOST:-}" ]; then
+	FAKE_GCS_HOST=localhost:$FAKE_GCS_PORT
+	CONTAINER=$(docker run -d --rm -p "$FAKE_GCS_PORT:4443" fsouza/fake-gcs-server \
+		-scheme http -public-host "$FAKE_GCS_HOST")
+fi
+GCS=http://$FAKE_GCS_HOST
+
+wait_for() {
+	for _ in $(seq 50); do
+		curl -s -o /dev/null "$1" && return 0
+		sleep 0.2
+	done
+	echo "timed out waiting for $1" >&2
+	exit 1
+}
+
+# upload <name> <content type> <metadata JSON> <content>
+upload() {
+	boundary=gcsproxy-integration
+	{
+		printf -- '--%s\r\nContent-Type: application/json\r\n\r\n' "$boundary"
+		printf '{"name": "%s", "contentType": "%s", "metadata": %s}\r\n' "$1" "$2" "$3"
+		printf -- '--%s\r\nContent-Type: %s\r\n\r\n%s\r\n--%s--\r\n' "$boundary" "$2" "$4" "$boundary"
+	} >"$WORK/upload"
+	curl -sf -o /dev/null -X POST \
+		-H "Content-Type: multipart/related; boundary=$boundary" \
+		--data-binary "@$WORK/upload" \
+		"$GCS/upload/storage/v1/b/$BUCKET/o?uploadType=multipart"
+}
+
+wait_for "$GCS/storage/v1/b"
+curl -sf -o /dev/null -X POST -H "Content-Type: application/json" \
+	-d "{\"name\": \"$BUCKET\"}" "$GCS/storage/v1/b?project=test"
+upload hello.txt text/plain '{}' 'hello, world'
+upload blocked.txt text/plain '{"Blocked": "true"}' 'secret'
+upload user.json application/json '{"userId": "42", "internal": "x"}' '{"ok": true}'
+
+go build -o "$WORK/gcsproxy" .
+STORAGE_EMULATOR_HOST=$FAKE_GCS_HOST "$WORK/gcsproxy" -b "$PROXY_ADDR" \
+	-block-if Blocked:true -pass-through userId >"$WORK/proxy.log" 2>&1 &
+PROXY_PID=$!
+wait_for "http://$PROXY_ADDR/"
+
+FAILED=0
+
+# check <name> <path> <expected status> <expected header line or body, or ""> [curl args...]
+check() {
+	name=$1 path=$2 status=$3 expect=$4
+	shift 4
+	got=$(curl -s -D "$WORK/headers" -o "$WORK/body" -w '%{http_code}' "$@" "http://$PROXY_ADDR/$BUCKET/$path")
+	if [ "$got" != "$status" ]; then
+		echo "FAIL $name: status $got, want $status"
+		FAILED=$((FAILED + 1))
+	elif [ -n "$expect" ] && ! tr -d '\r' <"$WORK/headers" | grep -qiF "$expect" && ! grep -qF "$expect" "$WORK/body"; then
+		echo "FAIL $name: no \"$expect\" in the response"
+		FAILED=$((FAILED + 1))
+	else
+		echo "ok   $name"
+	fi
+}
+
+check "serves objects" hello.txt 200 'hello, world'
+check "sets the content type" hello.txt 200 'Content-Type: text/plain'
+check "sets Last-Modified" hello.txt 200 'Last-Modified:'
+check "answers 404 for missing objects" missing.txt 404 ''
+check "answers 404 for -block-if objects" blocked.txt 404 ''
+check "passes -pass-through metadata" user.json 200 'X-Goog-Meta-Userid: 42'
+check "serves JSON objects" user.json 200 '{"ok": true}'
+if grep -qi 'X-Goog-Meta-Internal' "$WORK/headers"; then
+	echo "FAIL hides other metadata: X-Goog-Meta-Internal was sent"
+	FAILED=$((FAILED + 1))
+fi
+check "answers 304 when not modified" hello.txt 304 '' -H 'If-Modified-Since: Fri, 01 Jan 2100 00:00:00 GMT'
+check "serves objects modified since" hello.txt 200 'hello, world' -H 'If-Modified-Since: Thu, 01 Jan 2004 00:00:00 GMT'
+# Partial content isn't served; Range requests get the whole object.
+check "answers Range requests in full" hello.txt 200 'hello, world' -H 'Range: bytes=0-4'
+
+if [ "$FAILED" -gt 0 ]; then
+	echo "$FAILED check(s) failed; proxy log:"
+	cat "$WORK/proxy.log"
+	exit 1
+fi
+echo "all checks passed"